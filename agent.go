@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const ChannelAuthAgent = "auth-agent@openssh.com"
+
+// Replies of agentConfirm event, sent with agent escape command
+const (
+	AgentConfirmAllow = "allow"
+	AgentConfirmDeny  = "deny"
+)
+
+// agentSocket returns socket of local agent, SSH_AUTH_SOCK unless specified
+func agentSocket(socket string) (string, error) {
+	if socket != "" {
+		return socket, nil
+	}
+	if socket = os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		return socket, nil
+	}
+	if DefaultAgentSocket != "" {
+		return DefaultAgentSocket, nil
+	}
+	return "", fmt.Errorf("SSH_AUTH_SOCK is not set")
+}
+
+// forwardAgent lets remote use local agent at socket, through channels opened by server.
+// With confirm, every signing request waits for an agentConfirm event to be allowed.
+func forwardAgent(client *ssh.Client, session *ssh.Session, socket string, confirm bool) error {
+	socket, err := agentSocket(socket)
+	if err != nil {
+		return err
+	}
+
+	channels := client.HandleChannelOpen(ChannelAuthAgent)
+	if channels == nil {
+		return fmt.Errorf("agent forwarding is already set up")
+	}
+	go func() {
+		for newChannel := range channels {
+			go serveAgentChannel(newChannel, socket, confirm)
+		}
+	}()
+
+	LogDebug(LogLevelDebug2, "requesting agent forwarding to %s", socket)
+	if err = agent.RequestAgentForwarding(session); err != nil {
+		return fmt.Errorf("failed to request agent forwarding: %w", err)
+	}
+	return nil
+}
+
+func serveAgentChannel(newChannel ssh.NewChannel, socket string, confirm bool) {
+	conn, err := dialAgent(socket)
+	if err != nil {
+		LogError(fmt.Errorf("failed to connect to agent: %w", err))
+		_ = newChannel.Reject(ssh.ConnectionFailed, "agent is not available")
+		return
+	}
+	defer conn.Close()
+
+	channel, reqs, err := newChannel.Accept()
+	if err != nil {
+		LogError(fmt.Errorf("failed to accept agent channel: %w", err))
+		return
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(reqs)
+	LogDebug(LogLevelDebug1, "remote connected to agent")
+
+	if !confirm {
+		// Pass through as is, so that all extensions keep working
+		go func() {
+			_, _ = io.Copy(conn, channel)
+			_ = conn.Close()
+		}()
+		_, _ = io.Copy(channel, conn)
+		return
+	}
+
+	confirmingAgent := &ConfirmingAgent{
+		ExtendedAgent: agent.NewClient(conn),
+		confirmations: agentConfirmations,
+		timeout:       DefaultAgentConfirmTimeout,
+	}
+	if err = agent.ServeAgent(confirmingAgent, channel); err != nil && !errors.Is(err, io.EOF) {
+		LogDebug(LogLevelDebug1, "agent channel closed: %v", err)
+	}
+}
+
+// errForwardedAgentReadOnly refuses remote to manage keys of local agent
+var errForwardedAgentReadOnly = errors.New("not allowed on forwarded agent")
+
+// ConfirmingAgent asks for confirmation before signing with local agent, and refuses to manage its keys
+type ConfirmingAgent struct {
+	agent.ExtendedAgent
+	confirmations *AgentConfirmations
+	timeout       time.Duration
+}
+
+func (a *ConfirmingAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	if err := a.confirm(key); err != nil {
+		return nil, err
+	}
+	return a.ExtendedAgent.Sign(key, data)
+}
+
+func (a *ConfirmingAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	if err := a.confirm(key); err != nil {
+		return nil, err
+	}
+	return a.ExtendedAgent.SignWithFlags(key, data, flags)
+}
+
+func (a *ConfirmingAgent) Add(_ agent.AddedKey) error {
+	return errForwardedAgentReadOnly
+}
+
+func (a *ConfirmingAgent) Remove(_ ssh.PublicKey) error {
+	return errForwardedAgentReadOnly
+}
+
+func (a *ConfirmingAgent) RemoveAll() error {
+	return errForwardedAgentReadOnly
+}
+
+func (a *ConfirmingAgent) Lock(_ []byte) error {
+	return errForwardedAgentReadOnly
+}
+
+func (a *ConfirmingAgent) Unlock(_ []byte) error {
+	return errForwardedAgentReadOnly
+}
+
+func (a *ConfirmingAgent) confirm(key ssh.PublicKey) error {
+	// Comment helps to tell keys apart, not worth failing without it
+	comment := ""
+	if keys, err := a.List(); err == nil {
+		for _, k := range keys {
+			if bytes.Equal(k.Marshal(), key.Marshal()) {
+				comment = k.Comment
+				break
+			}
+		}
+	}
+
+	if !a.confirmations.request(key, comment, a.timeout) {
+		return fmt.Errorf("signing with %s is denied", ssh.FingerprintSHA256(key))
+	}
+	return nil
+}
+
+// AgentConfirmations tracks agentConfirm events waiting for reply
+type AgentConfirmations struct {
+	lock    sync.Mutex
+	lastID  int
+	pending map[string]chan bool
+}
+
+// agentConfirmations is shared by all agent channels, replies come from stdin of the only session
+var agentConfirmations = newAgentConfirmations()
+
+func newAgentConfirmations() *AgentConfirmations {
+	return &AgentConfirmations{pending: map[string]chan bool{}}
+}
+
+// request sends agentConfirm event and waits for its reply, which is denied if not arriving in time
+func (c *AgentConfirmations) request(key ssh.PublicKey, comment string, timeout time.Duration) bool {
+	c.lock.Lock()
+	c.lastID++
+	id := strconv.Itoa(c.lastID)
+	reply := make(chan bool, 1)
+	c.pending[id] = reply
+	c.lock.Unlock()
+
+	defer func() {
+		c.lock.Lock()
+		delete(c.pending, id)
+		c.lock.Unlock()
+	}()
+
+	evPayload := EventPayloadAgentConfirm{
+		ID:          id,
+		Fingerprint: ssh.FingerprintSHA256(key),
+		Type:        key.Type(),
+		Comment:     comment,
+		Timeout:     int(timeout.Seconds()),
+	}
+	if err := sendEvent(EventNameAgentConfirm, evPayload); err != nil {
+		LogError(err)
+		return false
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case allowed := <-reply:
+		LogDebug(LogLevelDebug1, "agent request %s allowed: %v", id, allowed)
+		return allowed
+	case <-expired:
+		LogDebug(LogLevelDebug1, "agent request %s timed out", id)
+		return false
+	}
+}
+
+// reply answers pending request, with command argument in "ID;allow" or "ID;deny" format
+func (c *AgentConfirmations) reply(arg string) error {
+	id, answer, ok := strings.Cut(arg, ";")
+	if !ok {
+		return fmt.Errorf("invalid agent reply %s, expected ID;%s or ID;%s", arg, AgentConfirmAllow, AgentConfirmDeny)
+	}
+
+	var allowed bool
+	switch answer {
+	case AgentConfirmAllow:
+		allowed = true
+	case AgentConfirmDeny:
+		allowed = false
+	default:
+		return fmt.Errorf("invalid agent reply %s, expected %s or %s", answer, AgentConfirmAllow, AgentConfirmDeny)
+	}
+
+	c.lock.Lock()
+	reply, ok := c.pending[id]
+	c.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("no pending agent request %s", id)
+	}
+	select {
+	case reply <- allowed:
+		return nil
+	default:
+		return fmt.Errorf("agent request %s is already replied", id)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestKeyring holds a new key with comment
+func newTestKeyring(t *testing.T) (agent.ExtendedAgent, ssh.PublicKey) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	keyring := agent.NewKeyring().(agent.ExtendedAgent)
+	if err = keyring.Add(agent.AddedKey{PrivateKey: priv, Comment: "candinya@nekops"}); err != nil {
+		t.Fatalf("failed to add key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("failed to create signer: %v", err)
+	}
+	return keyring, signer.PublicKey()
+}
+
+// replyWhenPending keeps trying to reply, till request is registered
+func replyWhenPending(t *testing.T, confirmations *AgentConfirmations, arg string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for confirmations.reply(arg) != nil {
+		if time.Now().After(deadline) {
+			t.Errorf("request is not pending for %s", arg)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_ConfirmingAgent(t *testing.T) {
+	testcases := []struct {
+		name      string
+		reply     string // empty for no reply
+		wantAllow bool
+	}{
+		{name: "allow", reply: "1;" + AgentConfirmAllow, wantAllow: true},
+		{name: "deny", reply: "1;" + AgentConfirmDeny, wantAllow: false},
+		{name: "timeout", wantAllow: false},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			keyring, key := newTestKeyring(t)
+			confirmingAgent := &ConfirmingAgent{
+				ExtendedAgent: keyring,
+				confirmations: newAgentConfirmations(),
+				timeout:       100 * time.Millisecond,
+			}
+			if testcase.reply != "" {
+				confirmingAgent.timeout = 5 * time.Second
+				go replyWhenPending(t, confirmingAgent.confirmations, testcase.reply)
+			}
+
+			signature, err := confirmingAgent.Sign(key, []byte("data"))
+			if !testcase.wantAllow {
+				if err == nil {
+					t.Errorf("got signature, want denied")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to sign: %v", err)
+			}
+			if err = key.Verify([]byte("data"), signature); err != nil {
+				t.Errorf("invalid signature: %v", err)
+			}
+		})
+	}
+}
+
+func Test_ConfirmingAgent_readOnly(t *testing.T) {
+	keyring, key := newTestKeyring(t)
+	confirmingAgent := &ConfirmingAgent{ExtendedAgent: keyring, confirmations: newAgentConfirmations()}
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	if err = confirmingAgent.Add(agent.AddedKey{PrivateKey: priv}); err == nil {
+		t.Errorf("got key added, want refused")
+	}
+	if err = confirmingAgent.Remove(key); err == nil {
+		t.Errorf("got key removed, want refused")
+	}
+	if err = confirmingAgent.RemoveAll(); err == nil {
+		t.Errorf("got keys removed, want refused")
+	}
+	if err = confirmingAgent.Lock([]byte("passphrase")); err == nil {
+		t.Errorf("got agent locked, want refused")
+	}
+	if err = confirmingAgent.Unlock([]byte("passphrase")); err == nil {
+		t.Errorf("got agent unlocked, want refused")
+	}
+
+	// Local agent is left as is
+	keys, err := keyring.List()
+	if err != nil {
+		t.Fatalf("failed to list keys: %v", err)
+	}
+	if len(keys) != 1 || string(keys[0].Marshal()) != string(key.Marshal()) {
+		t.Errorf("got keys %v, want the only key kept", keys)
+	}
+}
+
+func Test_AgentConfirmations_reply(t *testing.T) {
+	testcases := []struct {
+		name string
+		arg  string
+	}{
+		{name: "missing answer", arg: "1"},
+		{name: "invalid answer", arg: "1;maybe"},
+		{name: "not pending", arg: "2;allow"},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			if err := newAgentConfirmations().reply(testcase.arg); err == nil {
+				t.Errorf("got no error for %s", testcase.arg)
+			}
+		})
+	}
+}
+
+func Test_forwardAgent(t *testing.T) {
+	keyring, key := newTestKeyring(t)
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	agentListener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("unix socket is not available: %v", err)
+	}
+	defer agentListener.Close()
+	go func() {
+		for {
+			conn, err := agentListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_ = agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+
+	// Server lists keys through forwarded agent once requested
+	listed := make(chan []*agent.Key, 1)
+	client := newTestConnPair(t, []ssh.Signer{newTestSigner(t)}, nil, func(serverConn ssh.Conn, _ ssh.Channel, reqs <-chan *ssh.Request) {
+		for req := range reqs {
+			if req.Type != "auth-agent-req@openssh.com" {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			_ = req.Reply(true, nil)
+
+			channel, agentReqs, err := serverConn.OpenChannel(ChannelAuthAgent, nil)
+			if err != nil {
+				t.Errorf("failed to open agent channel: %v", err)
+				listed <- nil
+				return
+			}
+			defer channel.Close()
+			go ssh.DiscardRequests(agentReqs)
+			keys, err := agent.NewClient(channel).List()
+			if err != nil {
+				t.Errorf("failed to list keys: %v", err)
+			}
+			listed <- keys
+		}
+	})
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	defer session.Close()
+
+	if err = forwardAgent(client, session, socket, false); err != nil {
+		t.Fatalf("failed to forward agent: %v", err)
+	}
+
+	select {
+	case keys := <-listed:
+		if len(keys) != 1 || keys[0].Comment != "candinya@nekops" || string(keys[0].Marshal()) != string(key.Marshal()) {
+			t.Errorf("got keys %v, want the only key in local agent", keys)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for remote to list keys")
+	}
+}
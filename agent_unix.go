@@ -0,0 +1,15 @@
+//go:build !windows
+
+package main
+
+import (
+	"io"
+	"net"
+)
+
+// DefaultAgentSocket is used when SSH_AUTH_SOCK is not set, agent must be specified on unix
+const DefaultAgentSocket = ""
+
+func dialAgent(socket string) (io.ReadWriteCloser, error) {
+	return net.Dial("unix", socket)
+}
@@ -0,0 +1,21 @@
+//go:build windows
+
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// DefaultAgentSocket is named pipe of Windows OpenSSH agent service
+const DefaultAgentSocket = `\\.\pipe\openssh-ssh-agent`
+
+func dialAgent(socket string) (io.ReadWriteCloser, error) {
+	if strings.HasPrefix(socket, `\\.\pipe\`) {
+		// Named pipe can be used as a file
+		return os.OpenFile(socket, os.O_RDWR, 0)
+	}
+	return net.Dial("unix", socket)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+const (
+	sshMsgKexInit        = 20
+	kexInitNameListCount = 10     // kex, host key, cipher c2s/s2c, mac c2s/s2c, compression c2s/s2c, language c2s/s2c
+	kexInitRecordLimit   = 256000 // stop recording if KEXINIT is still not found
+)
+
+// Ciphers with built-in integrity, no MAC is negotiated for them
+var aeadCiphers = []string{"aes128-gcm@openssh.com", "aes256-gcm@openssh.com", "chacha20-poly1305@openssh.com"}
+
+// kexInitRecorder records the first KEXINIT packet of both sides, which are always in plain text.
+// golang.org/x/crypto/ssh doesn't expose negotiated algorithms, so they are calculated from these packets.
+type kexInitRecorder struct {
+	net.Conn
+
+	lock          sync.Mutex
+	read, written []byte // raw stream till KEXINIT is complete
+	isReadDone    bool
+	isWrittenDone bool
+}
+
+func newKexInitRecorder(conn net.Conn) *kexInitRecorder {
+	return &kexInitRecorder{Conn: conn}
+}
+
+func (r *kexInitRecorder) Read(b []byte) (int, error) {
+	n, err := r.Conn.Read(b)
+	r.record(&r.read, &r.isReadDone, b[:n])
+	return n, err
+}
+
+func (r *kexInitRecorder) Write(b []byte) (int, error) {
+	n, err := r.Conn.Write(b)
+	r.record(&r.written, &r.isWrittenDone, b[:n])
+	return n, err
+}
+
+func (r *kexInitRecorder) record(stream *[]byte, isDone *bool, b []byte) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if *isDone {
+		return
+	}
+
+	*stream = append(*stream, b...)
+	if _, isComplete := extractKexInit(*stream); isComplete || len(*stream) > kexInitRecordLimit {
+		*isDone = true
+	}
+}
+
+// negotiated calculates algorithms agreed by both sides, should be called after handshake
+func (r *kexInitRecorder) negotiated() (*EventPayloadConnectionInfo, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	clientKexInit, isComplete := extractKexInit(r.written)
+	if !isComplete {
+		return nil, fmt.Errorf("client KEXINIT not found")
+	}
+	serverKexInit, isComplete := extractKexInit(r.read)
+	if !isComplete {
+		return nil, fmt.Errorf("server KEXINIT not found")
+	}
+
+	clientNameLists, err := parseKexInit(clientKexInit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse client KEXINIT: %w", err)
+	}
+	serverNameLists, err := parseKexInit(serverKexInit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse server KEXINIT: %w", err)
+	}
+
+	// Client preference wins, same rule as RFC 4253 section 7.1
+	agreed := func(i int) string {
+		for _, algo := range clientNameLists[i] {
+			if arrayContains(serverNameLists[i], algo) {
+				return algo
+			}
+		}
+		return ""
+	}
+
+	info := &EventPayloadConnectionInfo{
+		Kex:     agreed(0),
+		HostKey: agreed(1),
+		Ciphers: [2]string{agreed(2), agreed(3)},
+	}
+	for i := range info.MACs {
+		if !arrayContains(aeadCiphers, info.Ciphers[i]) {
+			info.MACs[i] = agreed(4 + i)
+		}
+	}
+
+	return info, nil
+}
+
+// extractKexInit finds the first binary packet after version exchange, and returns its payload
+func extractKexInit(stream []byte) ([]byte, bool) {
+	// Skip lines before and including version line
+	for {
+		lineEnd := bytes.IndexByte(stream, '\n')
+		if lineEnd == -1 {
+			return nil, false
+		}
+		line := stream[:lineEnd]
+		stream = stream[lineEnd+1:]
+		if bytes.HasPrefix(line, []byte("SSH-")) {
+			break
+		}
+	}
+
+	// uint32 packet_length, byte padding_length, payload, padding
+	if len(stream) < 5 {
+		return nil, false
+	}
+	packetLength := binary.BigEndian.Uint32(stream)
+	if uint64(len(stream)) < 4+uint64(packetLength) {
+		return nil, false
+	}
+	paddingLength := uint32(stream[4])
+	if packetLength < paddingLength+1 {
+		// Malformed, stop looking
+		return nil, true
+	}
+
+	return stream[5 : 4+packetLength-paddingLength], true
+}
+
+func parseKexInit(payload []byte) ([kexInitNameListCount][]string, error) {
+	var nameLists [kexInitNameListCount][]string
+
+	// byte SSH_MSG_KEXINIT, byte[16] cookie, name-lists
+	if len(payload) < 17 || payload[0] != sshMsgKexInit {
+		return nameLists, fmt.Errorf("not a KEXINIT packet")
+	}
+
+	// Followed by bool and uint32 which are not needed
+	data := payload[17:]
+	for i := range nameLists {
+		if len(data) < 4 {
+			return nameLists, fmt.Errorf("truncated length")
+		}
+		length := binary.BigEndian.Uint32(data)
+		data = data[4:]
+		if uint32(len(data)) < length {
+			return nameLists, fmt.Errorf("truncated name-list")
+		}
+
+		if length > 0 {
+			nameLists[i] = strings.Split(string(data[:length]), ",")
+		}
+		data = data[length:]
+	}
+
+	return nameLists, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"golang.org/x/crypto/ssh"
+	"net"
+	"testing"
+)
+
+func Test_kexInitRecorder(t *testing.T) {
+	testcases := []struct {
+		name         string
+		clientConfig ssh.Config
+		serverConfig ssh.Config
+		wantInfo     EventPayloadConnectionInfo
+	}{
+		{
+			name: "client preference",
+			clientConfig: ssh.Config{
+				KeyExchanges: []string{"ecdh-sha2-nistp384", "curve25519-sha256"},
+				Ciphers:      []string{"aes256-ctr", "aes128-ctr"},
+				MACs:         []string{"hmac-sha2-512", "hmac-sha2-256"},
+			},
+			serverConfig: ssh.Config{
+				KeyExchanges: []string{"curve25519-sha256", "ecdh-sha2-nistp384"},
+				Ciphers:      []string{"aes128-ctr", "aes256-ctr"},
+				MACs:         []string{"hmac-sha2-256", "hmac-sha2-512"},
+			},
+			wantInfo: EventPayloadConnectionInfo{
+				Kex:     "ecdh-sha2-nistp384",
+				HostKey: ssh.KeyAlgoED25519,
+				Ciphers: [2]string{"aes256-ctr", "aes256-ctr"},
+				MACs:    [2]string{"hmac-sha2-512", "hmac-sha2-512"},
+			},
+		},
+		{
+			name: "server limits",
+			clientConfig: ssh.Config{
+				KeyExchanges: []string{"curve25519-sha256", "diffie-hellman-group14-sha256"},
+				Ciphers:      []string{"aes128-gcm@openssh.com", "aes128-ctr"},
+			},
+			serverConfig: ssh.Config{
+				KeyExchanges: []string{"diffie-hellman-group14-sha256"},
+				Ciphers:      []string{"aes128-ctr"},
+				MACs:         []string{"hmac-sha1"},
+			},
+			wantInfo: EventPayloadConnectionInfo{
+				Kex:     "diffie-hellman-group14-sha256",
+				HostKey: ssh.KeyAlgoED25519,
+				Ciphers: [2]string{"aes128-ctr", "aes128-ctr"},
+				MACs:    [2]string{"hmac-sha1", "hmac-sha1"},
+			},
+		},
+		{
+			name: "aead",
+			clientConfig: ssh.Config{
+				Ciphers: []string{"chacha20-poly1305@openssh.com"},
+			},
+			wantInfo: EventPayloadConnectionInfo{
+				Kex:     "curve25519-sha256",
+				HostKey: ssh.KeyAlgoED25519,
+				Ciphers: [2]string{"chacha20-poly1305@openssh.com", "chacha20-poly1305@openssh.com"},
+			},
+		},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			serverConfig := &ssh.ServerConfig{Config: testcase.serverConfig, NoClientAuth: true}
+			serverConfig.AddHostKey(newTestSigner(t))
+			clientPipe, err := net.Dial("tcp", newTestServer(t, serverConfig, nil, nil))
+			if err != nil {
+				t.Fatalf("failed to dial: %v", err)
+			}
+
+			recorder := newKexInitRecorder(clientPipe)
+			clientConn, _, _, err := ssh.NewClientConn(recorder, "candinya.com:22", &ssh.ClientConfig{
+				Config:          testcase.clientConfig,
+				User:            "root",
+				HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			})
+			if err != nil {
+				t.Fatalf("failed to connect: %v", err)
+			}
+			defer clientConn.Close()
+
+			info, err := recorder.negotiated()
+			if err != nil {
+				t.Fatalf("failed to get negotiated algorithms: %v", err)
+			}
+
+			if *info != testcase.wantInfo {
+				t.Errorf("Unexpected info: expected %+v, got %+v", testcase.wantInfo, *info)
+			}
+		})
+	}
+}
+
+func Test_extractKexInit(t *testing.T) {
+	packet := []byte{0, 0, 0, 12, 4, sshMsgKexInit, 1, 2, 3, 4, 5, 6, 7, 0, 0, 0, 0}
+
+	testcases := []struct {
+		name         string
+		stream       []byte
+		wantPayload  []byte
+		wantComplete bool
+	}{
+		{name: "no version", stream: []byte("SSH-2.0-Test"), wantComplete: false},
+		{name: "no packet", stream: []byte("SSH-2.0-Test\r\n"), wantComplete: false},
+		{name: "partial packet", stream: append([]byte("SSH-2.0-Test\r\n"), packet[:10]...), wantComplete: false},
+		{name: "complete", stream: append([]byte("SSH-2.0-Test\r\n"), packet...), wantPayload: packet[5:12], wantComplete: true},
+		{name: "banner lines", stream: append([]byte("Welcome\r\nSSH-2.0-Test\r\n"), packet...), wantPayload: packet[5:12], wantComplete: true},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			payload, isComplete := extractKexInit(testcase.stream)
+			if isComplete != testcase.wantComplete {
+				t.Errorf("Unexpected complete: expected %t, got %t", testcase.wantComplete, isComplete)
+			}
+			if string(payload) != string(testcase.wantPayload) {
+				t.Errorf("Unexpected payload: expected %v, got %v", testcase.wantPayload, payload)
+			}
+		})
+	}
+}
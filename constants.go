@@ -1,11 +1,138 @@
 package main
 
-import "time"
+import (
+	"golang.org/x/crypto/ssh"
+	"time"
+)
 
 const (
 	DefaultUser    = "root"
-	DefaultSSHPort = 22 // SSH port
-	DefaultTimeout = 30 * time.Second
+	DefaultSSHPort = 22               // SSH port
+	DefaultTimeout = 30 * time.Second // TCP connect
+
+	DefaultHandshakeTimeout = 30 * time.Second // version and key exchange
+	DefaultAuthTimeout      = 30 * time.Second // user authentication
+
+	DefaultHostKeyReplyTimeout = 5 * time.Minute // waiting for user to verify host key
+
+	DefaultServerAliveCountMax = 3 // disconnect after this many keepalive messages are not answered
+
+	DefaultDNSTimeout     = 5 * time.Second
+	DefaultDNSPayloadSize = 4096 // EDNS0 UDP payload size
 
 	DefaultBufferSize = 1024
+
+	DefaultBreakLength = 500 // milliseconds, when break command doesn't specify
+
+	DefaultAgentConfirmTimeout = 1 * time.Minute // waiting for reply of agentConfirm event, denied after
+
+	DefaultSFTPChunkSize    = 32 * 1024 // per read or write request, safe for all servers
+	DefaultSFTPRequests     = 16        // read or write requests in flight during transfer, so latency is not paid per chunk
+	DefaultProgressInterval = 200 * time.Millisecond
+
+	DefaultXAuthLocation = "xauth" // found in PATH
+
+	DefaultTerm         = "xterm-256color" // when neither --term nor TERM is set
+	DefaultTerminalRows = 24
+	DefaultTerminalCols = 80
+
+	KnownHostsHashMagic    = "|1|" // prefix of hashed hosts in known_hosts files
+	KnownHostsHashSaltSize = 20    // same as SHA1 digest size, like OpenSSH
+)
+
+const (
+	StrictHostKeyCheckingYes       = "yes"        // never add new keys, reject unknown or changed
+	StrictHostKeyCheckingAcceptNew = "accept-new" // add new keys without asking, reject changed
+	StrictHostKeyCheckingNo        = "no"         // add new keys without asking, allow changed ones without saving
+	StrictHostKeyCheckingOff       = "off"        // same as no
+	StrictHostKeyCheckingAsk       = "ask"        // ask user with hostKey event
+)
+
+const (
+	VerifyHostKeyDNSNo  = "no"  // don't look up SSHFP records
+	VerifyHostKeyDNSYes = "yes" // trust keys matching DNSSEC validated SSHFP records without asking
+	VerifyHostKeyDNSAsk = "ask" // only show matching result in hostKey event
+)
+
+var DefaultHostKeyAlgorithms = []string{
+	// Most secure one
+	ssh.KeyAlgoED25519,
+
+	// Relatively secure ones
+	ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoECDSA384,
+	ssh.KeyAlgoECDSA256,
+
+	// Keep for backward compatibility
+	ssh.KeyAlgoRSA,
+}
+
+// Defaults of golang.org/x/crypto/ssh client, base of option lists starting with +, - or ^
+var (
+	DefaultCiphers = []string{
+		"aes128-gcm@openssh.com", "aes256-gcm@openssh.com",
+		"chacha20-poly1305@openssh.com",
+		"aes128-ctr", "aes192-ctr", "aes256-ctr",
+	}
+
+	DefaultKexAlgorithms = []string{
+		"curve25519-sha256", "curve25519-sha256@libssh.org",
+		"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha256", "diffie-hellman-group14-sha1",
+	}
+
+	DefaultMACs = []string{
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com",
+		"hmac-sha2-256", "hmac-sha2-512",
+		"hmac-sha1", "hmac-sha1-96",
+	}
+
+	DefaultPubkeyAcceptedAlgorithms = []string{
+		ssh.KeyAlgoED25519,
+		ssh.KeyAlgoECDSA521, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA256,
+		ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256,
+	}
+)
+
+// Algorithms supported by golang.org/x/crypto/ssh client, to validate options
+var (
+	SupportedCiphers = []string{
+		"aes128-gcm@openssh.com", "aes256-gcm@openssh.com",
+		"chacha20-poly1305@openssh.com",
+		"aes128-ctr", "aes192-ctr", "aes256-ctr",
+
+		// Insecure, only for legacy servers
+		"aes128-cbc", "3des-cbc",
+		"arcfour256", "arcfour128", "arcfour",
+	}
+
+	SupportedKexAlgorithms = []string{
+		"curve25519-sha256", "curve25519-sha256@libssh.org",
+		"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha256", "diffie-hellman-group16-sha512",
+		"diffie-hellman-group-exchange-sha256",
+
+		// Insecure, only for legacy servers
+		"diffie-hellman-group14-sha1", "diffie-hellman-group1-sha1",
+		"diffie-hellman-group-exchange-sha1",
+	}
+
+	SupportedMACs = []string{
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com",
+		"hmac-sha2-256", "hmac-sha2-512",
+
+		// Insecure, only for legacy servers
+		"hmac-sha1", "hmac-sha1-96",
+	}
+
+	SupportedHostKeyAlgorithms = []string{
+		ssh.KeyAlgoED25519,
+		ssh.KeyAlgoECDSA521, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA256,
+		ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256,
+
+		// Insecure, only for legacy servers
+		ssh.KeyAlgoRSA, ssh.KeyAlgoDSA,
+	}
+
+	SupportedPubkeyAcceptedAlgorithms = SupportedHostKeyAlgorithms // security keys (sk-*) are not supported
 )
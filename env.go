@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"path"
+	"strings"
+)
+
+const RequestEnv = "env"
+
+// sessionEnv lists variables to be sent in order, local ones matching SendEnv patterns come first, SetEnv overrides them
+func sessionEnv(sendEnv []string, setEnv [][2]string, environ []string) [][2]string {
+	var env [][2]string
+	for _, kv := range environ {
+		name, value, ok := strings.Cut(kv, "=")
+		if !ok || name == "" {
+			continue
+		}
+		for _, pattern := range sendEnv {
+			if matched, _ := path.Match(pattern, name); matched {
+				env = append(env, [2]string{name, value})
+				break
+			}
+		}
+	}
+
+	for _, kv := range setEnv {
+		replaced := false
+		for i := range env {
+			if env[i][0] == kv[0] {
+				env[i][1] = kv[1]
+				replaced = true
+			}
+		}
+		if !replaced {
+			env = append(env, kv)
+		}
+	}
+
+	return env
+}
+
+// sendSessionEnv requests each variable to be set, servers usually only accept those listed in AcceptEnv
+func sendSessionEnv(session *ssh.Session, env [][2]string) (*EventPayloadEnvironment, error) {
+	evPayload := &EventPayloadEnvironment{}
+	for _, kv := range env {
+		ok, err := session.SendRequest(RequestEnv, true, ssh.Marshal(struct {
+			Name  string
+			Value string
+		}{kv[0], kv[1]}))
+		if err != nil {
+			return nil, fmt.Errorf("failed to send env %s: %w", kv[0], err)
+		}
+		if ok {
+			LogDebug(LogLevelDebug2, "sent env %s", kv[0])
+			evPayload.Accepted = append(evPayload.Accepted, kv[0])
+		} else {
+			LogDebug(LogLevelDebug1, "env %s refused by server", kv[0])
+			evPayload.Refused = append(evPayload.Refused, kv[0])
+		}
+	}
+	return evPayload, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"golang.org/x/crypto/ssh"
+	"reflect"
+	"testing"
+)
+
+func Test_sessionEnv(t *testing.T) {
+	environ := []string{"LANG=zh_CN.UTF-8", "LC_ALL=C", "LC_TIME=en_GB.UTF-8", "HOME=/root", "EMPTY=", "=C:=C:\\"}
+
+	testcases := []struct {
+		name    string
+		sendEnv []string
+		setEnv  [][2]string
+		want    [][2]string
+	}{
+		{
+			name: "nothing",
+		},
+		{
+			name:    "patterns",
+			sendEnv: []string{"LANG", "LC_*", "EMPTY"},
+			want:    [][2]string{{"LANG", "zh_CN.UTF-8"}, {"LC_ALL", "C"}, {"LC_TIME", "en_GB.UTF-8"}, {"EMPTY", ""}},
+		},
+		{
+			name:    "missing locally",
+			sendEnv: []string{"EDITOR"},
+		},
+		{
+			name:   "set",
+			setEnv: [][2]string{{"APP_MODE", "debug"}, {"GREETING", "hello world"}},
+			want:   [][2]string{{"APP_MODE", "debug"}, {"GREETING", "hello world"}},
+		},
+		{
+			name:    "set overrides send",
+			sendEnv: []string{"LANG"},
+			setEnv:  [][2]string{{"LANG", "en_US.UTF-8"}},
+			want:    [][2]string{{"LANG", "en_US.UTF-8"}},
+		},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			env := sessionEnv(testcase.sendEnv, testcase.setEnv, environ)
+			if !reflect.DeepEqual(env, testcase.want) {
+				t.Errorf("Unexpected env: expected %v, got %v", testcase.want, env)
+			}
+		})
+	}
+}
+
+func Test_sendSessionEnv(t *testing.T) {
+	received := make(chan [2]string, 3)
+	client := newTestConnPair(t, []ssh.Signer{newTestSigner(t)}, nil, func(_ ssh.Conn, _ ssh.Channel, reqs <-chan *ssh.Request) {
+		for req := range reqs {
+			var kv struct {
+				Name  string
+				Value string
+			}
+			if err := ssh.Unmarshal(req.Payload, &kv); err != nil {
+				_ = req.Reply(false, nil)
+				continue
+			}
+			received <- [2]string{kv.Name, kv.Value}
+
+			// Like AcceptEnv LANG LC_*
+			_ = req.Reply(kv.Name == "LANG", nil)
+		}
+	})
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	defer session.Close()
+
+	env := [][2]string{{"LANG", "zh_CN.UTF-8"}, {"APP_MODE", "debug"}}
+	evPayload, err := sendSessionEnv(session, env)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for _, kv := range env {
+		if got := <-received; got != kv {
+			t.Errorf("Unexpected variable: expected %v, got %v", kv, got)
+		}
+	}
+	if !reflect.DeepEqual(evPayload.Accepted, []string{"LANG"}) {
+		t.Errorf("Unexpected accepted: %v", evPayload.Accepted)
+	}
+	if !reflect.DeepEqual(evPayload.Refused, []string{"APP_MODE"}) {
+		t.Errorf("Unexpected refused: %v", evPayload.Refused)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"net"
+)
+
+// Error codes reported in error event, stable for Nekops to match
+const (
+	ErrorCodeUnknown         = "unknown"
+	ErrorCodeUsage           = "usage"             // invalid arguments or options
+	ErrorCodeDNS             = "dns"               // failed to resolve hostname
+	ErrorCodeRefused         = "refused"           // connection refused
+	ErrorCodeUnreachable     = "unreachable"       // no route to host or network
+	ErrorCodeTimeout         = "timeout"           // any phase timed out
+	ErrorCodeHandshakeFailed = "handshake-failed"  // e.g. no common algorithm, connection closed by server
+	ErrorCodeHostKeyRejected = "host-key-rejected" // by user or StrictHostKeyChecking
+	ErrorCodeAuthFailed      = "auth-failed"       // all auth methods failed
+	ErrorCodeJumpFailed      = "jump-failed"       // jump server refused to open tunnel to target
+	ErrorCodeSessionFailed   = "session-failed"    // failed to open session channel
+	ErrorCodePtyDenied       = "pty-denied"        // server refused pty request
+	ErrorCodeShellFailed     = "shell-failed"      // server refused to start shell
+	ErrorCodeDisconnected    = "disconnected"      // connection lost before remote exited
+	ErrorCodeSubsystemFailed = "subsystem-failed"  // server refused to start subsystem
+	ErrorCodeTransferFailed  = "transfer-failed"   // file transfer rejected or aborted by remote
+)
+
+// errorExitCodes maps error codes to process exit codes, unknown errors exit with 1
+var errorExitCodes = map[string]int{
+	ErrorCodeUnknown:         1,
+	ErrorCodeUsage:           2,
+	ErrorCodeDNS:             10,
+	ErrorCodeRefused:         11,
+	ErrorCodeUnreachable:     12,
+	ErrorCodeTimeout:         13,
+	ErrorCodeHandshakeFailed: 14,
+	ErrorCodeHostKeyRejected: 15,
+	ErrorCodeAuthFailed:      16,
+	ErrorCodeJumpFailed:      17,
+	ErrorCodeSessionFailed:   20,
+	ErrorCodePtyDenied:       21,
+	ErrorCodeShellFailed:     22,
+	ErrorCodeDisconnected:    23,
+	ErrorCodeSubsystemFailed: 24,
+	ErrorCodeTransferFailed:  25,
+}
+
+// CodedError marks err with a code which can't be told from its type
+type CodedError struct {
+	Code string
+	Err  error
+}
+
+func (e *CodedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *CodedError) Unwrap() error {
+	return e.Err
+}
+
+func withCode(code string, err error) error {
+	return &CodedError{Code: code, Err: err}
+}
+
+// HopError tells which hop err happened on
+type HopError struct {
+	Hop string
+	Err error
+}
+
+func (e *HopError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *HopError) Unwrap() error {
+	return e.Err
+}
+
+func withHop(hop string, err error) error {
+	return &HopError{Hop: hop, Err: err}
+}
+
+// classifyError finds code and hop of err, explicitly marked code takes precedence
+func classifyError(err error) (code string, hop string) {
+	var hopErr *HopError
+	if errors.As(err, &hopErr) {
+		hop = hopErr.Hop
+	}
+
+	var (
+		codedErr       *CodedError
+		timeoutErr     *TimeoutError
+		dnsErr         *net.DNSError
+		openChannelErr *ssh.OpenChannelError
+	)
+	switch {
+	case errors.As(err, &codedErr):
+		code = codedErr.Code
+	case errors.As(err, &timeoutErr):
+		code = ErrorCodeTimeout
+	case errors.As(err, &dnsErr):
+		code = ErrorCodeDNS
+	case isConnectionRefused(err):
+		code = ErrorCodeRefused
+	case isUnreachable(err):
+		code = ErrorCodeUnreachable
+	case errors.As(err, &openChannelErr):
+		code = ErrorCodeJumpFailed
+	default:
+		code = ErrorCodeUnknown
+	}
+
+	return code, hop
+}
+
+// reportError logs err and sends it as error event, returns exit code for it
+func reportError(err error) int {
+	LogError(err)
+
+	code, hop := classifyError(err)
+	if eventErr := sendEvent(EventNameError, EventPayloadError{
+		Code:   code,
+		Hop:    hop,
+		Detail: err.Error(),
+	}); eventErr != nil {
+		LogError(eventErr)
+	}
+
+	return errorExitCode(code)
+}
+
+func errorExitCode(code string) int {
+	if exitCode, ok := errorExitCodes[code]; ok {
+		return exitCode
+	}
+	return errorExitCodes[ErrorCodeUnknown]
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_classifyError(t *testing.T) {
+	// Find a closed port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	closedAddress := listener.Addr().String()
+	_ = listener.Close()
+	_, refusedErr := net.Dial("tcp", closedAddress)
+	if refusedErr == nil {
+		t.Fatalf("port %s is not closed", closedAddress)
+	}
+
+	testcases := []struct {
+		name     string
+		err      error
+		wantCode string
+		wantHop  string
+	}{
+		{
+			name:     "unknown",
+			err:      errors.New("something wrong"),
+			wantCode: ErrorCodeUnknown,
+		},
+		{
+			name:     "coded",
+			err:      fmt.Errorf("failed to request pty: %w", withCode(ErrorCodePtyDenied, errors.New("denied"))),
+			wantCode: ErrorCodePtyDenied,
+		},
+		{
+			name:     "timeout",
+			err:      withHop(HopJump, fmt.Errorf("failed to dial: %w", &TimeoutError{Phase: PhaseConnect, Timeout: time.Second})),
+			wantCode: ErrorCodeTimeout,
+			wantHop:  HopJump,
+		},
+		{
+			name:     "dns",
+			err:      withHop(HopTarget, &net.DNSError{Err: "no such host", Name: "candinya.invalid", IsNotFound: true}),
+			wantCode: ErrorCodeDNS,
+			wantHop:  HopTarget,
+		},
+		{
+			name:     "refused",
+			err:      withHop(HopTarget, fmt.Errorf("failed to dial: %w", refusedErr)),
+			wantCode: ErrorCodeRefused,
+			wantHop:  HopTarget,
+		},
+		{
+			name:     "tunnel rejected",
+			err:      withHop(HopJump, &ssh.OpenChannelError{Reason: ssh.Prohibited, Message: "administratively prohibited"}),
+			wantCode: ErrorCodeJumpFailed,
+			wantHop:  HopJump,
+		},
+		{
+			name:     "code overrides type",
+			err:      withCode(ErrorCodeHostKeyRejected, &TimeoutError{Phase: PhaseHostKeyPrompt}),
+			wantCode: ErrorCodeHostKeyRejected,
+		},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			code, hop := classifyError(testcase.err)
+			if code != testcase.wantCode {
+				t.Errorf("Unexpected code: expected %s, got %s", testcase.wantCode, code)
+			}
+			if hop != testcase.wantHop {
+				t.Errorf("Unexpected hop: expected %q, got %q", testcase.wantHop, hop)
+			}
+		})
+	}
+}
+
+func Test_newClient_errors(t *testing.T) {
+	testcases := []struct {
+		name       string
+		rejectKey  bool // user rejects host key
+		badAuth    bool // server rejects password
+		badCiphers bool // no common cipher
+		wantCode   string
+	}{
+		{name: "host key rejected", rejectKey: true, wantCode: ErrorCodeHostKeyRejected},
+		{name: "auth failed", badAuth: true, wantCode: ErrorCodeAuthFailed},
+		{name: "handshake failed", badCiphers: true, wantCode: ErrorCodeHandshakeFailed},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			serverConfig := &ssh.ServerConfig{
+				PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+					if testcase.badAuth {
+						return nil, errors.New("wrong password")
+					}
+					return nil, nil
+				},
+			}
+			if testcase.badCiphers {
+				serverConfig.Ciphers = []string{"aes128-ctr"}
+			}
+			serverConfig.AddHostKey(newTestSigner(t))
+			conn, err := net.Dial("tcp", newTestServer(t, serverConfig, nil, nil))
+			if err != nil {
+				t.Fatalf("failed to dial: %v", err)
+			}
+
+			clientConfig := &ssh.ClientConfig{
+				User: "root",
+				Auth: []ssh.AuthMethod{ssh.Password("password")},
+				HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+					if testcase.rejectKey {
+						return fmt.Errorf("user rejected")
+					}
+					return nil
+				},
+			}
+			if testcase.badCiphers {
+				clientConfig.Ciphers = []string{"chacha20-poly1305@openssh.com"}
+			}
+
+			client, err := newClient(conn, "candinya.com:22", clientConfig, nil, HopTarget, &Server{
+				ConnectionConfig: &ConnectionConfig{},
+				Timing:           &HopTiming{},
+			})
+			if err == nil {
+				_ = client.Close()
+				t.Fatalf("Unexpected success")
+			}
+
+			if code, _ := classifyError(err); code != testcase.wantCode {
+				t.Errorf("Unexpected code: expected %s, got %s (%v)", testcase.wantCode, code, err)
+			}
+		})
+	}
+}
@@ -3,4 +3,8 @@ package main
 var (
 	EscapeWindowChangePrefix = []byte("\x1B[8;")
 	EscapeWindowChangeSuffix = byte('t') // We only require this so it has been hard-encoded (compare func and length)
+
+	// Private OSC sequence for commands to pipessh itself, e.g. "\x1B]pipessh;signal;INT\a"
+	EscapeCommandPrefix = []byte("\x1B]pipessh;")
+	EscapeCommandSuffix = byte('\a')
 )
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"os"
 )
 
 const (
@@ -14,6 +15,22 @@ const (
 const (
 	EventNameHostKey  = "hostKey"  // new server, never seen before
 	EventNameSSHStart = "sshStart" // pipe stdin/stdout/stderr to ssh from now on
+
+	EventNameHostKeysUpdated = "hostKeysUpdated" // server rotated its keys, known_hosts updated
+	EventNameConnectionInfo  = "connectionInfo"  // handshake with a hop finished
+	EventNameTiming          = "timing"          // remote shell started, how long each phase took
+	EventNameError           = "error"           // fatal error, process exits right after
+	EventNameEnvironment     = "environment"     // environment variables sent to server
+
+	EventNameAgentConfirm = "agentConfirm" // remote wants to sign with forwarded agent, reply required
+
+	EventNameSFTPResult       = "sftpResult"       // sftp command finished
+	EventNameTransferProgress = "transferProgress" // file transfer is going on
+)
+
+const (
+	HopTarget = "target"
+	HopJump   = "jump"
 )
 
 type EventPayloadHostKey struct {
@@ -21,6 +38,93 @@ type EventPayloadHostKey struct {
 	Fingerprint     string   `json:"fp"`
 	HostWithSameKey []string `json:"s,omitempty"`
 	OldFingerprint  *string  `json:"o,omitempty"`
+
+	// Details for user to verify
+	KeyType        string `json:"t"`
+	KeyBits        int    `json:"b,omitempty"`
+	FingerprintMD5 string `json:"md5"`
+	RandomArt      string `json:"art"`
+	KnownHostsLine string `json:"l"`                  // line to be written when saved
+	DNSMatch       *bool  `json:"dnsMatch,omitempty"` // whether SSHFP records match, omitted if not checked or no records
+
+	// How to reply
+	Replies []string `json:"r"`
+	Timeout int      `json:"to"` // seconds, 0 means no limit
+}
+
+// Replies to hostKey event, send one of them as a line to stdin
+const (
+	HostKeyReplyAcceptOnce    = "accept-once"     // connect, but don't save the key
+	HostKeyReplyAcceptAndSave = "accept-and-save" // connect and save the key
+	HostKeyReplyReject        = "reject"          // abort connection
+)
+
+type EventPayloadHostKeysUpdated struct {
+	Host    string   `json:"h"`
+	Added   []string `json:"a,omitempty"`
+	Removed []string `json:"r,omitempty"`
+}
+
+type EventPayloadConnectionInfo struct {
+	Hop           string    `json:"hop"` // target or jump
+	Host          string    `json:"h"`
+	ServerVersion string    `json:"v"`
+	Kex           string    `json:"kex"`
+	HostKey       string    `json:"hk"`
+	Ciphers       [2]string `json:"c"` // client to server, server to client
+	MACs          [2]string `json:"m"` // empty when cipher has built-in integrity (AEAD)
+}
+
+type EventPayloadTiming struct {
+	Hops []*HopTiming `json:"hops"` // in connecting order, jump first
+
+	// Milliseconds, on target server
+	Session float64 `json:"session"`
+	Pty     float64 `json:"pty"`
+	Shell   float64 `json:"shell"` // or subsystem
+}
+
+type EventPayloadEnvironment struct {
+	Accepted []string `json:"a,omitempty"`
+	Refused  []string `json:"r,omitempty"` // usually not listed in AcceptEnv of server
+}
+
+type EventPayloadAgentConfirm struct {
+	ID          string `json:"id"` // used in reply
+	Fingerprint string `json:"fp"`
+	Type        string `json:"t"`
+	Comment     string `json:"c,omitempty"`
+	Timeout     int    `json:"to"` // seconds, 0 means no limit
+}
+
+type EventPayloadSFTPEntry struct {
+	Name    string `json:"n"`
+	Size    uint64 `json:"s"`
+	Mode    uint32 `json:"m"` // permissions with file type bits, like st_mode
+	ModTime uint32 `json:"t"` // unix timestamp
+	IsDir   bool   `json:"d"`
+}
+
+type EventPayloadSFTPResult struct {
+	ID      string                  `json:"id"`
+	OK      bool                    `json:"ok"`
+	Error   string                  `json:"e,omitempty"`
+	Entries []EventPayloadSFTPEntry `json:"entries,omitempty"` // for list
+	Stat    *EventPayloadSFTPEntry  `json:"stat,omitempty"`    // for stat
+}
+
+type EventPayloadTransferProgress struct {
+	ID          string  `json:"id"`
+	Transferred int64   `json:"b"` // including resumed part
+	Total       int64   `json:"t"`
+	Rate        float64 `json:"rate"` // bytes per second
+	ETA         float64 `json:"eta"`  // seconds
+}
+
+type EventPayloadError struct {
+	Code   string `json:"code"`
+	Hop    string `json:"hop,omitempty"` // omitted if not related to any hop
+	Detail string `json:"detail"`
 }
 
 func buildEvent(name string, payload any) ([]byte, error) {
@@ -37,3 +141,15 @@ func buildEvent(name string, payload any) ([]byte, error) {
 	data = append(data, EventTransmitEnd)
 	return data, nil
 }
+
+// sendEvent writes event to stdout, where Nekops is listening
+func sendEvent(name string, payload any) error {
+	eventBytes, err := buildEvent(name, payload)
+	if err != nil {
+		return fmt.Errorf("failed to build %s event: %w", name, err)
+	}
+	if _, err = os.Stdout.Write(eventBytes); err != nil {
+		return fmt.Errorf("failed to write %s event: %w", name, err)
+	}
+	return nil
+}
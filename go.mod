@@ -2,6 +2,10 @@ module pipessh
 
 go 1.24.1
 
-require golang.org/x/crypto v0.37.0
-
-require golang.org/x/sys v0.32.0 // indirect
+require (
+	golang.org/x/crypto v0.37.0
+	golang.org/x/net v0.39.0
+	golang.org/x/sync v0.13.0
+	golang.org/x/sys v0.32.0
+	golang.org/x/term v0.31.0
+)
@@ -3,46 +3,113 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"golang.org/x/crypto/ssh"
 	"io"
+	"math"
 	"net"
 	"os"
 	"strings"
+	"sync"
+	"time"
 )
 
-func prepareHostKeyHandler(knownHostsFilePath string) func(string, net.Addr, ssh.PublicKey) error {
+func prepareHostKeyHandler(hostKeyConfig *HostKeyConfig) func(string, net.Addr, ssh.PublicKey) error {
 	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-		rawHostname, friendlyHostname, err := extractHostname(hostname)
-		if err != nil {
-			return fmt.Errorf("failed to extract hostname %s: %w", hostname, err)
-		}
+		_, err := verifyHostKey(hostKeyConfig, hostname, remote, key)
+		return err
+	}
+}
 
-		var rawAddr string
-		if remote.(*net.TCPAddr).Port == DefaultSSHPort {
-			rawAddr = remote.(*net.TCPAddr).IP.String()
-		} else {
-			rawAddr = fmt.Sprintf("[%s]:%d", remote.(*net.TCPAddr).IP.String(), remote.(*net.TCPAddr).Port)
+// verifyHostKey also reports whether key is found as is in user known_hosts file, only such hosts are trusted to update their keys
+func verifyHostKey(hostKeyConfig *HostKeyConfig, hostname string, remote net.Addr, key ssh.PublicKey) (bool, error) {
+	rawHostname, friendlyHostname, rawAddr, err := knownHostsNames(hostKeyConfig, hostname, remote)
+	if err != nil {
+		return false, err
+	}
+
+	// Look up SSHFP records before consulting known_hosts files
+	var (
+		dnsMatch  *bool = nil
+		dnsSecure       = false
+	)
+	if hostKeyConfig.VerifyHostKeyDNS == VerifyHostKeyDNSYes || hostKeyConfig.VerifyHostKeyDNS == VerifyHostKeyDNSAsk {
+		host, _, _ := net.SplitHostPort(hostname) // already validated by extractHostname
+		if dnsMatch, dnsSecure, err = verifyHostKeyDNS(hostKeyConfig.VerifyHostKeyDNSResolver, host, key); err != nil {
+			// DNS is only additional information, continue without it
+			LogError(fmt.Errorf("failed to verify host key with DNS: %w", err))
 		}
+	}
+
+	// Query global known_hosts files, hosts pinned there never fall through to DNS or user file
+	isTrusted, err := checkGlobalKnownHosts(hostKeyConfig.GlobalKnownHostsFiles, rawHostname, rawAddr, key)
+	if err != nil {
+		return false, err
+	}
+	if isTrusted {
+		LogDebug(LogLevelDebug1, "host %s found in global known_hosts", friendlyHostname)
+		return false, nil
+	}
 
-		// Query known_hosts file
-		knownHostsFile, err := os.OpenFile(knownHostsFilePath, os.O_RDWR|os.O_CREATE, 0600)
+	if hostKeyConfig.VerifyHostKeyDNS == VerifyHostKeyDNSYes && dnsMatch != nil && *dnsMatch && dnsSecure {
+		// Validated by DNSSEC, trust without asking like OpenSSH does
+		LogDebug(LogLevelDebug1, "host %s matched secure SSHFP records", friendlyHostname)
+		return false, nil
+	}
+
+	// Query known_hosts file, no lock required for reading since it's always replaced atomically
+	var knownHostsContent []byte = nil
+	if hostKeyConfig.UserKnownHostsFile != nil {
+		knownHostsContent, err = readKnownHosts(*hostKeyConfig.UserKnownHostsFile)
 		if err != nil {
-			return fmt.Errorf("failed to open known_hosts file: %w", err)
+			return false, fmt.Errorf("failed to read known_hosts file: %w", err)
 		}
+	}
 
-		defer knownHostsFile.Close()
+	isPerfectMatch, hostsWithSameKey, oldKey, _, _ := findServer(bytes.NewReader(knownHostsContent), rawHostname, rawAddr, key)
+	if isPerfectMatch {
+		LogDebug(LogLevelDebug1, "host %s found in known_hosts", friendlyHostname)
+		return true, nil
+	}
+	LogDebug(LogLevelDebug1, "host %s not matched, StrictHostKeyChecking is %s", friendlyHostname, hostKeyConfig.StrictHostKeyChecking)
 
-		isPerfectMatch, hostsWithSameKey, oldKey, relevantLineStart, relevantLineEnd := findServer(knownHostsFile, rawHostname, rawAddr, key)
-		if isPerfectMatch {
-			return nil
+	// No matching result found, decide by StrictHostKeyChecking
+	switch hostKeyConfig.StrictHostKeyChecking {
+	case StrictHostKeyCheckingYes:
+		if oldKey == nil {
+			return false, fmt.Errorf("host key for %s is unknown, rejected by StrictHostKeyChecking", friendlyHostname)
 		}
-
-		// No matching result found, prepare event
+		return false, fmt.Errorf("host key for %s has changed, rejected by StrictHostKeyChecking", friendlyHostname)
+	case StrictHostKeyCheckingAcceptNew:
+		if oldKey != nil {
+			return false, fmt.Errorf("host key for %s has changed, rejected by StrictHostKeyChecking", friendlyHostname)
+		}
+		// else: new host, save without asking
+	case StrictHostKeyCheckingNo, StrictHostKeyCheckingOff:
+		if oldKey != nil {
+			// Allow to connect, but never overwrite the known key
+			LogError(fmt.Errorf("host key for %s has changed (%s => %s), ignored by StrictHostKeyChecking", friendlyHostname, ssh.FingerprintSHA256(oldKey), ssh.FingerprintSHA256(key)))
+			return false, nil
+		}
+		// else: new host, save without asking
+	default: // StrictHostKeyCheckingAsk
 		evPayload := EventPayloadHostKey{
 			Host:        friendlyHostname,
 			Fingerprint: ssh.FingerprintSHA256(key),
+
+			KeyType:        key.Type(),
+			KeyBits:        keyBits(key),
+			FingerprintMD5: ssh.FingerprintLegacyMD5(key),
+			RandomArt:      randomArt(key),
+			KnownHostsLine: formatKnownHostsLine(append(append([]string{}, hostsWithSameKey...), rawHostname), key),
+			DNSMatch:       dnsMatch,
+
+			Replies: []string{HostKeyReplyAcceptOnce, HostKeyReplyReject},
+			Timeout: int(hostKeyConfig.PromptTimeout.Seconds()),
 		}
 
 		if oldKey == nil {
@@ -53,37 +120,236 @@ func prepareHostKeyHandler(knownHostsFilePath string) func(string, net.Addr, ssh
 			evPayload.OldFingerprint = p(ssh.FingerprintSHA256(oldKey))
 		}
 
-		// Send event
-		keyEvBytes, err := buildEvent(EventNameHostKey, &evPayload)
+		if hostKeyConfig.UserKnownHostsFile != nil {
+			// Only makes sense when there's somewhere to save
+			evPayload.Replies = append(evPayload.Replies, HostKeyReplyAcceptAndSave)
+		}
+
+		reply, err := askHostKey(&evPayload, hostKeyConfig.PromptTimeout)
 		if err != nil {
-			return fmt.Errorf("failed to build key event: %w", err)
+			return false, err
+		}
+
+		switch reply {
+		case HostKeyReplyAcceptOnce:
+			return false, nil
+		case HostKeyReplyAcceptAndSave:
+			// Continue to save
+		default:
+			return false, fmt.Errorf("user rejected")
+		}
+	}
+
+	// Accepted, update file before proceed
+	if hostKeyConfig.UserKnownHostsFile == nil {
+		// Nowhere to save
+		return false, nil
+	}
+
+	if err = modifyKnownHosts(*hostKeyConfig.UserKnownHostsFile, func(knownHostsFile *os.File) error {
+		// Scan again, file might be changed by other instances while waiting for reply
+		isPerfectMatch, hostsWithSameKey, oldKey, relevantLineStart, relevantLineEnd := findServer(knownHostsFile, rawHostname, rawAddr, key)
+		if isPerfectMatch {
+			// Someone else has already done this for us
+			return nil
 		}
-		if _, err = os.Stdout.Write(keyEvBytes); err != nil {
-			return fmt.Errorf("failed to write key event: %w", err)
+
+		return updateKnownHosts(knownHostsFile, rawHostname, key, oldKey, hostsWithSameKey, relevantLineStart, relevantLineEnd)
+	}); err != nil {
+		// Update failed, but continue processing
+		LogError(fmt.Errorf("failed to update known_hosts file: %w", err))
+	}
+
+	return false, nil
+}
+
+func askHostKey(evPayload *EventPayloadHostKey, timeout time.Duration) (string, error) {
+	// Once stdin is piped to remote, the reply can only come as an escape command
+	escapedReply, err := hostKeyReplies.register()
+	if err != nil {
+		return "", err
+	}
+	if escapedReply != nil {
+		defer hostKeyReplies.unregister()
+	}
+
+	// Send event
+	if err := sendEvent(EventNameHostKey, evPayload); err != nil {
+		return "", err
+	}
+
+	var timeoutCh <-chan time.Time = nil // never fires if no limit
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+
+	if escapedReply != nil {
+		select {
+		case reply := <-escapedReply:
+			return reply, nil
+		case <-timeoutCh:
+			return "", &TimeoutError{Phase: PhaseHostKeyPrompt, Timeout: timeout}
 		}
+	}
 
-		// Waiting for reply
+	// Waiting for reply before session starts. Stdin can't be interrupted, but the connection is aborted on timeout anyway
+	type readResult struct {
+		reply []byte
+		err   error
+	}
+	readCh := make(chan readResult, 1)
+	go func() {
 		resBuf := make([]byte, DefaultBufferSize)
 		n, err := os.Stdin.Read(resBuf)
-		if err != nil {
-			return fmt.Errorf("failed to read from stdin: %w", err)
+		readCh <- readResult{resBuf[:n], err}
+	}()
+
+	select {
+	case res := <-readCh:
+		if res.err != nil {
+			return "", fmt.Errorf("failed to read from stdin: %w", res.err)
 		}
-		if n == 0 {
-			return fmt.Errorf("nothing read from stdin")
+		if len(res.reply) == 0 {
+			return "", fmt.Errorf("nothing read from stdin")
 		}
-		if !arrayContains([]byte("yY1\r\n"), resBuf[0]) {
-			// User rejected
-			return fmt.Errorf("user rejected")
+		return parseHostKeyReply(res.reply), nil
+	case <-timeoutCh:
+		return "", &TimeoutError{Phase: PhaseHostKeyPrompt, Timeout: timeout}
+	}
+}
+
+// HostKeyReplies takes replies of hostKey events asked after stdin is piped to remote, e.g. when host key changes on re-key
+type HostKeyReplies struct {
+	lock    sync.Mutex
+	piped   bool        // stdin is read by session
+	escaped bool        // escape commands are handled, so replies can still arrive
+	pending chan string // nil if not asking
+}
+
+// hostKeyReplies is shared by all connections, replies come from stdin of the only session
+var hostKeyReplies = &HostKeyReplies{}
+
+// pipeStdin marks stdin as taken by session, escaped tells whether escape commands are handled
+func (r *HostKeyReplies) pipeStdin(escaped bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.piped, r.escaped = true, escaped
+}
+
+// register prepares for an escaped reply, nil if stdin can be read directly
+func (r *HostKeyReplies) register() (<-chan string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if !r.piped {
+		return nil, nil
+	}
+	if !r.escaped {
+		return nil, fmt.Errorf("stdin is piped to remote, unable to reply to hostKey event")
+	}
+	if r.pending != nil {
+		return nil, fmt.Errorf("another hostKey event is waiting for reply")
+	}
+	r.pending = make(chan string, 1)
+	return r.pending, nil
+}
+
+func (r *HostKeyReplies) unregister() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.pending = nil
+}
+
+// reply answers pending hostKey event, with command argument in the same format as a direct reply
+func (r *HostKeyReplies) reply(arg string) error {
+	if arg == "" {
+		return fmt.Errorf("host key reply is required")
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.pending == nil {
+		return fmt.Errorf("no pending hostKey event")
+	}
+	select {
+	case r.pending <- parseHostKeyReply([]byte(arg)):
+		return nil
+	default:
+		return fmt.Errorf("hostKey event is already replied")
+	}
+}
+
+func parseHostKeyReply(reply []byte) string {
+	switch replyStr := strings.ToLower(strings.TrimSpace(string(reply))); replyStr {
+	case HostKeyReplyAcceptOnce, HostKeyReplyAcceptAndSave, HostKeyReplyReject:
+		return replyStr
+	}
+
+	// Legacy reply: single character
+	if arrayContains([]byte("yY1\r\n"), reply[0]) {
+		return HostKeyReplyAcceptAndSave
+	}
+
+	return HostKeyReplyReject
+}
+
+func checkGlobalKnownHosts(globalKnownHostsFilePaths []string, hostname string, rawAddr string, key ssh.PublicKey) (bool, error) {
+	var mismatchErr error = nil
+	for _, knownHostsFilePath := range globalKnownHostsFilePaths {
+		knownHostsContent, err := readKnownHosts(knownHostsFilePath)
+		if err != nil {
+			return false, fmt.Errorf("failed to read global known_hosts file %s: %w", knownHostsFilePath, err)
 		}
 
-		// else: user approved, update file before proceed
-		if err = updateKnownHosts(knownHostsFile, rawHostname, key, oldKey, hostsWithSameKey, relevantLineStart, relevantLineEnd); err != nil {
-			// Update failed, but continue processing
-			LogError(fmt.Errorf("failed to update known_hosts file: %w", err))
+		isPerfectMatch, _, oldKey, _, _ := findServer(bytes.NewReader(knownHostsContent), hostname, rawAddr, key)
+		if isPerfectMatch {
+			return true, nil
+		}
+		if oldKey != nil && mismatchErr == nil {
+			// Keep looking, another global file may still hold the current key
+			mismatchErr = fmt.Errorf("host key mismatch with global known_hosts file %s: expected %s, got %s", knownHostsFilePath, ssh.FingerprintSHA256(oldKey), ssh.FingerprintSHA256(key))
 		}
+	}
 
-		return nil
+	return false, mismatchErr
+}
+
+// knownHostsNames decides how a host is looked up and recorded in known_hosts files
+func knownHostsNames(hostKeyConfig *HostKeyConfig, hostname string, remote net.Addr) (rawHostname, friendlyHostname, rawAddr string, err error) {
+	if hostKeyConfig.HostKeyAlias != nil {
+		// Alias replaces host and port entirely, and remote address is never checked, same as OpenSSH
+		return *hostKeyConfig.HostKeyAlias, *hostKeyConfig.HostKeyAlias, "", nil
 	}
+
+	rawHostname, friendlyHostname, err = extractHostname(hostname)
+	if err != nil {
+		return "", "", "", fmt.Errorf("failed to extract hostname %s: %w", hostname, err)
+	}
+
+	if !hostKeyConfig.Tunneled {
+		// Tunneled connections only know the address we asked for, not the real peer
+		rawAddr = extractRemoteAddr(remote)
+	}
+
+	return rawHostname, friendlyHostname, rawAddr, nil
+}
+
+// extractRemoteAddr formats remote address as known_hosts host, empty if it's not a usable TCP address
+func extractRemoteAddr(remote net.Addr) string {
+	tcpAddr, ok := remote.(*net.TCPAddr)
+	if !ok || tcpAddr == nil || tcpAddr.IP == nil || tcpAddr.IP.IsUnspecified() {
+		return ""
+	}
+
+	if tcpAddr.Port == DefaultSSHPort {
+		return tcpAddr.IP.String()
+	}
+	return fmt.Sprintf("[%s]:%d", tcpAddr.IP.String(), tcpAddr.Port)
 }
 
 func extractHostname(hostname string) (rawHostname, friendlyHostname string, err error) {
@@ -104,68 +370,260 @@ func extractHostname(hostname string) (rawHostname, friendlyHostname string, err
 
 func findServer(knownHostsFile io.Reader, hostname string, rawAddr string, key ssh.PublicKey) (bool, []string, ssh.PublicKey, int64, int64) {
 	var (
-		relevantLineStart int64 = 0
-		relevantLineEnd   int64 = 0
-	)
+		fileEnd int64 = 0
 
-	knownHostsScanner := bufio.NewScanner(knownHostsFile)
-	for ; knownHostsScanner.Scan(); relevantLineStart = relevantLineEnd {
-		line := knownHostsScanner.Text()
+		// A host may have several keys recorded, so keep the first candidates and decide after the whole file is scanned
+		oldKey                           ssh.PublicKey = nil
+		oldKeyLineStart, oldKeyLineEnd   int64
+		hostsWithSameKey                 []string = nil
+		sameKeyLineStart, sameKeyLineEnd int64
 
-		if len(strings.TrimSpace(line)) == 0 {
-			// Empty line
-			continue
-		}
-
-		relevantLineEnd += int64(len(line) + 1) // + line separator
+		isPerfectMatch = false
+	)
 
-		// Each line: host1:port1,host2,host3... algo pubkey
-		// for example:
-		// github.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl
-		splits := strings.SplitN(line, " ", 2)
-		if len(splits) != 2 {
-			// Malformed line, skip
-			continue
-		}
+	scanKnownHostsLines(knownHostsFile, func(line string, lineStart, lineEnd int64) bool {
+		fileEnd = lineEnd
 
-		// Parse
-		hostsInLine := strings.Split(splits[0], ",")
-		keyInLine, _, _, _, err := ssh.ParseAuthorizedKey([]byte(splits[1]))
+		hostsInLine, keyInLine, _, err := parseKnownHostsLine(line)
 		if err != nil {
-			// Parse failed, skip
-			continue
+			// Empty, comment or malformed line, skip
+			return true
 		}
 
 		// Compare
-		isHostMatch := (arrayContains(hostsInLine, hostname) || arrayContains(hostsInLine, rawAddr)) && (key.Type() == keyInLine.Type())
+		isHostMatch := (matchKnownHost(hostsInLine, hostname) || (rawAddr != "" && matchKnownHost(hostsInLine, rawAddr))) && (key.Type() == keyInLine.Type())
 		isKeyMatch := bytes.Equal(key.Marshal(), keyInLine.Marshal())
 
 		if !isHostMatch && !isKeyMatch {
 			// Not this one, proceed next line
-			continue
 		} else if isHostMatch && isKeyMatch {
 			// Perfect Match
-			return true, nil, nil, 0, 0
+			isPerfectMatch = true
+			return false
 		} else if isHostMatch { // !isKeyMatch
-			// Server change its key
-			return false, nil, keyInLine, relevantLineStart, relevantLineEnd
+			// Server might change its key, but there may still be another line holding the current key
+			if oldKey == nil {
+				oldKey = keyInLine
+				oldKeyLineStart, oldKeyLineEnd = lineStart, lineEnd
+			}
 		} else { // isKeyMatch && !isHostMatch
 			// Access the same server using different host
-			return false, hostsInLine, nil, relevantLineStart, relevantLineEnd
+			if hostsWithSameKey == nil {
+				hostsWithSameKey = hostsInLine
+				sameKeyLineStart, sameKeyLineEnd = lineStart, lineEnd
+			}
 		}
 
+		return true
+	})
+
+	if isPerfectMatch {
+		return true, nil, nil, 0, 0
+	} else if oldKey != nil {
+		// Server change its key
+		return false, nil, oldKey, oldKeyLineStart, oldKeyLineEnd
+	} else if hostsWithSameKey != nil {
+		// Access the same server using different host
+		return false, hostsWithSameKey, nil, sameKeyLineStart, sameKeyLineEnd
 	}
 
 	// Nothing matches, this is a new server
-	return false, nil, nil, relevantLineStart, relevantLineEnd // Use relevant line end to mark file end position
+	return false, nil, nil, fileEnd, fileEnd // Use file end position
 }
 
-func updateKnownHosts(knownHostsFile *os.File, hostname string, key ssh.PublicKey, oldKey ssh.PublicKey, hostsWithSameKey []string, relevantLineStart, relevantLineEnd int64) error {
-	bytesToWrite := []byte(fmt.Sprintf(
+func findKnownKeyTypes(knownHostsFile io.Reader, hostname string) []string {
+	var knownKeyTypes []string
+	for _, hostLine := range findHostLines(knownHostsFile, hostname) {
+		if !arrayContains(knownKeyTypes, hostLine.Key.Type()) {
+			knownKeyTypes = append(knownKeyTypes, hostLine.Key.Type())
+		}
+	}
+
+	return knownKeyTypes
+}
+
+func findHostLines(knownHostsFile io.Reader, hostname string) []KnownHostsLine {
+	var hostLines []KnownHostsLine
+
+	scanKnownHostsLines(knownHostsFile, func(line string, lineStart, lineEnd int64) bool {
+		hostsInLine, keyInLine, _, err := parseKnownHostsLine(line)
+		if err != nil {
+			// Empty, comment or malformed line, skip
+			return true
+		}
+
+		if matchKnownHost(hostsInLine, hostname) {
+			hostLines = append(hostLines, KnownHostsLine{
+				Hosts: hostsInLine,
+				Key:   keyInLine,
+				Start: lineStart,
+				End:   lineEnd,
+			})
+		}
+
+		return true
+	})
+
+	return hostLines
+}
+
+// scanKnownHostsLines calls handle with every line (without line separator) and its position in file (including line separator), till handle returns false
+func scanKnownHostsLines(knownHostsFile io.Reader, handle func(line string, lineStart, lineEnd int64) bool) {
+	var lineStart int64 = 0
+
+	knownHostsReader := bufio.NewReader(knownHostsFile)
+	for {
+		rawLine, err := knownHostsReader.ReadString('\n')
+		if len(rawLine) > 0 {
+			lineEnd := lineStart + int64(len(rawLine)) // count bytes as they are, line separator could be either LF or CRLF
+			if !handle(strings.TrimRight(rawLine, "\r\n"), lineStart, lineEnd) {
+				return
+			}
+			lineStart = lineEnd
+		}
+
+		if err != nil {
+			// EOF or read failure, nothing more to scan
+			return
+		}
+	}
+}
+
+// matchKnownHost checks both plain and hashed (|1|salt|hash) hosts
+func matchKnownHost(hostsInLine []string, hostname string) bool {
+	for _, host := range hostsInLine {
+		if host == hostname {
+			return true
+		}
+
+		if strings.HasPrefix(host, KnownHostsHashMagic) {
+			saltAndHash := strings.Split(host[len(KnownHostsHashMagic):], "|")
+			if len(saltAndHash) != 2 {
+				// Malformed, skip
+				continue
+			}
+			salt, err := base64.StdEncoding.DecodeString(saltAndHash[0])
+			if err != nil {
+				continue
+			}
+			if host == hashKnownHost(hostname, salt) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hashKnownHost hashes hostname the same way as OpenSSH HashKnownHosts
+func hashKnownHost(hostname string, salt []byte) string {
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(hostname))
+	return KnownHostsHashMagic + base64.StdEncoding.EncodeToString(salt) + "|" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func containsKey(keys []ssh.PublicKey, key ssh.PublicKey) bool {
+	for _, k := range keys {
+		if bytes.Equal(k.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+	return false
+}
+
+func formatKnownHostsLine(hosts []string, key ssh.PublicKey) string {
+	return fmt.Sprintf(
 		"%s %s",
-		strings.Join(append(hostsWithSameKey, hostname), ","),
-		ssh.MarshalAuthorizedKey(key),
-	)) // ssh.MarshalAuthorizedKey will include \n, so no need to add manually
+		strings.Join(hosts, ","),
+		bytes.TrimSpace(ssh.MarshalAuthorizedKey(key)), // ssh.MarshalAuthorizedKey will include \n, line separator should be added by caller
+	)
+}
+
+func parseKnownHostsLine(line string) ([]string, ssh.PublicKey, string, error) {
+	// Each line: host1:port1,host2,host3... algo pubkey [comment]
+	// for example:
+	// github.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl
+	// fields could be separated by any number of spaces or tabs
+	line = strings.TrimSpace(line)
+	if len(line) == 0 || line[0] == '#' {
+		return nil, nil, "", fmt.Errorf("empty or comment line")
+	}
+	if line[0] == '@' {
+		// Markers (@cert-authority, @revoked) are not supported
+		return nil, nil, "", fmt.Errorf("marker line")
+	}
+
+	hostsEnd := strings.IndexAny(line, " \t")
+	if hostsEnd == -1 {
+		return nil, nil, "", fmt.Errorf("malformed line")
+	}
+
+	// Parse
+	hostsInLine := strings.Split(line[:hostsEnd], ",")
+	keyInLine, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(line[hostsEnd+1:]))
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("failed to parse key: %w", err)
+	}
+
+	return hostsInLine, keyInLine, comment, nil
+}
+
+// detectLineSeparator follows line separator of the first line, files without any line use LF
+func detectLineSeparator(knownHostsFile io.ReaderAt) (string, error) {
+	firstLine, err := bufio.NewReader(io.NewSectionReader(knownHostsFile, 0, math.MaxInt64)).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+
+	if strings.HasSuffix(firstLine, "\r\n") {
+		return "\r\n", nil
+	}
+	return "\n", nil
+}
+
+func orderHostKeyAlgorithms(algorithms []string, knownKeyTypes []string) []string {
+	// Prefer algorithms whose key type is already known for this host, like OpenSSH does
+	var preferred, others []string
+	for _, algo := range algorithms {
+		if arrayContains(knownKeyTypes, hostKeyAlgoKeyType(algo)) {
+			preferred = append(preferred, algo)
+		} else {
+			others = append(others, algo)
+		}
+	}
+
+	return append(preferred, others...)
+}
+
+func hostKeyAlgoKeyType(algo string) string {
+	switch algo {
+	case ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSASHA512:
+		// RSA signature algorithms share the same key type
+		return ssh.KeyAlgoRSA
+	default:
+		return algo
+	}
+}
+
+func updateKnownHosts(knownHostsFile *os.File, hostname string, key ssh.PublicKey, oldKey ssh.PublicKey, hostsWithSameKey []string, relevantLineStart, relevantLineEnd int64) error {
+	// Keep the line separator style of this file
+	lineSeparator, err := detectLineSeparator(knownHostsFile)
+	if err != nil {
+		return fmt.Errorf("failed to detect line separator of known_hosts file: %w", err)
+	}
+
+	line := formatKnownHostsLine(append(hostsWithSameKey, hostname), key)
+	if hostsWithSameKey != nil {
+		// Still the same key, keep its comment
+		oldLine := make([]byte, relevantLineEnd-relevantLineStart)
+		if _, err := knownHostsFile.ReadAt(oldLine, relevantLineStart); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("failed to read known_hosts file: %w", err)
+		}
+		if _, _, comment, err := parseKnownHostsLine(string(oldLine)); err == nil && comment != "" {
+			line += " " + comment
+		}
+	}
+	bytesToWrite := []byte(line + lineSeparator)
+
 	if oldKey == nil && hostsWithSameKey == nil {
 		// Brand-new host, just append to end of file
 		if stat, err := knownHostsFile.Stat(); err != nil {
@@ -181,9 +639,12 @@ func updateKnownHosts(knownHostsFile *os.File, hostname string, key ssh.PublicKe
 			}
 			if finalByte[0] != '\n' {
 				// No line separator at the end of file, should add line separator before our content or file would be corrupted
-				bytesToWrite = append([]byte{'\n'}, bytesToWrite...)
+				bytesToWrite = append([]byte(lineSeparator), bytesToWrite...)
 			}
 		}
+		if _, err := knownHostsFile.Seek(0, io.SeekEnd); err != nil {
+			return fmt.Errorf("failed to seek known_hosts file: %w", err)
+		}
 		if _, err := knownHostsFile.Write(bytesToWrite); err != nil {
 			return fmt.Errorf("failed to append to known_hosts file: %w", err)
 		}
@@ -3,10 +3,13 @@ package main
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"golang.org/x/crypto/ssh"
 	"io"
 	"log"
+	"net"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 )
@@ -71,6 +74,93 @@ func Test_extractHostname(t *testing.T) {
 	}
 }
 
+func Test_knownHostsNames(t *testing.T) {
+	testcases := []struct {
+		name                                  string
+		hostKeyConfig                         HostKeyConfig
+		hostname                              string
+		remote                                net.Addr
+		wantRawHostname, wantFriendlyHostname string
+		wantRawAddr                           string
+	}{
+		{
+			name:            "direct standard",
+			hostname:        "candinya.com:22",
+			remote:          &net.TCPAddr{IP: net.ParseIP("192.168.3.117"), Port: 22},
+			wantRawHostname: "candinya.com", wantFriendlyHostname: "candinya.com",
+			wantRawAddr: "192.168.3.117",
+		},
+		{
+			name:            "direct non-standard",
+			hostname:        "candinya.com:2233",
+			remote:          &net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 2233},
+			wantRawHostname: "[candinya.com]:2233", wantFriendlyHostname: "candinya.com:2233",
+			wantRawAddr: "[fe80::1]:2233",
+		},
+		{
+			name:            "tunneled",
+			hostKeyConfig:   HostKeyConfig{Tunneled: true},
+			hostname:        "candinya.com:22",
+			remote:          &net.TCPAddr{IP: net.ParseIP("192.168.3.117"), Port: 22},
+			wantRawHostname: "candinya.com", wantFriendlyHostname: "candinya.com",
+			wantRawAddr: "",
+		},
+		{
+			name:            "unresolved tcp address",
+			hostname:        "candinya.com:22",
+			remote:          &net.TCPAddr{Port: 22},
+			wantRawHostname: "candinya.com", wantFriendlyHostname: "candinya.com",
+			wantRawAddr: "",
+		},
+		{
+			name:            "unix address",
+			hostname:        "candinya.com:22",
+			remote:          &net.UnixAddr{Name: "/tmp/proxy.sock", Net: "unix"},
+			wantRawHostname: "candinya.com", wantFriendlyHostname: "candinya.com",
+			wantRawAddr: "",
+		},
+		{
+			name:            "nil address",
+			hostname:        "candinya.com:22",
+			remote:          nil,
+			wantRawHostname: "candinya.com", wantFriendlyHostname: "candinya.com",
+			wantRawAddr: "",
+		},
+		{
+			name:            "alias",
+			hostKeyConfig:   HostKeyConfig{HostKeyAlias: p("nekops-prod")},
+			hostname:        "candinya.com:2233",
+			remote:          &net.TCPAddr{IP: net.ParseIP("192.168.3.117"), Port: 2233},
+			wantRawHostname: "nekops-prod", wantFriendlyHostname: "nekops-prod",
+			wantRawAddr: "",
+		},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			rawHostname, friendlyHostname, rawAddr, err := knownHostsNames(&testcase.hostKeyConfig, testcase.hostname, testcase.remote)
+			if err != nil {
+				t.Fatalf("failed to get known_hosts names: %v", err)
+			}
+
+			if rawHostname != testcase.wantRawHostname {
+				t.Errorf("Unexpected hostname: want %q, got %q", testcase.wantRawHostname, rawHostname)
+			}
+
+			if friendlyHostname != testcase.wantFriendlyHostname {
+				t.Errorf("Unexpected friendly hostname: want %q, got %q", testcase.wantFriendlyHostname, friendlyHostname)
+			}
+
+			if rawAddr != testcase.wantRawAddr {
+				t.Errorf("Unexpected address: want %q, got %q", testcase.wantRawAddr, rawAddr)
+			}
+		})
+	}
+}
+
 func Test_findServer(t *testing.T) {
 	testcases := []struct {
 		name                                       string
@@ -147,7 +237,7 @@ func Test_findServer(t *testing.T) {
 			wantPerfectMatch:      false,
 			wantHostsWithSameKey:  nil,
 			wantOldKey:            nil,
-			wantRelevantLineStart: 92, wantRelevantLineEnd: 92,
+			wantRelevantLineStart: 91, wantRelevantLineEnd: 91, // file end, no line separator
 		},
 		{
 			name:                  "new server (different algo)",
@@ -182,6 +272,83 @@ func Test_findServer(t *testing.T) {
 			wantOldKey:            p("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"),
 			wantRelevantLineStart: 0, wantRelevantLineEnd: 92,
 		},
+		{
+			name:                  "perfect match after same type old key",
+			knownHosts:            "github.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl\ngithub.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFKGJvkCkPoissrebkHB17tYjPunEULNKP8fNN6fTQ8M\n",
+			rawHostname:           "github.com",
+			rawAddr:               "",
+			key:                   "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFKGJvkCkPoissrebkHB17tYjPunEULNKP8fNN6fTQ8M",
+			wantPerfectMatch:      true,
+			wantHostsWithSameKey:  nil,
+			wantOldKey:            nil,
+			wantRelevantLineStart: 0, wantRelevantLineEnd: 0,
+		},
+		{
+			name:                  "perfect match after same key different host",
+			knownHosts:            "candinya.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl\ngithub.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl\n",
+			rawHostname:           "github.com",
+			rawAddr:               "",
+			key:                   "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl",
+			wantPerfectMatch:      true,
+			wantHostsWithSameKey:  nil,
+			wantOldKey:            nil,
+			wantRelevantLineStart: 0, wantRelevantLineEnd: 0,
+		},
+		{
+			name:                  "same host new key before same key different host",
+			knownHosts:            "candinya.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFKGJvkCkPoissrebkHB17tYjPunEULNKP8fNN6fTQ8M\ngithub.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl\n",
+			rawHostname:           "github.com",
+			rawAddr:               "",
+			key:                   "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFKGJvkCkPoissrebkHB17tYjPunEULNKP8fNN6fTQ8M",
+			wantPerfectMatch:      false,
+			wantHostsWithSameKey:  nil,
+			wantOldKey:            p("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"),
+			wantRelevantLineStart: 94, wantRelevantLineEnd: 186,
+		},
+		{
+			name:                  "same host new key (CRLF)",
+			knownHosts:            "candinya.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFKGJvkCkPoissrebkHB17tYjPunEULNKP8fNN6fTQ8M\r\ngithub.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl\r\n",
+			rawHostname:           "github.com",
+			rawAddr:               "",
+			key:                   "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFKGJvkCkPoissrebkHB17tYjPunEULNKP8fNN6fTQ8M",
+			wantPerfectMatch:      false,
+			wantHostsWithSameKey:  nil,
+			wantOldKey:            p("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"),
+			wantRelevantLineStart: 95, wantRelevantLineEnd: 188,
+		},
+		{
+			name:                  "same host new key (comments, empty lines and tabs)",
+			knownHosts:            "# managed by candinya\n\n  \ncandinya.com\tssh-ed25519   AAAAC3NzaC1lZDI1NTE5AAAAIFKGJvkCkPoissrebkHB17tYjPunEULNKP8fNN6fTQ8M   laptop\n# github\ngithub.com   ssh-ed25519\tAAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl # trailing comment\n",
+			rawHostname:           "github.com",
+			rawAddr:               "",
+			key:                   "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFKGJvkCkPoissrebkHB17tYjPunEULNKP8fNN6fTQ8M",
+			wantPerfectMatch:      false,
+			wantHostsWithSameKey:  nil,
+			wantOldKey:            p("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"),
+			wantRelevantLineStart: 140, wantRelevantLineEnd: 253,
+		},
+		{
+			name:                  "new server (CRLF)",
+			knownHosts:            "github.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl\r\n# comment\r\n",
+			rawHostname:           "candinya.com",
+			rawAddr:               "",
+			key:                   "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFKGJvkCkPoissrebkHB17tYjPunEULNKP8fNN6fTQ8M",
+			wantPerfectMatch:      false,
+			wantHostsWithSameKey:  nil,
+			wantOldKey:            nil,
+			wantRelevantLineStart: 104, wantRelevantLineEnd: 104,
+		},
+		{
+			name:                  "commented out line is not a match",
+			knownHosts:            "#github.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl\n",
+			rawHostname:           "github.com",
+			rawAddr:               "",
+			key:                   "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl",
+			wantPerfectMatch:      false,
+			wantHostsWithSameKey:  nil,
+			wantOldKey:            nil,
+			wantRelevantLineStart: 93, wantRelevantLineEnd: 93,
+		},
 	}
 
 	for _, testcase := range testcases {
@@ -229,6 +396,296 @@ func Test_findServer(t *testing.T) {
 	}
 }
 
+func Test_prepareHostKeyHandler_strictHostKeyChecking(t *testing.T) {
+	testcases := []struct {
+		name                  string
+		strictHostKeyChecking string
+		initialContent        string
+		key                   string
+		wantErr               bool
+		wantContent           string
+	}{
+		{
+			name:                  "yes known",
+			strictHostKeyChecking: StrictHostKeyCheckingYes,
+			initialContent:        "candinya.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl\n",
+			key:                   "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl",
+			wantErr:               false,
+			wantContent:           "candinya.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl\n",
+		},
+		{
+			name:                  "yes new",
+			strictHostKeyChecking: StrictHostKeyCheckingYes,
+			initialContent:        "",
+			key:                   "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl",
+			wantErr:               true,
+			wantContent:           "",
+		},
+		{
+			name:                  "yes changed",
+			strictHostKeyChecking: StrictHostKeyCheckingYes,
+			initialContent:        "candinya.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFKGJvkCkPoissrebkHB17tYjPunEULNKP8fNN6fTQ8M\n",
+			key:                   "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl",
+			wantErr:               true,
+			wantContent:           "candinya.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFKGJvkCkPoissrebkHB17tYjPunEULNKP8fNN6fTQ8M\n",
+		},
+		{
+			name:                  "accept-new new",
+			strictHostKeyChecking: StrictHostKeyCheckingAcceptNew,
+			initialContent:        "github.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFKGJvkCkPoissrebkHB17tYjPunEULNKP8fNN6fTQ8M\n",
+			key:                   "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl",
+			wantErr:               false,
+			wantContent:           "github.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFKGJvkCkPoissrebkHB17tYjPunEULNKP8fNN6fTQ8M\ncandinya.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl\n",
+		},
+		{
+			name:                  "accept-new changed",
+			strictHostKeyChecking: StrictHostKeyCheckingAcceptNew,
+			initialContent:        "candinya.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFKGJvkCkPoissrebkHB17tYjPunEULNKP8fNN6fTQ8M\n",
+			key:                   "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl",
+			wantErr:               true,
+			wantContent:           "candinya.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFKGJvkCkPoissrebkHB17tYjPunEULNKP8fNN6fTQ8M\n",
+		},
+		{
+			name:                  "no new",
+			strictHostKeyChecking: StrictHostKeyCheckingNo,
+			initialContent:        "",
+			key:                   "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl",
+			wantErr:               false,
+			wantContent:           "candinya.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl\n",
+		},
+		{
+			name:                  "off changed",
+			strictHostKeyChecking: StrictHostKeyCheckingOff,
+			initialContent:        "candinya.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFKGJvkCkPoissrebkHB17tYjPunEULNKP8fNN6fTQ8M\n",
+			key:                   "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl",
+			wantErr:               false,
+			wantContent:           "candinya.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFKGJvkCkPoissrebkHB17tYjPunEULNKP8fNN6fTQ8M\n",
+		},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			// Prepare
+			knownHostsFilePath := filepath.Join(t.TempDir(), "known_hosts")
+			if err := os.WriteFile(knownHostsFilePath, []byte(testcase.initialContent), 0600); err != nil {
+				t.Fatalf("failed to write content: %v", err)
+			}
+
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(testcase.key))
+			if err != nil {
+				t.Fatalf("failed to parse public key: %v", err)
+			}
+
+			handler := prepareHostKeyHandler(&HostKeyConfig{
+				UserKnownHostsFile:    &knownHostsFilePath,
+				StrictHostKeyChecking: testcase.strictHostKeyChecking,
+			})
+
+			// Test
+			err = handler("candinya.com:22", &net.TCPAddr{IP: net.ParseIP("192.168.3.117"), Port: 22}, key)
+			if (err != nil) != testcase.wantErr {
+				t.Errorf("Unexpected error: want error %t, got %v", testcase.wantErr, err)
+			}
+
+			// Validate
+			content, err := os.ReadFile(knownHostsFilePath)
+			if err != nil {
+				t.Fatalf("failed to read content: %v", err)
+			}
+
+			if string(content) != testcase.wantContent {
+				t.Errorf("Unexpected content: expected %q, got %q", testcase.wantContent, string(content))
+			}
+		})
+	}
+}
+
+func Test_parseHostKeyReply(t *testing.T) {
+	testcases := []struct {
+		name      string
+		reply     string
+		wantReply string
+	}{
+		{name: "accept once", reply: "accept-once\n", wantReply: HostKeyReplyAcceptOnce},
+		{name: "accept and save", reply: "accept-and-save\r\n", wantReply: HostKeyReplyAcceptAndSave},
+		{name: "reject", reply: "reject", wantReply: HostKeyReplyReject},
+		{name: "case insensitive", reply: "Accept-Once", wantReply: HostKeyReplyAcceptOnce},
+		{name: "legacy y", reply: "y", wantReply: HostKeyReplyAcceptAndSave},
+		{name: "legacy 1", reply: "1\n", wantReply: HostKeyReplyAcceptAndSave},
+		{name: "legacy enter", reply: "\r", wantReply: HostKeyReplyAcceptAndSave},
+		{name: "legacy n", reply: "n", wantReply: HostKeyReplyReject},
+		{name: "unknown", reply: "accept", wantReply: HostKeyReplyReject},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			reply := parseHostKeyReply([]byte(testcase.reply))
+			if reply != testcase.wantReply {
+				t.Errorf("Unexpected reply: expected %q, got %q", testcase.wantReply, reply)
+			}
+		})
+	}
+}
+
+func Test_checkGlobalKnownHosts(t *testing.T) {
+	testcases := []struct {
+		name        string
+		globalFiles []string
+		rawHostname string
+		key         string
+		wantTrusted bool
+		wantErr     bool
+	}{
+		{
+			name:        "trusted",
+			globalFiles: []string{"candinya.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFKGJvkCkPoissrebkHB17tYjPunEULNKP8fNN6fTQ8M\n", "github.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl\n"},
+			rawHostname: "github.com",
+			key:         "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl",
+			wantTrusted: true,
+		},
+		{
+			name:        "unknown",
+			globalFiles: []string{"candinya.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFKGJvkCkPoissrebkHB17tYjPunEULNKP8fNN6fTQ8M\n"},
+			rawHostname: "github.com",
+			key:         "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl",
+			wantTrusted: false,
+		},
+		{
+			name:        "mismatch",
+			globalFiles: []string{"github.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFKGJvkCkPoissrebkHB17tYjPunEULNKP8fNN6fTQ8M\n"},
+			rawHostname: "github.com",
+			key:         "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl",
+			wantTrusted: false,
+			wantErr:     true,
+		},
+		{
+			name:        "mismatch but trusted in another file",
+			globalFiles: []string{"github.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFKGJvkCkPoissrebkHB17tYjPunEULNKP8fNN6fTQ8M\n", "github.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl\n"},
+			rawHostname: "github.com",
+			key:         "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl",
+			wantTrusted: true,
+		},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			// Prepare
+			dir := t.TempDir()
+			globalFilePaths := []string{filepath.Join(dir, "missing")}
+			for i, content := range testcase.globalFiles {
+				globalFilePath := filepath.Join(dir, fmt.Sprintf("known_hosts_%d", i))
+				if err := os.WriteFile(globalFilePath, []byte(content), 0400); err != nil {
+					t.Fatalf("failed to write content: %v", err)
+				}
+				globalFilePaths = append(globalFilePaths, globalFilePath)
+			}
+
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(testcase.key))
+			if err != nil {
+				t.Fatalf("failed to parse public key: %v", err)
+			}
+
+			// Test
+			trusted, err := checkGlobalKnownHosts(globalFilePaths, testcase.rawHostname, "", key)
+
+			if (err != nil) != testcase.wantErr {
+				t.Errorf("Unexpected error: want error %t, got %v", testcase.wantErr, err)
+			}
+
+			if trusted != testcase.wantTrusted {
+				t.Errorf("Unexpected trusted: expected %t, got %t", testcase.wantTrusted, trusted)
+			}
+		})
+	}
+}
+
+func Test_findKnownKeyTypes(t *testing.T) {
+	testcases := []struct {
+		name              string
+		knownHosts        string
+		rawHostname       string
+		wantKnownKeyTypes []string
+	}{
+		{
+			name:              "empty",
+			knownHosts:        "",
+			rawHostname:       "github.com",
+			wantKnownKeyTypes: nil,
+		},
+		{
+			name:              "multiple keys",
+			knownHosts:        "github.com ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABgQCj7ndNxQowgcQnjshcLrqPEiiphnt+VTTvDP6mHBL9j1aNUkY4Ue1gvwnGLVlOhGeYrnZaMgRK6+PKCUXaDbC7qtbW8gIkhL7aGCsOr/C56SJMy/BCZfxd1nWzAOxSDPgVsmerOBYfNqltV9/hWCqBywINIR+5dIg6JTJ72pcEpEjcYgXkE2YEFXV1JHnsKgbLWNlhScqb2UmyRkQyytRLtL+38TGxkxCflmO+5Z8CSSNY7GidjMIZ7Q4zMjA2n1nGrlTDkzwDCsw+wqFPGQA179cnfGWOWRVruj16z6XyvxvjJwbz0wQZ75XK5tKSb7FNyeIEs4TT4jk+S4dhPeAUC5y+bDYirYgM4GC7uEnztnZyaVWQ7B381AK4Qdrwt51ZqExKbQpTUNn+EjqoTwvqNj4kqx5QUCI0ThS/YkOxJCXmPUWZbhjpCg56i+2aB6CmK2JGhn57K5mj0MNdBXA4/WnwH6XoPWJzK5Nyu2zB3nAZp+S5hpQs+p1vN1/wsjk=\ncandinya.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl\ngithub.com,[example.com]:2233 ecdsa-sha2-nistp256 AAAAE2VjZHNhLXNoYTItbmlzdHAyNTYAAAAIbmlzdHAyNTYAAABBBEmKSENjQEezOmxkZMy7opKgwFB9nkt5YRrYMjNuG5N87uRgg6CLrbo5wAdT/y6v0mKV0U2w0WZ2YB/++Tpockg=\n",
+			rawHostname:       "github.com",
+			wantKnownKeyTypes: []string{ssh.KeyAlgoRSA, ssh.KeyAlgoECDSA256},
+		},
+		{
+			name:              "unknown host",
+			knownHosts:        "github.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl\n",
+			rawHostname:       "candinya.com",
+			wantKnownKeyTypes: nil,
+		},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			knownKeyTypes := findKnownKeyTypes(bytes.NewReader([]byte(testcase.knownHosts)), testcase.rawHostname)
+
+			if !reflect.DeepEqual(knownKeyTypes, testcase.wantKnownKeyTypes) {
+				t.Errorf("Unexpected known key types: expected %q, got %q", testcase.wantKnownKeyTypes, knownKeyTypes)
+			}
+		})
+	}
+}
+
+func Test_orderHostKeyAlgorithms(t *testing.T) {
+	testcases := []struct {
+		name           string
+		knownKeyTypes  []string
+		wantAlgorithms []string
+	}{
+		{
+			name:           "nothing known",
+			knownKeyTypes:  nil,
+			wantAlgorithms: []string{ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSA},
+		},
+		{
+			name:           "rsa known",
+			knownKeyTypes:  []string{ssh.KeyAlgoRSA},
+			wantAlgorithms: []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSA, ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256},
+		},
+		{
+			name:           "multiple known",
+			knownKeyTypes:  []string{ssh.KeyAlgoRSA, ssh.KeyAlgoECDSA256},
+			wantAlgorithms: []string{ssh.KeyAlgoECDSA256, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSA, ssh.KeyAlgoED25519},
+		},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			algorithms := orderHostKeyAlgorithms([]string{ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSA}, testcase.knownKeyTypes)
+
+			if !reflect.DeepEqual(algorithms, testcase.wantAlgorithms) {
+				t.Errorf("Unexpected algorithms: expected %q, got %q", testcase.wantAlgorithms, algorithms)
+			}
+		})
+	}
+}
+
 func Test_spareSpace(t *testing.T) {
 	testcases := []struct {
 		name                  string
@@ -432,6 +889,46 @@ func Test_updateKnownHosts(t *testing.T) {
 			relevantLineStart: 0, relevantLineEnd: 94,
 			wantContent: "candinya.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFKGJvkCkPoissrebkHB17tYjPunEULNKP8fNN6fTQ8M\n",
 		},
+		{
+			name:              "new host CRLF file",
+			initialContent:    "github.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl\r\n",
+			rawHostname:       "candinya.com",
+			key:               "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFKGJvkCkPoissrebkHB17tYjPunEULNKP8fNN6fTQ8M",
+			oldKey:            nil,
+			hostsWithSameKey:  nil,
+			relevantLineStart: 93, relevantLineEnd: 93,
+			wantContent: "github.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl\r\ncandinya.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFKGJvkCkPoissrebkHB17tYjPunEULNKP8fNN6fTQ8M\r\n",
+		},
+		{
+			name:              "new host CRLF file (without newline)",
+			initialContent:    "# comment\r\ngithub.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl",
+			rawHostname:       "candinya.com",
+			key:               "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFKGJvkCkPoissrebkHB17tYjPunEULNKP8fNN6fTQ8M",
+			oldKey:            nil,
+			hostsWithSameKey:  nil,
+			relevantLineStart: 102, relevantLineEnd: 102,
+			wantContent: "# comment\r\ngithub.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl\r\ncandinya.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFKGJvkCkPoissrebkHB17tYjPunEULNKP8fNN6fTQ8M\r\n",
+		},
+		{
+			name:              "new host same key keeps comments",
+			initialContent:    "# comment\r\ngithub.com\tssh-ed25519  AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl  work laptop\r\n# another comment\r\n",
+			rawHostname:       "candinya.com",
+			key:               "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl",
+			oldKey:            nil,
+			hostsWithSameKey:  []string{"github.com"},
+			relevantLineStart: 11, relevantLineEnd: 118,
+			wantContent: "# comment\r\ngithub.com,candinya.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl work laptop\r\n# another comment\r\n",
+		},
+		{
+			name:              "old host new key CRLF file",
+			initialContent:    "candinya.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl\r\n# comment\r\n",
+			rawHostname:       "candinya.com",
+			key:               "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFKGJvkCkPoissrebkHB17tYjPunEULNKP8fNN6fTQ8M",
+			oldKey:            p("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"),
+			hostsWithSameKey:  nil,
+			relevantLineStart: 0, relevantLineEnd: 95,
+			wantContent: "candinya.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFKGJvkCkPoissrebkHB17tYjPunEULNKP8fNN6fTQ8M\r\n# comment\r\n",
+		},
 	}
 
 	for _, testcase := range testcases {
@@ -487,3 +984,63 @@ func Test_updateKnownHosts(t *testing.T) {
 		})
 	}
 }
+
+func Test_HostKeyReplies(t *testing.T) {
+	testcases := []struct {
+		name         string
+		piped        bool
+		escaped      bool
+		reply        string
+		wantRegister bool // reply is taken through escape command
+		wantErr      bool
+		wantReply    string
+	}{
+		{name: "not piped", wantRegister: false},
+		{name: "piped without escape", piped: true, wantErr: true},
+		{name: "accept once", piped: true, escaped: true, reply: "accept-once", wantRegister: true, wantReply: HostKeyReplyAcceptOnce},
+		{name: "legacy", piped: true, escaped: true, reply: "y", wantRegister: true, wantReply: HostKeyReplyAcceptAndSave},
+		{name: "empty", piped: true, escaped: true, reply: "", wantRegister: true, wantErr: true},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			replies := &HostKeyReplies{}
+			if testcase.piped {
+				replies.pipeStdin(testcase.escaped)
+			}
+
+			escapedReply, err := replies.register()
+			if !testcase.wantRegister {
+				if (err != nil) != testcase.wantErr || escapedReply != nil {
+					t.Errorf("got %v %v, want not registered and error %t", escapedReply, err, testcase.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to register: %v", err)
+			}
+			if _, err = replies.register(); err == nil {
+				t.Errorf("got registered twice, want error")
+			}
+
+			err = replies.reply(testcase.reply)
+			if (err != nil) != testcase.wantErr {
+				t.Fatalf("got error %v, want error %t", err, testcase.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := <-escapedReply; got != testcase.wantReply {
+				t.Errorf("got reply %s, want %s", got, testcase.wantReply)
+			}
+
+			replies.unregister()
+			if err = replies.reply(testcase.reply); err == nil {
+				t.Errorf("got replied without pending event, want error")
+			}
+		})
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"os"
+	"sync"
+)
+
+const (
+	GlobalRequestHostKeys      = "hostkeys-00@openssh.com"       // server announces all its host keys
+	GlobalRequestHostKeysProve = "hostkeys-prove-00@openssh.com" // client asks server to prove ownership of keys
+)
+
+func prepareHostKeysUpdate(hostKeyConfig *HostKeyConfig, cfg *ssh.ClientConfig) RequestsFilter {
+	// Callback runs again on re-key while announcements are being handled
+	var (
+		lock                                        sync.Mutex
+		isFirstKex                                  = true
+		sessionRawHostname, sessionFriendlyHostname string
+		sessionKey                                  ssh.PublicKey
+	)
+
+	// Record the key used for this session, only a server holding a key found in user known_hosts file is allowed to announce others.
+	// Keys accepted once, ignored after change, or trusted by global files and DNS are never used to modify user file, same as OpenSSH.
+	// Verify by ourselves instead of wrapping the handler, which doesn't tell where the key is found.
+	// Only the first key exchange counts, a key switched to on re-key never becomes the session key
+	cfg.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		isUserKnown, err := verifyHostKey(hostKeyConfig, hostname, remote, key)
+		if err != nil {
+			return err
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		if !isFirstKex {
+			return nil
+		}
+		isFirstKex = false
+		if !isUserKnown {
+			return nil
+		}
+
+		rawHostname, friendlyHostname, _, err := knownHostsNames(hostKeyConfig, hostname, remote)
+		if err != nil {
+			return err
+		}
+
+		sessionRawHostname, sessionFriendlyHostname, sessionKey = rawHostname, friendlyHostname, key
+		return nil
+	}
+
+	return func(conn ssh.Conn, reqs <-chan *ssh.Request) <-chan *ssh.Request {
+		filteredReqs := make(chan *ssh.Request)
+
+		go func() {
+			defer close(filteredReqs)
+
+			for req := range reqs {
+				if req.Type != GlobalRequestHostKeys {
+					// Not our business, pass to client
+					filteredReqs <- req
+					continue
+				}
+
+				if req.WantReply {
+					// Announcement should not require reply, but just in case
+					_ = req.Reply(false, nil)
+				}
+
+				lock.Lock()
+				rawHostname, friendlyHostname, key := sessionRawHostname, sessionFriendlyHostname, sessionKey
+				lock.Unlock()
+				if key == nil {
+					LogDebug(LogLevelDebug1, "host key is not found in known_hosts, ignore host keys announcement")
+					continue
+				}
+
+				// Prove in background, we can't block other requests while waiting for reply
+				go func(payload []byte) {
+					if err := updateHostKeys(conn, *hostKeyConfig.UserKnownHostsFile, rawHostname, friendlyHostname, key, payload); err != nil {
+						LogError(fmt.Errorf("failed to update host keys: %w", err))
+					}
+				}(req.Payload)
+			}
+		}()
+
+		return filteredReqs
+	}
+}
+
+func updateHostKeys(conn ssh.Conn, knownHostsFilePath string, rawHostname, friendlyHostname string, sessionKey ssh.PublicKey, payload []byte) error {
+	// Parse announced keys
+	keyBlobs, err := parseSSHStrings(payload)
+	if err != nil {
+		return fmt.Errorf("failed to parse announcement: %w", err)
+	}
+
+	var announcedKeys []ssh.PublicKey
+	for _, keyBlob := range keyBlobs {
+		key, err := ssh.ParsePublicKey(keyBlob)
+		if err != nil {
+			// Unsupported key type, skip
+			continue
+		}
+
+		if !containsKey(announcedKeys, key) {
+			announcedKeys = append(announcedKeys, key)
+		}
+	}
+
+	if sessionKey == nil || !containsKey(announcedKeys, sessionKey) {
+		return fmt.Errorf("server didn't announce the key used for this session")
+	}
+
+	// Compare with known keys
+	knownHostsContent, err := readKnownHosts(knownHostsFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to read known_hosts file: %w", err)
+	}
+
+	newKeys, staleLines, err := diffHostKeys(findHostLines(bytes.NewReader(knownHostsContent), rawHostname), announcedKeys)
+	if err != nil {
+		return fmt.Errorf("host key for %s: %w", friendlyHostname, err)
+	}
+
+	if len(newKeys) == 0 && len(staleLines) == 0 {
+		// Already up to date
+		return nil
+	}
+
+	// Server must prove it holds private keys of new ones
+	if len(newKeys) > 0 {
+		if err = proveHostKeys(conn, newKeys); err != nil {
+			return fmt.Errorf("failed to prove host keys: %w", err)
+		}
+	}
+
+	provedKeys := newKeys
+	evPayload := EventPayloadHostKeysUpdated{
+		Host: friendlyHostname,
+	}
+
+	if err = modifyKnownHosts(knownHostsFilePath, func(knownHostsFile *os.File) error {
+		// Compare again, file might be changed by other instances while proving
+		newKeys, staleLines, err := diffHostKeys(findHostLines(knownHostsFile, rawHostname), announcedKeys)
+		if err != nil {
+			return fmt.Errorf("host key for %s: %w", friendlyHostname, err)
+		}
+
+		// Remove from bottom to top, so offsets of lines before are not affected
+		for i := len(staleLines) - 1; i >= 0; i-- {
+			if err = spareSpace(knownHostsFile, staleLines[i].Start, staleLines[i].End, 0); err != nil {
+				return fmt.Errorf("failed to remove stale key: %w", err)
+			}
+			evPayload.Removed = append(evPayload.Removed, ssh.FingerprintSHA256(staleLines[i].Key))
+		}
+
+		for _, key := range newKeys {
+			if !containsKey(provedKeys, key) {
+				// Not proved, can't trust
+				continue
+			}
+
+			if err = updateKnownHosts(knownHostsFile, rawHostname, key, nil, nil, 0, 0); err != nil {
+				return fmt.Errorf("failed to add new key: %w", err)
+			}
+			evPayload.Added = append(evPayload.Added, ssh.FingerprintSHA256(key))
+		}
+
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to update known_hosts file: %w", err)
+	}
+
+	if len(evPayload.Added) == 0 && len(evPayload.Removed) == 0 {
+		// Someone else has already done this for us
+		return nil
+	}
+
+	// Send event
+	return sendEvent(EventNameHostKeysUpdated, &evPayload)
+}
+
+// diffHostKeys finds keys to add and lines to remove, so that known keys of a host become exactly the announced ones
+func diffHostKeys(hostLines []KnownHostsLine, announcedKeys []ssh.PublicKey) ([]ssh.PublicKey, []KnownHostsLine, error) {
+	var knownKeys []ssh.PublicKey
+	for _, hostLine := range hostLines {
+		if len(hostLine.Hosts) > 1 {
+			// Editing such lines would affect other hosts, leave them to user
+			return nil, nil, fmt.Errorf("associated with multiple hostnames, skip update")
+		}
+
+		knownKeys = append(knownKeys, hostLine.Key)
+	}
+
+	var newKeys []ssh.PublicKey
+	for _, key := range announcedKeys {
+		if !containsKey(knownKeys, key) {
+			newKeys = append(newKeys, key)
+		}
+	}
+
+	var staleLines []KnownHostsLine
+	for _, hostLine := range hostLines {
+		if !containsKey(announcedKeys, hostLine.Key) {
+			staleLines = append(staleLines, hostLine)
+		}
+	}
+
+	return newKeys, staleLines, nil
+}
+
+func proveHostKeys(conn ssh.Conn, keys []ssh.PublicKey) error {
+	var keyBlobs [][]byte
+	for _, key := range keys {
+		keyBlobs = append(keyBlobs, key.Marshal())
+	}
+
+	ok, reply, err := conn.SendRequest(GlobalRequestHostKeysProve, true, marshalSSHStrings(keyBlobs))
+	if err != nil {
+		return fmt.Errorf("failed to send prove request: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("server refused to prove")
+	}
+
+	sigBlobs, err := parseSSHStrings(reply)
+	if err != nil {
+		return fmt.Errorf("failed to parse prove reply: %w", err)
+	}
+	if len(sigBlobs) != len(keys) {
+		return fmt.Errorf("signature count mismatch: expected %d, got %d", len(keys), len(sigBlobs))
+	}
+
+	// Each signature covers: request name, session id, key blob
+	sessionID := conn.SessionID()
+	for i, key := range keys {
+		sig := new(ssh.Signature)
+		if err = ssh.Unmarshal(sigBlobs[i], sig); err != nil {
+			return fmt.Errorf("failed to parse signature for %s: %w", ssh.FingerprintSHA256(key), err)
+		}
+
+		signedData := marshalSSHStrings([][]byte{[]byte(GlobalRequestHostKeysProve), sessionID, keyBlobs[i]})
+		if err = key.Verify(signedData, sig); err != nil {
+			return fmt.Errorf("failed to verify signature for %s: %w", ssh.FingerprintSHA256(key), err)
+		}
+	}
+
+	return nil
+}
+
+func parseSSHStrings(data []byte) ([][]byte, error) {
+	var strs [][]byte
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("truncated length")
+		}
+
+		length := binary.BigEndian.Uint32(data)
+		data = data[4:]
+		if uint32(len(data)) < length {
+			return nil, fmt.Errorf("truncated string")
+		}
+
+		strs = append(strs, data[:length])
+		data = data[length:]
+	}
+
+	return strs, nil
+}
+
+func marshalSSHStrings(strs [][]byte) []byte {
+	var data []byte
+	for _, str := range strs {
+		data = binary.BigEndian.AppendUint32(data, uint32(len(str)))
+		data = append(data, str...)
+	}
+
+	return data
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("failed to create signer: %v", err)
+	}
+
+	return signer
+}
+
+// newTestServer serves one connection at returned address, global requests and channels are rejected unless there's a handler
+func newTestServer(t *testing.T, serverConfig *ssh.ServerConfig, handleRequest func(serverConn ssh.Conn, req *ssh.Request), handleChannel func(serverConn ssh.Conn, channel ssh.Channel, reqs <-chan *ssh.Request)) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		serverPipe, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer serverPipe.Close()
+		serverConn, chans, reqs, err := ssh.NewServerConn(serverPipe, serverConfig)
+		if err != nil {
+			return
+		}
+		defer serverConn.Close()
+
+		go func() {
+			for req := range reqs {
+				if handleRequest == nil {
+					if req.WantReply {
+						_ = req.Reply(false, nil)
+					}
+					continue
+				}
+				handleRequest(serverConn, req)
+			}
+		}()
+
+		for newChannel := range chans {
+			if handleChannel == nil {
+				_ = newChannel.Reject(ssh.Prohibited, "not supported")
+				continue
+			}
+			channel, channelReqs, err := newChannel.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer channel.Close()
+				handleChannel(serverConn, channel, channelReqs)
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+// newTestConnPair connects a client to a local server holding hostSigners, the first one is used for handshake
+func newTestConnPair(t *testing.T, hostSigners []ssh.Signer, handleRequest func(serverConn ssh.Conn, req *ssh.Request), handleChannel func(serverConn ssh.Conn, channel ssh.Channel, reqs <-chan *ssh.Request)) *ssh.Client {
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(hostSigners[0])
+
+	client, err := ssh.Dial("tcp", newTestServer(t, serverConfig, handleRequest, handleChannel), &ssh.ClientConfig{
+		User:            "root",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+
+	return client
+}
+
+func Test_updateHostKeys(t *testing.T) {
+	sessionSigner, newSigner, staleSigner := newTestSigner(t), newTestSigner(t), newTestSigner(t)
+	otherHostLine := "github.com " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(staleSigner.PublicKey()))) + "\n"
+
+	testcases := []struct {
+		name           string
+		initialContent string
+		announced      []ssh.Signer
+		badProof       bool
+		wantErr        bool
+		wantContent    string
+	}{
+		{
+			name:           "add new key",
+			initialContent: otherHostLine + "candinya.com " + string(ssh.MarshalAuthorizedKey(sessionSigner.PublicKey())),
+			announced:      []ssh.Signer{sessionSigner, newSigner},
+			wantContent:    otherHostLine + "candinya.com " + string(ssh.MarshalAuthorizedKey(sessionSigner.PublicKey())) + "candinya.com " + string(ssh.MarshalAuthorizedKey(newSigner.PublicKey())),
+		},
+		{
+			name:           "remove stale key",
+			initialContent: "candinya.com " + string(ssh.MarshalAuthorizedKey(staleSigner.PublicKey())) + otherHostLine + "candinya.com " + string(ssh.MarshalAuthorizedKey(sessionSigner.PublicKey())),
+			announced:      []ssh.Signer{sessionSigner},
+			wantContent:    otherHostLine + "candinya.com " + string(ssh.MarshalAuthorizedKey(sessionSigner.PublicKey())),
+		},
+		{
+			name:           "replace stale key",
+			initialContent: "candinya.com " + string(ssh.MarshalAuthorizedKey(sessionSigner.PublicKey())) + "candinya.com " + string(ssh.MarshalAuthorizedKey(staleSigner.PublicKey())),
+			announced:      []ssh.Signer{newSigner, sessionSigner},
+			wantContent:    "candinya.com " + string(ssh.MarshalAuthorizedKey(sessionSigner.PublicKey())) + "candinya.com " + string(ssh.MarshalAuthorizedKey(newSigner.PublicKey())),
+		},
+		{
+			name:           "session key not announced",
+			initialContent: "candinya.com " + string(ssh.MarshalAuthorizedKey(sessionSigner.PublicKey())),
+			announced:      []ssh.Signer{newSigner},
+			wantErr:        true,
+			wantContent:    "candinya.com " + string(ssh.MarshalAuthorizedKey(sessionSigner.PublicKey())),
+		},
+		{
+			name:           "bad proof",
+			initialContent: "candinya.com " + string(ssh.MarshalAuthorizedKey(sessionSigner.PublicKey())),
+			announced:      []ssh.Signer{sessionSigner, newSigner},
+			badProof:       true,
+			wantErr:        true,
+			wantContent:    "candinya.com " + string(ssh.MarshalAuthorizedKey(sessionSigner.PublicKey())),
+		},
+		{
+			name:           "multiple hostnames",
+			initialContent: "candinya.com,github.com " + string(ssh.MarshalAuthorizedKey(sessionSigner.PublicKey())),
+			announced:      []ssh.Signer{sessionSigner, newSigner},
+			wantErr:        true,
+			wantContent:    "candinya.com,github.com " + string(ssh.MarshalAuthorizedKey(sessionSigner.PublicKey())),
+		},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			// Prepare
+			f, err := os.CreateTemp("", "pipessh-test-updateHostKeys.*.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(f.Name()) // clean up
+
+			if _, err = f.WriteString(testcase.initialContent); err != nil {
+				t.Fatalf("failed to write content: %v", err)
+			}
+			_ = f.Close()
+
+			conn := newTestConnPair(t, testcase.announced, func(serverConn ssh.Conn, req *ssh.Request) {
+				if req.Type != GlobalRequestHostKeysProve {
+					_ = req.Reply(false, nil)
+					return
+				}
+
+				keyBlobs, err := parseSSHStrings(req.Payload)
+				if err != nil {
+					_ = req.Reply(false, nil)
+					return
+				}
+
+				var sigBlobs [][]byte
+				for _, keyBlob := range keyBlobs {
+					for _, signer := range testcase.announced {
+						if string(signer.PublicKey().Marshal()) != string(keyBlob) {
+							continue
+						}
+
+						signedData := marshalSSHStrings([][]byte{[]byte(GlobalRequestHostKeysProve), serverConn.SessionID(), keyBlob})
+						if testcase.badProof {
+							signedData = append(signedData, 0)
+						}
+
+						sig, err := signer.Sign(rand.Reader, signedData)
+						if err != nil {
+							_ = req.Reply(false, nil)
+							return
+						}
+						sigBlobs = append(sigBlobs, ssh.Marshal(sig))
+					}
+				}
+
+				_ = req.Reply(true, marshalSSHStrings(sigBlobs))
+			}, nil)
+
+			var keyBlobs [][]byte
+			for _, signer := range testcase.announced {
+				keyBlobs = append(keyBlobs, signer.PublicKey().Marshal())
+			}
+
+			// Test
+			err = updateHostKeys(conn, f.Name(), "candinya.com", "candinya.com", sessionSigner.PublicKey(), marshalSSHStrings(keyBlobs))
+			if (err != nil) != testcase.wantErr {
+				t.Errorf("Unexpected error: want error %t, got %v", testcase.wantErr, err)
+			}
+
+			// Validate
+			content, err := os.ReadFile(f.Name())
+			if err != nil {
+				t.Fatalf("failed to read content: %v", err)
+			}
+
+			if string(content) != testcase.wantContent {
+				t.Errorf("Unexpected content: expected %q, got %q", testcase.wantContent, string(content))
+			}
+		})
+	}
+}
+
+// provingConn records prove requests sent to server
+type provingConn struct {
+	ssh.Conn
+	proved chan struct{}
+}
+
+func (c *provingConn) SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error) {
+	if name == GlobalRequestHostKeysProve {
+		c.proved <- struct{}{}
+	}
+	return false, nil, nil
+}
+
+func Test_prepareHostKeysUpdate(t *testing.T) {
+	sessionSigner, newSigner, oldSigner := newTestSigner(t), newTestSigner(t), newTestSigner(t)
+	sessionLine := "candinya.com " + string(ssh.MarshalAuthorizedKey(sessionSigner.PublicKey()))
+	oldLine := "candinya.com " + string(ssh.MarshalAuthorizedKey(oldSigner.PublicKey()))
+
+	testcases := []struct {
+		name                  string
+		strictHostKeyChecking string
+		userContent           string
+		globalContent         string
+		reply                 string // to hostKey event
+		rekey                 bool   // switch to the old key on re-key, before announcement
+		wantUpdate            bool
+	}{
+		{name: "known", strictHostKeyChecking: StrictHostKeyCheckingYes, userContent: sessionLine, wantUpdate: true},
+		{name: "accept once", strictHostKeyChecking: StrictHostKeyCheckingAsk, userContent: oldLine, reply: HostKeyReplyAcceptOnce},
+		{name: "accept and save", strictHostKeyChecking: StrictHostKeyCheckingAsk, reply: HostKeyReplyAcceptAndSave},
+		{name: "no changed", strictHostKeyChecking: StrictHostKeyCheckingNo, userContent: oldLine},
+		{name: "global known", strictHostKeyChecking: StrictHostKeyCheckingYes, globalContent: sessionLine},
+		{name: "re-key to known key", strictHostKeyChecking: StrictHostKeyCheckingNo, userContent: oldLine, rekey: true},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			// Not parallel, replies are read from stdin
+
+			dir := t.TempDir()
+			userKnownHostsFile, globalKnownHostsFile := filepath.Join(dir, "known_hosts"), filepath.Join(dir, "ssh_known_hosts")
+			if err := os.WriteFile(userKnownHostsFile, []byte(testcase.userContent), 0600); err != nil {
+				t.Fatalf("failed to write content: %v", err)
+			}
+			if err := os.WriteFile(globalKnownHostsFile, []byte(testcase.globalContent), 0600); err != nil {
+				t.Fatalf("failed to write content: %v", err)
+			}
+
+			if testcase.reply != "" {
+				stdinR, stdinW, err := os.Pipe()
+				if err != nil {
+					t.Fatalf("failed to create pipe: %v", err)
+				}
+				defer stdinR.Close()
+				if _, err = stdinW.WriteString(testcase.reply + "\n"); err != nil {
+					t.Fatalf("failed to write reply: %v", err)
+				}
+				_ = stdinW.Close()
+				stdin := os.Stdin
+				os.Stdin = stdinR
+				defer func() { os.Stdin = stdin }()
+			}
+
+			hostKeyConfig := &HostKeyConfig{
+				UserKnownHostsFile:    &userKnownHostsFile,
+				GlobalKnownHostsFiles: []string{globalKnownHostsFile},
+				StrictHostKeyChecking: testcase.strictHostKeyChecking,
+			}
+			cfg := &ssh.ClientConfig{HostKeyCallback: prepareHostKeyHandler(hostKeyConfig)}
+			filter := prepareHostKeysUpdate(hostKeyConfig, cfg)
+
+			if err := cfg.HostKeyCallback("candinya.com:22", &net.TCPAddr{IP: net.ParseIP("192.168.3.117"), Port: 22}, sessionSigner.PublicKey()); err != nil {
+				t.Fatalf("failed to verify host key: %v", err)
+			}
+
+			announcedKey := sessionSigner.PublicKey()
+			if testcase.rekey {
+				// Verified again, but only the key of the first exchange counts
+				announcedKey = oldSigner.PublicKey()
+				if err := cfg.HostKeyCallback("candinya.com:22", &net.TCPAddr{IP: net.ParseIP("192.168.3.117"), Port: 22}, announcedKey); err != nil {
+					t.Fatalf("failed to verify host key on re-key: %v", err)
+				}
+			}
+
+			// Server announces a new key
+			conn := &provingConn{proved: make(chan struct{}, 1)}
+			reqs := make(chan *ssh.Request, 1)
+			reqs <- &ssh.Request{Type: GlobalRequestHostKeys, Payload: marshalSSHStrings([][]byte{announcedKey.Marshal(), newSigner.PublicKey().Marshal()})}
+			close(reqs)
+			for range filter(conn, reqs) {
+				t.Errorf("announcement is passed to client")
+			}
+
+			select {
+			case <-conn.proved:
+				if !testcase.wantUpdate {
+					t.Errorf("got keys proved, want announcement ignored")
+				}
+			case <-time.After(200 * time.Millisecond):
+				if testcase.wantUpdate {
+					t.Errorf("got announcement ignored, want keys proved")
+				}
+			}
+		})
+	}
+}
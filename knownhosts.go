@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// modifyKnownHosts runs modify on a locked copy of known_hosts file, and replaces the original only when modify succeeds.
+// modify should re-scan the file by itself, since other instances may have changed it before the lock is acquired.
+func modifyKnownHosts(knownHostsFilePath string, modify func(knownHostsFile *os.File) error) error {
+	// Step 1: Lock, other instances may be writing at the same time
+	lock, err := os.OpenFile(knownHostsFilePath+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	defer lock.Close()
+
+	if err = lockFile(lock); err != nil {
+		return fmt.Errorf("failed to lock known_hosts file: %w", err)
+	}
+
+	defer unlockFile(lock)
+
+	// Step 2: Copy to a temp file next to the original, so rename stays on the same filesystem
+	tmpFile, err := os.CreateTemp(filepath.Dir(knownHostsFilePath), filepath.Base(knownHostsFilePath)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+
+	tmpFilePath := tmpFile.Name()
+	defer os.Remove(tmpFilePath) // no-op after rename
+	defer tmpFile.Close()
+
+	fileMode := os.FileMode(0600)
+	if knownHostsFile, err := os.Open(knownHostsFilePath); err == nil {
+		if stat, err := knownHostsFile.Stat(); err == nil {
+			fileMode = stat.Mode().Perm()
+		}
+
+		_, err = io.Copy(tmpFile, knownHostsFile)
+		knownHostsFile.Close()
+		if err != nil {
+			return fmt.Errorf("failed to copy known_hosts file: %w", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to open known_hosts file: %w", err)
+	}
+
+	if _, err = tmpFile.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek temp file: %w", err)
+	}
+
+	// Step 3: Modify
+	if err = modify(tmpFile); err != nil {
+		return err
+	}
+
+	// Step 4: Flush to disk and replace
+	if err = tmpFile.Chmod(fileMode); err != nil {
+		return fmt.Errorf("failed to chmod temp file: %w", err)
+	}
+	if err = tmpFile.Sync(); err != nil {
+		return fmt.Errorf("failed to sync temp file: %w", err)
+	}
+	if err = tmpFile.Close(); err != nil {
+		return fmt.Errorf("failed to close temp file: %w", err)
+	}
+	if err = os.Rename(tmpFilePath, knownHostsFilePath); err != nil {
+		return fmt.Errorf("failed to replace known_hosts file: %w", err)
+	}
+	if err = syncDir(filepath.Dir(knownHostsFilePath)); err != nil {
+		return fmt.Errorf("failed to sync known_hosts directory: %w", err)
+	}
+
+	return nil
+}
+
+// readKnownHosts reads the whole known_hosts file, a missing file is treated as empty
+func readKnownHosts(knownHostsFilePath string) ([]byte, error) {
+	knownHostsContent, err := os.ReadFile(knownHostsFilePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	return knownHostsContent, nil
+}
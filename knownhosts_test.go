@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func Test_modifyKnownHosts(t *testing.T) {
+	testcases := []struct {
+		name           string
+		initialContent *string
+		modifyErr      error
+		wantContent    string
+	}{
+		{
+			name:           "create new file",
+			initialContent: nil,
+			wantContent:    "candinya.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl\n",
+		},
+		{
+			name:           "append to existing file",
+			initialContent: p("github.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFKGJvkCkPoissrebkHB17tYjPunEULNKP8fNN6fTQ8M\n"),
+			wantContent:    "github.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFKGJvkCkPoissrebkHB17tYjPunEULNKP8fNN6fTQ8M\ncandinya.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl\n",
+		},
+		{
+			name:           "keep original on failure",
+			initialContent: p("github.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFKGJvkCkPoissrebkHB17tYjPunEULNKP8fNN6fTQ8M\n"),
+			modifyErr:      errors.New("modify failed"),
+			wantContent:    "github.com ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFKGJvkCkPoissrebkHB17tYjPunEULNKP8fNN6fTQ8M\n",
+		},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			// Prepare
+			dir := t.TempDir()
+			knownHostsFilePath := filepath.Join(dir, "known_hosts")
+			if testcase.initialContent != nil {
+				if err := os.WriteFile(knownHostsFilePath, []byte(*testcase.initialContent), 0600); err != nil {
+					t.Fatalf("failed to write content: %v", err)
+				}
+			}
+
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"))
+			if err != nil {
+				t.Fatalf("failed to parse public key: %v", err)
+			}
+
+			// Test
+			err = modifyKnownHosts(knownHostsFilePath, func(knownHostsFile *os.File) error {
+				if err := updateKnownHosts(knownHostsFile, "candinya.com", key, nil, nil, 0, 0); err != nil {
+					return err
+				}
+				return testcase.modifyErr
+			})
+			if !errors.Is(err, testcase.modifyErr) {
+				t.Errorf("Unexpected error: expected %v, got %v", testcase.modifyErr, err)
+			}
+
+			// Validate
+			content, err := os.ReadFile(knownHostsFilePath)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("failed to read content: %v", err)
+			}
+
+			if string(content) != testcase.wantContent {
+				t.Errorf("Unexpected content: expected %q, got %q", testcase.wantContent, string(content))
+			}
+
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatalf("failed to read dir: %v", err)
+			}
+			for _, entry := range entries {
+				if strings.HasSuffix(entry.Name(), ".tmp") {
+					t.Errorf("Unexpected temp file left: %s", entry.Name())
+				}
+			}
+		})
+	}
+}
+
+func Test_modifyKnownHosts_concurrent(t *testing.T) {
+	const writers = 32
+
+	knownHostsFilePath := filepath.Join(t.TempDir(), "known_hosts")
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"))
+	if err != nil {
+		t.Fatalf("failed to parse public key: %v", err)
+	}
+
+	// Every writer adds itself to the same line, so lost updates would show up as missing hosts
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(hostname string) {
+			defer wg.Done()
+
+			if err := modifyKnownHosts(knownHostsFilePath, func(knownHostsFile *os.File) error {
+				_, hostsWithSameKey, _, relevantLineStart, relevantLineEnd := findServer(knownHostsFile, hostname, "", key)
+				return updateKnownHosts(knownHostsFile, hostname, key, nil, hostsWithSameKey, relevantLineStart, relevantLineEnd)
+			}); err != nil {
+				t.Errorf("failed to modify known_hosts file: %v", err)
+			}
+		}(fmt.Sprintf("host%d.candinya.com", i))
+	}
+	wg.Wait()
+
+	// Validate
+	content, err := os.ReadFile(knownHostsFilePath)
+	if err != nil {
+		t.Fatalf("failed to read content: %v", err)
+	}
+
+	if bytes.Count(content, []byte{'\n'}) != 1 {
+		t.Fatalf("Unexpected content: expected single line, got %q", string(content))
+	}
+
+	hostsInLine, keyInLine, _, err := parseKnownHostsLine(string(content))
+	if err != nil {
+		t.Fatalf("failed to parse line: %v", err)
+	}
+
+	if !bytes.Equal(keyInLine.Marshal(), key.Marshal()) {
+		t.Errorf("Unexpected key: got %s", ssh.FingerprintSHA256(keyInLine))
+	}
+
+	for i := 0; i < writers; i++ {
+		if !arrayContains(hostsInLine, fmt.Sprintf("host%d.candinya.com", i)) {
+			t.Errorf("Unexpected lost update: host%d.candinya.com", i)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const CommandKnownHosts = "known-hosts"
+
+type KnownHostsEntry struct {
+	Hosts       []string `json:"h"`
+	KeyType     string   `json:"t"`
+	Fingerprint string   `json:"fp"`
+	Key         string   `json:"k"` // authorized_keys format, without comment
+	Comment     string   `json:"c,omitempty"`
+}
+
+type KnownHostsHashResult struct {
+	Hashed int `json:"n"` // number of hosts hashed
+}
+
+// runKnownHostsCommand handles `pipessh known-hosts <list|find|remove|add|hash> -f file ...`, results are written to stdout as JSON
+func runKnownHostsCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing subcommand, expected one of list, find, remove, add, hash")
+	}
+
+	subcommand := args[0]
+	flagSet := flag.NewFlagSet(CommandKnownHosts+" "+subcommand, flag.ContinueOnError)
+	knownHostsFilePath := flagSet.String("f", "", "known_hosts file, required")
+	fingerprint := flagSet.String("fp", "", "Only remove key with this SHA256 fingerprint")
+	if err := flagSet.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	if *knownHostsFilePath == "" {
+		// Same as connecting, never fall back to known_hosts of OpenSSH
+		return fmt.Errorf("known_hosts file is required, specify it with -f")
+	}
+
+	var result any
+	switch subcommand {
+	case "list":
+		knownHostsContent, err := readKnownHosts(*knownHostsFilePath)
+		if err != nil {
+			return fmt.Errorf("failed to read known_hosts file: %w", err)
+		}
+		result = listKnownHosts(bytes.NewReader(knownHostsContent), "")
+	case "find":
+		if flagSet.NArg() != 1 {
+			return fmt.Errorf("usage: %s find -f file host[:port]", CommandKnownHosts)
+		}
+		rawHostname, _, err := parseKnownHostsCommandHost(flagSet.Arg(0))
+		if err != nil {
+			return err
+		}
+		knownHostsContent, err := readKnownHosts(*knownHostsFilePath)
+		if err != nil {
+			return fmt.Errorf("failed to read known_hosts file: %w", err)
+		}
+		result = listKnownHosts(bytes.NewReader(knownHostsContent), rawHostname)
+	case "remove":
+		if flagSet.NArg() != 1 {
+			return fmt.Errorf("usage: %s remove -f file [-fp fingerprint] host[:port]", CommandKnownHosts)
+		}
+		rawHostname, friendlyHostname, err := parseKnownHostsCommandHost(flagSet.Arg(0))
+		if err != nil {
+			return err
+		}
+		evPayload := EventPayloadHostKeysUpdated{
+			Host: friendlyHostname,
+		}
+		if err = modifyKnownHosts(*knownHostsFilePath, func(knownHostsFile *os.File) error {
+			evPayload.Removed, err = removeKnownHost(knownHostsFile, rawHostname, *fingerprint)
+			return err
+		}); err != nil {
+			return fmt.Errorf("failed to update known_hosts file: %w", err)
+		}
+		result = evPayload
+	case "add":
+		if flagSet.NArg() < 2 {
+			return fmt.Errorf("usage: %s add -f file host[:port] key-type key", CommandKnownHosts)
+		}
+		rawHostname, friendlyHostname, err := parseKnownHostsCommandHost(flagSet.Arg(0))
+		if err != nil {
+			return err
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.Join(flagSet.Args()[1:], " ")))
+		if err != nil {
+			return fmt.Errorf("failed to parse key: %w", err)
+		}
+		evPayload := EventPayloadHostKeysUpdated{
+			Host: friendlyHostname,
+		}
+		if err = modifyKnownHosts(*knownHostsFilePath, func(knownHostsFile *os.File) error {
+			isPerfectMatch, hostsWithSameKey, oldKey, relevantLineStart, relevantLineEnd := findServer(knownHostsFile, rawHostname, "", key)
+			if isPerfectMatch {
+				// Already known
+				return nil
+			}
+
+			if err := updateKnownHosts(knownHostsFile, rawHostname, key, oldKey, hostsWithSameKey, relevantLineStart, relevantLineEnd); err != nil {
+				return err
+			}
+
+			evPayload.Added = append(evPayload.Added, ssh.FingerprintSHA256(key))
+			if oldKey != nil {
+				evPayload.Removed = append(evPayload.Removed, ssh.FingerprintSHA256(oldKey))
+			}
+			return nil
+		}); err != nil {
+			return fmt.Errorf("failed to update known_hosts file: %w", err)
+		}
+		result = evPayload
+	case "hash":
+		hashResult := KnownHostsHashResult{}
+		if err := modifyKnownHosts(*knownHostsFilePath, func(knownHostsFile *os.File) (err error) {
+			hashResult.Hashed, err = hashKnownHosts(knownHostsFile)
+			return err
+		}); err != nil {
+			return fmt.Errorf("failed to update known_hosts file: %w", err)
+		}
+		result = hashResult
+	default:
+		return fmt.Errorf("unknown subcommand %s", subcommand)
+	}
+
+	return json.NewEncoder(os.Stdout).Encode(result)
+}
+
+// parseKnownHostsCommandHost accepts host in the same format as target server
+func parseKnownHostsCommandHost(host string) (rawHostname, friendlyHostname string, err error) {
+	server, err := parseServer(host)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to parse host %s: %w", host, err)
+	}
+
+	return extractHostname(net.JoinHostPort(server.Host, strconv.Itoa(server.Port)))
+}
+
+// listKnownHosts lists all entries matching hostname, or all entries if hostname is empty
+func listKnownHosts(knownHostsFile io.Reader, hostname string) []KnownHostsEntry {
+	entries := []KnownHostsEntry{} // never output null
+
+	scanKnownHostsLines(knownHostsFile, func(line string, _, _ int64) bool {
+		hostsInLine, keyInLine, comment, err := parseKnownHostsLine(line)
+		if err != nil {
+			// Empty, comment or malformed line, skip
+			return true
+		}
+
+		if hostname == "" || matchKnownHost(hostsInLine, hostname) {
+			entries = append(entries, KnownHostsEntry{
+				Hosts:       hostsInLine,
+				KeyType:     keyInLine.Type(),
+				Fingerprint: ssh.FingerprintSHA256(keyInLine),
+				Key:         string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(keyInLine))),
+				Comment:     comment,
+			})
+		}
+
+		return true
+	})
+
+	return entries
+}
+
+// removeKnownHost removes hostname from all lines (only the one holding fingerprint if specified), lines left with no host are deleted
+func removeKnownHost(knownHostsFile *os.File, hostname string, fingerprint string) ([]string, error) {
+	var removed []string
+
+	err := rewriteKnownHostsLines(knownHostsFile, func(hosts []string, key ssh.PublicKey, comment string) ([]string, bool) {
+		if !matchKnownHost(hosts, hostname) || (fingerprint != "" && ssh.FingerprintSHA256(key) != fingerprint) {
+			return nil, false
+		}
+
+		var hostsLeft []string
+		for _, host := range hosts {
+			if !matchKnownHost([]string{host}, hostname) {
+				hostsLeft = append(hostsLeft, host)
+			}
+		}
+		removed = append(removed, ssh.FingerprintSHA256(key))
+
+		if len(hostsLeft) == 0 {
+			// Delete whole line
+			return nil, true
+		}
+		return []string{withComment(formatKnownHostsLine(hostsLeft, key), comment)}, true
+	})
+
+	return removed, err
+}
+
+// hashKnownHosts replaces all plain hosts with hashed ones, one line for each host like ssh-keygen -H does
+func hashKnownHosts(knownHostsFile *os.File) (int, error) {
+	hashed := 0
+
+	var hashErr error = nil
+	err := rewriteKnownHostsLines(knownHostsFile, func(hosts []string, key ssh.PublicKey, comment string) ([]string, bool) {
+		if hashErr != nil {
+			return nil, false
+		}
+
+		var lines []string
+		isChanged := false
+		for _, host := range hosts {
+			if strings.HasPrefix(host, KnownHostsHashMagic) {
+				// Already hashed
+				lines = append(lines, withComment(formatKnownHostsLine([]string{host}, key), comment))
+				continue
+			}
+
+			salt := make([]byte, KnownHostsHashSaltSize)
+			if _, err := rand.Read(salt); err != nil {
+				hashErr = fmt.Errorf("failed to generate salt: %w", err)
+				return nil, false
+			}
+			lines = append(lines, withComment(formatKnownHostsLine([]string{hashKnownHost(host, salt)}, key), comment))
+			isChanged = true
+			hashed++
+		}
+
+		return lines, isChanged
+	})
+	if err != nil {
+		return 0, err
+	}
+	if hashErr != nil {
+		return 0, hashErr
+	}
+
+	return hashed, nil
+}
+
+func withComment(line string, comment string) string {
+	if comment == "" {
+		return line
+	}
+	return line + " " + comment
+}
+
+// rewriteKnownHostsLines replaces every line that rewrite reports changed with the returned lines, no lines means delete
+func rewriteKnownHostsLines(knownHostsFile *os.File, rewrite func(hosts []string, key ssh.PublicKey, comment string) ([]string, bool)) error {
+	// Keep the line separator style of this file
+	lineSeparator, err := detectLineSeparator(knownHostsFile)
+	if err != nil {
+		return fmt.Errorf("failed to detect line separator of known_hosts file: %w", err)
+	}
+
+	type lineReplacement struct {
+		start, end int64
+		content    []byte
+	}
+	var replacements []lineReplacement
+
+	scanKnownHostsLines(io.NewSectionReader(knownHostsFile, 0, math.MaxInt64), func(line string, lineStart, lineEnd int64) bool {
+		hostsInLine, keyInLine, comment, err := parseKnownHostsLine(line)
+		if err != nil {
+			// Empty, comment or malformed line, keep as is
+			return true
+		}
+
+		newLines, isChanged := rewrite(hostsInLine, keyInLine, comment)
+		if !isChanged {
+			return true
+		}
+
+		content := strings.Join(newLines, lineSeparator)
+		if len(newLines) > 0 && lineEnd-lineStart > int64(len(line)) {
+			// Original line has a line separator, keep it
+			content += lineSeparator
+		}
+		replacements = append(replacements, lineReplacement{lineStart, lineEnd, []byte(content)})
+
+		return true
+	})
+
+	// Replace from bottom to top, so offsets of lines before are not affected
+	for i := len(replacements) - 1; i >= 0; i-- {
+		if err = spareSpace(knownHostsFile, replacements[i].start, replacements[i].end, int64(len(replacements[i].content))); err != nil {
+			return fmt.Errorf("failed to spare space from known_hosts file: %w", err)
+		}
+		if _, err = knownHostsFile.WriteAt(replacements[i].content, replacements[i].start); err != nil {
+			return fmt.Errorf("failed to write to known_hosts file: %w", err)
+		}
+	}
+
+	return nil
+}
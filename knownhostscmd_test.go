@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	testKnownHostsKeyCandinya = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"
+	testKnownHostsKeyGithub   = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFKGJvkCkPoissrebkHB17tYjPunEULNKP8fNN6fTQ8M"
+)
+
+func Test_matchKnownHost(t *testing.T) {
+	hashedHost := hashKnownHost("candinya.com", []byte("0123456789abcdefghij"))
+
+	testcases := []struct {
+		name      string
+		hosts     []string
+		hostname  string
+		wantMatch bool
+	}{
+		{name: "plain", hosts: []string{"github.com", "candinya.com"}, hostname: "candinya.com", wantMatch: true},
+		{name: "plain mismatch", hosts: []string{"github.com"}, hostname: "candinya.com", wantMatch: false},
+		{name: "hashed", hosts: []string{hashedHost}, hostname: "candinya.com", wantMatch: true},
+		{name: "hashed mismatch", hosts: []string{hashedHost}, hostname: "github.com", wantMatch: false},
+		{name: "hashed malformed", hosts: []string{"|1|abc"}, hostname: "candinya.com", wantMatch: false},
+		{name: "hashed bad salt", hosts: []string{"|1|!!!|abc"}, hostname: "candinya.com", wantMatch: false},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			if match := matchKnownHost(testcase.hosts, testcase.hostname); match != testcase.wantMatch {
+				t.Errorf("Unexpected match: expected %t, got %t", testcase.wantMatch, match)
+			}
+		})
+	}
+}
+
+func Test_listKnownHosts(t *testing.T) {
+	knownHosts := "# comment\n" +
+		"candinya.com,[candinya.com]:2233 " + testKnownHostsKeyCandinya + " candinya@nekops\n" +
+		"github.com " + testKnownHostsKeyGithub + "\n"
+
+	testcases := []struct {
+		name      string
+		hostname  string
+		wantHosts [][]string
+	}{
+		{name: "all", hostname: "", wantHosts: [][]string{{"candinya.com", "[candinya.com]:2233"}, {"github.com"}}},
+		{name: "find", hostname: "[candinya.com]:2233", wantHosts: [][]string{{"candinya.com", "[candinya.com]:2233"}}},
+		{name: "find none", hostname: "example.com", wantHosts: nil},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			entries := listKnownHosts(strings.NewReader(knownHosts), testcase.hostname)
+			if entries == nil {
+				t.Fatalf("Unexpected nil entries")
+			}
+
+			var hosts [][]string
+			for _, entry := range entries {
+				hosts = append(hosts, entry.Hosts)
+			}
+			if !reflect.DeepEqual(hosts, testcase.wantHosts) {
+				t.Errorf("Unexpected hosts: expected %v, got %v", testcase.wantHosts, hosts)
+			}
+		})
+	}
+
+	// Details
+	entries := listKnownHosts(strings.NewReader(knownHosts), "candinya.com")
+	if len(entries) != 1 {
+		t.Fatalf("Unexpected entries count: %d", len(entries))
+	}
+	if entries[0].KeyType != "ssh-ed25519" || entries[0].Key != testKnownHostsKeyCandinya || entries[0].Comment != "candinya@nekops" {
+		t.Errorf("Unexpected entry: %+v", entries[0])
+	}
+}
+
+func Test_removeKnownHost(t *testing.T) {
+	testcases := []struct {
+		name           string
+		initialContent string
+		hostname       string
+		fingerprint    string
+		wantRemoved    int
+		wantContent    string
+	}{
+		{
+			name:           "remove line",
+			initialContent: "candinya.com " + testKnownHostsKeyCandinya + "\ngithub.com " + testKnownHostsKeyGithub + "\n",
+			hostname:       "candinya.com",
+			wantRemoved:    1,
+			wantContent:    "github.com " + testKnownHostsKeyGithub + "\n",
+		},
+		{
+			name:           "remove host from line",
+			initialContent: "candinya.com,192.168.3.117 " + testKnownHostsKeyCandinya + " my server\r\ngithub.com " + testKnownHostsKeyGithub + "\r\n",
+			hostname:       "candinya.com",
+			wantRemoved:    1,
+			wantContent:    "192.168.3.117 " + testKnownHostsKeyCandinya + " my server\r\ngithub.com " + testKnownHostsKeyGithub + "\r\n",
+		},
+		{
+			name:           "remove all keys",
+			initialContent: "candinya.com " + testKnownHostsKeyCandinya + "\n# keep\ncandinya.com " + testKnownHostsKeyGithub,
+			hostname:       "candinya.com",
+			wantRemoved:    2,
+			wantContent:    "# keep\n",
+		},
+		{
+			name:           "remove by fingerprint",
+			initialContent: "candinya.com " + testKnownHostsKeyCandinya + "\ncandinya.com " + testKnownHostsKeyGithub + "\n",
+			hostname:       "candinya.com",
+			fingerprint:    "SHA256:iAFhEN5AUi2EbDl9gClWaaLYaBcMSzOLEkC7M6C75mQ",
+			wantRemoved:    1,
+			wantContent:    "candinya.com " + testKnownHostsKeyCandinya + "\n",
+		},
+		{
+			name:           "remove hashed",
+			initialContent: hashKnownHost("candinya.com", []byte("0123456789abcdefghij")) + " " + testKnownHostsKeyCandinya + "\n",
+			hostname:       "candinya.com",
+			wantRemoved:    1,
+			wantContent:    "",
+		},
+		{
+			name:           "nothing to remove",
+			initialContent: "github.com " + testKnownHostsKeyGithub + "\n",
+			hostname:       "candinya.com",
+			wantRemoved:    0,
+			wantContent:    "github.com " + testKnownHostsKeyGithub + "\n",
+		},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			knownHostsFilePath := filepath.Join(t.TempDir(), "known_hosts")
+			if err := os.WriteFile(knownHostsFilePath, []byte(testcase.initialContent), 0600); err != nil {
+				t.Fatalf("failed to write content: %v", err)
+			}
+
+			var removed []string
+			if err := modifyKnownHosts(knownHostsFilePath, func(knownHostsFile *os.File) (err error) {
+				removed, err = removeKnownHost(knownHostsFile, testcase.hostname, testcase.fingerprint)
+				return err
+			}); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if len(removed) != testcase.wantRemoved {
+				t.Errorf("Unexpected removed count: expected %d, got %d", testcase.wantRemoved, len(removed))
+			}
+
+			content, err := os.ReadFile(knownHostsFilePath)
+			if err != nil {
+				t.Fatalf("failed to read content: %v", err)
+			}
+			if string(content) != testcase.wantContent {
+				t.Errorf("Unexpected content: expected %q, got %q", testcase.wantContent, string(content))
+			}
+		})
+	}
+}
+
+func Test_hashKnownHosts(t *testing.T) {
+	knownHostsFilePath := filepath.Join(t.TempDir(), "known_hosts")
+	initialContent := "# comment\ncandinya.com,[candinya.com]:2233 " + testKnownHostsKeyCandinya + " my server\n" + hashKnownHost("github.com", []byte("0123456789abcdefghij")) + " " + testKnownHostsKeyGithub + "\n"
+	if err := os.WriteFile(knownHostsFilePath, []byte(initialContent), 0600); err != nil {
+		t.Fatalf("failed to write content: %v", err)
+	}
+
+	var hashed int
+	if err := modifyKnownHosts(knownHostsFilePath, func(knownHostsFile *os.File) (err error) {
+		hashed, err = hashKnownHosts(knownHostsFile)
+		return err
+	}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if hashed != 2 {
+		t.Errorf("Unexpected hashed count: expected 2, got %d", hashed)
+	}
+
+	content, err := os.ReadFile(knownHostsFilePath)
+	if err != nil {
+		t.Fatalf("failed to read content: %v", err)
+	}
+
+	if bytes.Contains(content, []byte("candinya.com")) {
+		t.Errorf("Unexpected plain host left: %q", string(content))
+	}
+	if !bytes.HasPrefix(content, []byte("# comment\n")) {
+		t.Errorf("Unexpected comment line lost: %q", string(content))
+	}
+
+	entries := listKnownHosts(bytes.NewReader(content), "")
+	if len(entries) != 3 {
+		t.Fatalf("Unexpected entries count: expected 3, got %d", len(entries))
+	}
+	for i, hostname := range []string{"candinya.com", "[candinya.com]:2233", "github.com"} {
+		if len(entries[i].Hosts) != 1 || !matchKnownHost(entries[i].Hosts, hostname) {
+			t.Errorf("Unexpected entry %d: %v doesn't match %s", i, entries[i].Hosts, hostname)
+		}
+		if i < 2 && entries[i].Comment != "my server" {
+			t.Errorf("Unexpected comment of entry %d: %q", i, entries[i].Comment)
+		}
+	}
+}
+
+func Test_runKnownHostsCommand_requiresFile(t *testing.T) {
+	for _, subcommand := range []string{"list", "hash", "add"} {
+		subcommand := subcommand
+		t.Run(subcommand, func(t *testing.T) {
+			t.Parallel()
+
+			if err := runKnownHostsCommand([]string{subcommand}); err == nil {
+				t.Errorf("got no error without -f, want error")
+			}
+		})
+	}
+}
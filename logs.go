@@ -1,12 +1,84 @@
 package main
 
-import "os"
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
 
-func LogError(err error) {
-	_, _ = os.Stderr.WriteString(err.Error() + "\r\n")
+// Verbosity levels, raised by each -v
+const (
+	LogLevelDebug1 = 1 + iota // connection steps
+	LogLevelDebug2            // options, keys and algorithms
+	LogLevelDebug3            // everything else
+)
+
+var (
+	logLock      sync.Mutex
+	logWriter    io.Writer = os.Stderr
+	logLineBreak           = "\r\n" // terminal is in raw mode, so line feed alone is not enough
+	logLevel               = 0
+)
+
+// FlagVerbosity counts -v, -vv and -vvv like OpenSSH, each of them can be repeated
+type FlagVerbosity struct {
+	level *int
+	step  int
+}
+
+// String is an implementation of the flag.Value interface
+func (v FlagVerbosity) String() string {
+	if v.level == nil {
+		return "0"
+	}
+	return fmt.Sprintf("%d", *v.level)
+}
+
+// Set is an implementation of the flag.Value interface
+func (v FlagVerbosity) Set(_ string) error {
+	*v.level += v.step
+	return nil
+}
+
+// IsBoolFlag makes flag package accept it without value
+func (v FlagVerbosity) IsBoolFlag() bool {
+	return true
 }
 
-func LogPanic(err error) {
-	LogError(err)
-	os.Exit(1)
+// setupLogger applies verbosity, and redirects all logs to logFile if set
+func setupLogger(level int, logFile string) error {
+	logLock.Lock()
+	defer logLock.Unlock()
+
+	logLevel = level
+	if logFile != "" {
+		f, err := os.OpenFile(logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to open log file %s: %w", logFile, err)
+		}
+		logWriter = f // kept open till exit
+		logLineBreak = "\n"
+	}
+	return nil
+}
+
+func writeLog(line string) {
+	logLock.Lock()
+	defer logLock.Unlock()
+
+	_, _ = io.WriteString(logWriter, line+logLineBreak)
+}
+
+// LogDebug writes message when verbosity reaches level, prefixed like OpenSSH does
+func LogDebug(level int, format string, a ...any) {
+	if logLevel < level {
+		return
+	}
+	writeLog(fmt.Sprintf("debug%d: ", level) + strings.TrimRight(fmt.Sprintf(format, a...), "\r\n"))
+}
+
+func LogError(err error) {
+	writeLog(err.Error())
 }
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_FlagVerbosity(t *testing.T) {
+	testcases := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{
+			name: "quiet",
+			args: []string{"root@candinya.com"},
+			want: 0,
+		},
+		{
+			name: "single",
+			args: []string{"-v", "root@candinya.com"},
+			want: LogLevelDebug1,
+		},
+		{
+			name: "repeated",
+			args: []string{"-v", "-v", "root@candinya.com"},
+			want: LogLevelDebug2,
+		},
+		{
+			name: "combined",
+			args: []string{"-vvv", "root@candinya.com"},
+			want: LogLevelDebug3,
+		},
+		{
+			name: "mixed",
+			args: []string{"-vv", "-v", "root@candinya.com"},
+			want: LogLevelDebug3,
+		},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			level := 0
+			flagSet := flag.NewFlagSet("pipessh", flag.ContinueOnError)
+			flagSet.Var(FlagVerbosity{&level, 1}, "v", "")
+			flagSet.Var(FlagVerbosity{&level, 2}, "vv", "")
+			flagSet.Var(FlagVerbosity{&level, 3}, "vvv", "")
+
+			if err := flagSet.Parse(testcase.args); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if level != testcase.want {
+				t.Errorf("Unexpected level: expected %d, got %d", testcase.want, level)
+			}
+			if flagSet.NArg() != 1 {
+				t.Errorf("Unexpected args: %v", flagSet.Args())
+			}
+		})
+	}
+}
+
+func Test_setupLogger(t *testing.T) {
+	// Not parallel, logger is global
+	defer func(writer io.Writer, lineBreak string, level int) {
+		logWriter, logLineBreak, logLevel = writer, lineBreak, level
+	}(logWriter, logLineBreak, logLevel)
+
+	logFile := filepath.Join(t.TempDir(), "pipessh.log")
+	if err := os.WriteFile(logFile, []byte("old\n"), 0600); err != nil {
+		t.Fatalf("failed to write log file: %v", err)
+	}
+	if err := setupLogger(LogLevelDebug1, logFile); err != nil {
+		t.Fatalf("failed to setup logger: %v", err)
+	}
+	LogDebug(LogLevelDebug1, "connecting")
+	LogDebug(LogLevelDebug2, "ignored")
+	LogError(fmt.Errorf("failed"))
+	_ = logWriter.(*os.File).Close()
+
+	content, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatalf("failed to read log file: %v", err)
+	}
+	if want := "old\ndebug1: connecting\nfailed\n"; string(content) != want {
+		t.Errorf("got %q, want %q", content, want)
+	}
+}
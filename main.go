@@ -1,16 +1,67 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"golang.org/x/crypto/ssh"
 	"os"
+	"time"
 )
 
 func main() {
+	// Exit only after all deferred cleanups are done
+	os.Exit(run())
+}
+
+func run() int {
+	// Subcommands
+	if len(os.Args) > 1 && os.Args[1] == CommandKnownHosts {
+		if err := runKnownHostsCommand(os.Args[2:]); err != nil {
+			// Output is JSON, so don't mix error event into it
+			LogError(fmt.Errorf("failed to run %s: %w", CommandKnownHosts, err))
+			return 1
+		}
+		return 0
+	}
+
+	// Same options as ssh, but work with files instead of a shell
+	args := os.Args[1:]
+	mode := ""
+	if len(args) > 0 && (args[0] == CommandSFTP || args[0] == CommandSCP) {
+		mode = args[0]
+		args = args[1:]
+	}
+
+	operands, err := parseArgs(args)
+	if err != nil {
+		return reportError(withCode(ErrorCodeUsage, fmt.Errorf("failed to parse arguments: %w", err)))
+	}
+
+	// Destination is part of a remote path for scp
+	var destination string
+	var scpTransfer *SCPTransfer
+	if mode == CommandSCP {
+		if len(operands) != 2 {
+			return reportError(withCode(ErrorCodeUsage, fmt.Errorf("expected source and target, got %d arguments", len(operands))))
+		}
+		if scpTransfer, destination, err = parseSCPOperands(operands[0], operands[1]); err != nil {
+			return reportError(withCode(ErrorCodeUsage, fmt.Errorf("failed to parse scp arguments: %w", err)))
+		}
+		scpTransfer.Recursive, scpTransfer.Preserve = flagRecursive, flagPreserve
+	} else {
+		if flagRecursive || flagPreserve {
+			return reportError(withCode(ErrorCodeUsage, fmt.Errorf("-r and -preserve are only supported in scp mode")))
+		}
+		if len(operands) != 1 {
+			return reportError(withCode(ErrorCodeUsage, fmt.Errorf("expected destination, got %d arguments", len(operands))))
+		}
+		destination = operands[0]
+	}
+
 	// Prepare basic info
-	targetServer, jumpServer, privateKeys, knownHostsFilePath, err := prepare()
+	targetServer, jumpServer, sessionConfig, privateKeys, err := prepare(destination)
 	if err != nil {
-		LogPanic(fmt.Errorf("failed to prepare: %w", err))
+		return reportError(withCode(ErrorCodeUsage, fmt.Errorf("failed to prepare: %w", err)))
 	}
 
 	// Prepare private keys
@@ -31,29 +82,36 @@ func main() {
 		signers = append(signers, signer)
 	}
 
-	var keyAuth ssh.AuthMethod = nil
-	if len(signers) > 0 {
-		keyAuth = ssh.PublicKeys(signers...)
+	// Measure connecting phases of each hop
+	targetServer.Timing = &HopTiming{Hop: HopTarget, Host: targetServer.Host}
+	if jumpServer != nil {
+		jumpServer.Timing = &HopTiming{Hop: HopJump, Host: jumpServer.Host}
 	}
 
 	// Configure SSH client
-	targetConfig, err := sshConfig(targetServer, keyAuth, knownHostsFilePath)
+	targetConfig, err := sshConfig(targetServer, signers)
 	if err != nil {
-		LogPanic(fmt.Errorf("failed to configure target server: %w", err))
+		return reportError(withHop(HopTarget, withCode(ErrorCodeUsage, fmt.Errorf("failed to configure target server: %w", err))))
 	}
 
 	var jumpConfig *ssh.ClientConfig = nil
 	if jumpServer != nil {
-		jumpConfig, err = sshConfig(jumpServer, keyAuth, knownHostsFilePath)
+		jumpConfig, err = sshConfig(jumpServer, signers)
 		if err != nil {
-			LogPanic(fmt.Errorf("failed to configure jump server: %w", err))
+			return reportError(withHop(HopJump, withCode(ErrorCodeUsage, fmt.Errorf("failed to configure jump server: %w", err))))
 		}
 	}
 
+	// Accept host keys rotation from target server
+	var targetRequestsFilter RequestsFilter = nil
+	if targetServer.HostKeyConfig.UserKnownHostsFile != nil {
+		targetRequestsFilter = prepareHostKeysUpdate(targetServer.HostKeyConfig, targetConfig)
+	}
+
 	// Dial
-	targetClient, jumpClient, err := sshDial(targetServer, targetConfig, jumpServer, jumpConfig)
+	targetClient, jumpClient, err := sshDial(targetServer, targetConfig, jumpServer, jumpConfig, targetRequestsFilter)
 	if err != nil {
-		LogPanic(fmt.Errorf("failed to dial: %w", err))
+		return reportError(fmt.Errorf("failed to dial: %w", err))
 	}
 
 	if jumpClient != nil {
@@ -62,76 +120,119 @@ func main() {
 
 	defer targetClient.Close()
 
+	switch mode {
+	case CommandSFTP:
+		// Commands are read from stdin, hostKey event on re-key can't be replied
+		hostKeyReplies.pipeStdin(false)
+		if err = runSFTPSession(targetClient, os.Stdin); err != nil {
+			return reportError(err)
+		}
+		return 0
+	case CommandSCP:
+		if err = runSCPSession(targetClient, scpTransfer); err != nil {
+			return reportError(err)
+		}
+		return 0
+	}
+
 	// Create session
+	timingPayload := EventPayloadTiming{}
+	if jumpServer != nil {
+		timingPayload.Hops = append(timingPayload.Hops, jumpServer.Timing)
+	}
+	timingPayload.Hops = append(timingPayload.Hops, targetServer.Timing)
+
+	LogDebug(LogLevelDebug1, "opening session")
+	sessionStart := time.Now()
 	session, err := targetClient.NewSession()
 	if err != nil {
-		LogPanic(fmt.Errorf("failed to create session: %w", err))
+		return reportError(withHop(HopTarget, withCode(ErrorCodeSessionFailed, fmt.Errorf("failed to create session: %w", err))))
 	}
 	defer session.Close()
+	timingPayload.Session = milliseconds(time.Since(sessionStart))
 
 	// Pipe stdin/stdout/stderr
-	sshStdIn, err := session.StdinPipe()
-	if err != nil {
-		LogPanic(fmt.Errorf("failed to pipe stdin: %w", err))
-	}
-	sshStdout, err := session.StdoutPipe()
+	attachedSession, err := attachSession(session, os.Stdin, os.Stdout, os.Stderr, sessionConfig.Subsystem != "")
 	if err != nil {
-		LogPanic(fmt.Errorf("failed to pipe stdout: %w", err))
+		return reportError(err)
 	}
-	sshStderr, err := session.StderrPipe()
-	if err != nil {
-		LogPanic(fmt.Errorf("failed to pipe stderr: %w", err))
+
+	// Loading finish, start
+	if err = sendEvent(EventNameSSHStart, nil); err != nil {
+		return reportError(err)
 	}
 
-	defer sshStdIn.Close()
+	// Request pseudo terminal
+	if sessionConfig.RequestPty {
+		LogDebug(LogLevelDebug2, "requesting pty %s of %dx%d", sessionConfig.Term, sessionConfig.Rows, sessionConfig.Cols)
+		ptyStart := time.Now()
+		if err = requestPty(session, sessionConfig); err != nil {
+			return reportError(withHop(HopTarget, withCode(ErrorCodePtyDenied, fmt.Errorf("failed to request pty: %w", err))))
+		}
+		timingPayload.Pty = milliseconds(time.Since(ptyStart))
+	}
 
-	// Pipe output to std
-	go func() {
-		if err := pipe(sshStdout, os.Stdout); err != nil {
-			LogPanic(fmt.Errorf("failed to pipe stdout: %w", err))
+	// Pass environment variables
+	if env := sessionEnv(sessionConfig.SendEnv, sessionConfig.SetEnv, os.Environ()); len(env) > 0 {
+		evPayload, err := sendSessionEnv(session, env)
+		if err != nil {
+			return reportError(err)
 		}
-	}()
-	go func() {
-		if err := pipe(sshStderr, os.Stderr); err != nil {
-			LogPanic(fmt.Errorf("failed to pipe stderr: %w", err))
+		if err = sendEvent(EventNameEnvironment, evPayload); err != nil {
+			LogError(err)
 		}
-	}()
+	}
 
-	// Pipe input from std
-	go func() {
-		if err := inPipe(os.Stdin, sshStdIn, session.WindowChange); err != nil {
-			LogPanic(fmt.Errorf("failed to in-pipe stdin: %w", err))
+	// Let remote use local keys
+	if sessionConfig.ForwardAgent {
+		if err = forwardAgent(targetClient, session, sessionConfig.AgentSocket, sessionConfig.ForwardAgentConfirm); err != nil {
+			// Session is still usable, as OpenSSH does
+			LogError(err)
 		}
-	}()
-
-	// Loading finish, start
-	startEventBytes, err := buildEvent(EventNameSSHStart, nil)
-	if err != nil {
-		LogPanic(fmt.Errorf("failed to build start event: %w", err))
-	}
-	if _, err = os.Stdout.Write(startEventBytes); err != nil {
-		LogPanic(fmt.Errorf("failed to write start event: %w", err))
 	}
 
-	// Setup terminal
-	modes := ssh.TerminalModes{
-		ssh.ECHO:          1,
-		ssh.TTY_OP_ISPEED: 14400,
-		ssh.TTY_OP_OSPEED: 14400,
+	// Let remote show windows on local display
+	if sessionConfig.ForwardX11 {
+		if err = forwardX11(targetClient, session, os.Getenv("DISPLAY"), sessionConfig.ForwardX11Trusted, sessionConfig.XAuthLocation); err != nil {
+			LogError(err)
+		}
 	}
 
-	// Request pseudo terminal
-	if err = session.RequestPty("xterm-256color", 24, 80, modes); err != nil {
-		LogPanic(fmt.Errorf("failed to request pty: %w", err))
+	// Start remote shell or subsystem
+	shellStart := time.Now()
+	if sessionConfig.Subsystem != "" {
+		LogDebug(LogLevelDebug2, "requesting subsystem %s", sessionConfig.Subsystem)
+		if err = session.RequestSubsystem(sessionConfig.Subsystem); err != nil {
+			return reportError(withHop(HopTarget, withCode(ErrorCodeSubsystemFailed, fmt.Errorf("failed to request subsystem %s: %w", sessionConfig.Subsystem, err))))
+		}
+	} else {
+		LogDebug(LogLevelDebug2, "requesting shell")
+		if err = session.Shell(); err != nil {
+			return reportError(withHop(HopTarget, withCode(ErrorCodeShellFailed, fmt.Errorf("failed to start shell: %w", err))))
+		}
 	}
+	timingPayload.Shell = milliseconds(time.Since(shellStart))
 
-	// Start remote shell
-	if err = session.Shell(); err != nil {
-		LogPanic(fmt.Errorf("failed to start shell: %w", err))
+	if err = sendEvent(EventNameTiming, timingPayload); err != nil {
+		LogError(err)
 	}
 
-	// Wait till end
-	if err = session.Wait(); err != nil {
-		LogPanic(fmt.Errorf("failed to wait: %w", err))
+	// Without pty, signals are for remote command. Otherwise tear down orderly, so all connections are closed and output is flushed
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	caughtSignal := watchSignals(ctx, cancel, session, !sessionConfig.RequestPty)
+
+	// Wait till end, hostKey event on re-key is replied by escape command from now on
+	hostKeyReplies.pipeStdin(sessionConfig.Subsystem == "")
+	exitStatus, err := attachedSession.Wait(ctx)
+	select {
+	case sig := <-caughtSignal:
+		return signalExitCode(sig)
+	default:
+	}
+	if err != nil {
+		return reportError(err)
 	}
+	LogDebug(LogLevelDebug1, "remote exited with status %d", exitStatus)
+	return exitStatus
 }
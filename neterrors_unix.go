@@ -0,0 +1,16 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"golang.org/x/sys/unix"
+)
+
+func isConnectionRefused(err error) bool {
+	return errors.Is(err, unix.ECONNREFUSED)
+}
+
+func isUnreachable(err error) bool {
+	return errors.Is(err, unix.EHOSTUNREACH) || errors.Is(err, unix.ENETUNREACH)
+}
@@ -0,0 +1,16 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"golang.org/x/sys/windows"
+)
+
+func isConnectionRefused(err error) bool {
+	return errors.Is(err, windows.WSAECONNREFUSED)
+}
+
+func isUnreachable(err error) bool {
+	return errors.Is(err, windows.WSAEHOSTUNREACH) || errors.Is(err, windows.WSAENETUNREACH)
+}
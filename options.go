@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const JumpOptionPrefix = "jump" // options with this prefix only apply to jump server
+
+type HopOptionSetter func(server *Server, value string) error
+type IdentityOptionSetter func(identityConfig *IdentityConfig, value string) error
+type SessionOptionSetter func(sessionConfig *SessionConfig, value string) error
+
+// hopOptionSetters apply to a single hop, keys are in lower case
+var hopOptionSetters = map[string]HopOptionSetter{
+	// Destination
+	"hostname": func(server *Server, value string) error {
+		server.Host = value
+		return nil
+	},
+	"port": func(server *Server, value string) error {
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("invalid port %s", value)
+		}
+		server.Port = port
+		return nil
+	},
+	"user": func(server *Server, value string) error {
+		if server.Username == nil {
+			// User specified in destination takes precedence, same as OpenSSH
+			server.Username = &value
+		}
+		return nil
+	},
+
+	// Connection
+	"connecttimeout": func(server *Server, value string) (err error) {
+		server.ConnectionConfig.ConnectTimeout, err = parseOptionDuration(value)
+		return err
+	},
+	"handshaketimeout": func(server *Server, value string) (err error) {
+		server.ConnectionConfig.HandshakeTimeout, err = parseOptionDuration(value)
+		return err
+	},
+	"authtimeout": func(server *Server, value string) (err error) {
+		server.ConnectionConfig.AuthTimeout, err = parseOptionDuration(value)
+		return err
+	},
+	"serveraliveinterval": func(server *Server, value string) (err error) {
+		server.ConnectionConfig.ServerAliveInterval, err = parseOptionDuration(value)
+		return err
+	},
+	"serveralivecountmax": func(server *Server, value string) error {
+		count, err := strconv.Atoi(value)
+		if err != nil || count < 1 {
+			return fmt.Errorf("invalid count %s", value)
+		}
+		server.ConnectionConfig.ServerAliveCountMax = count
+		return nil
+	},
+	"ciphers": func(server *Server, value string) (err error) {
+		server.ConnectionConfig.Ciphers, err = parseOptionAlgorithms(value, SupportedCiphers, DefaultCiphers)
+		return err
+	},
+	"kexalgorithms": func(server *Server, value string) (err error) {
+		server.ConnectionConfig.KexAlgorithms, err = parseOptionAlgorithms(value, SupportedKexAlgorithms, DefaultKexAlgorithms)
+		return err
+	},
+	"macs": func(server *Server, value string) (err error) {
+		server.ConnectionConfig.MACs, err = parseOptionAlgorithms(value, SupportedMACs, DefaultMACs)
+		return err
+	},
+	"hostkeyalgorithms": func(server *Server, value string) (err error) {
+		server.ConnectionConfig.HostKeyAlgorithms, err = parseOptionAlgorithms(value, SupportedHostKeyAlgorithms, DefaultHostKeyAlgorithms)
+		return err
+	},
+	"pubkeyacceptedalgorithms": func(server *Server, value string) (err error) {
+		server.ConnectionConfig.PubkeyAcceptedAlgorithms, err = parseOptionAlgorithms(value, SupportedPubkeyAcceptedAlgorithms, DefaultPubkeyAcceptedAlgorithms)
+		return err
+	},
+
+	// Host key verification
+	"userknownhostsfile": func(server *Server, value string) error {
+		server.HostKeyConfig.UserKnownHostsFile = &value
+		return nil
+	},
+	"globalknownhostsfile": func(server *Server, value string) error {
+		// Multiple paths are separated by whitespace
+		server.HostKeyConfig.GlobalKnownHostsFiles = append(server.HostKeyConfig.GlobalKnownHostsFiles, strings.Fields(value)...)
+		return nil
+	},
+	"stricthostkeychecking": func(server *Server, value string) (err error) {
+		server.HostKeyConfig.StrictHostKeyChecking, err = parseOptionEnum(value, []string{StrictHostKeyCheckingYes, StrictHostKeyCheckingAcceptNew, StrictHostKeyCheckingNo, StrictHostKeyCheckingOff, StrictHostKeyCheckingAsk})
+		return err
+	},
+	"hostkeyalias": func(server *Server, value string) error {
+		server.HostKeyConfig.HostKeyAlias = &value
+		return nil
+	},
+	"hostkeyprompttimeout": func(server *Server, value string) (err error) {
+		server.HostKeyConfig.PromptTimeout, err = parseOptionDuration(value)
+		return err
+	},
+	"verifyhostkeydns": func(server *Server, value string) (err error) {
+		server.HostKeyConfig.VerifyHostKeyDNS, err = parseOptionEnum(value, []string{VerifyHostKeyDNSNo, VerifyHostKeyDNSYes, VerifyHostKeyDNSAsk})
+		return err
+	},
+	"verifyhostkeydnsresolver": func(server *Server, value string) error {
+		server.HostKeyConfig.VerifyHostKeyDNSResolver = value
+		return nil
+	},
+}
+
+// identityOptionSetters apply to all hops, keys are in lower case
+var identityOptionSetters = map[string]IdentityOptionSetter{
+	"identityfile": func(identityConfig *IdentityConfig, value string) error {
+		identityConfig.IdentityFiles = append(identityConfig.IdentityFiles, value)
+		return nil
+	},
+	"identitiesonly": func(identityConfig *IdentityConfig, value string) (err error) {
+		identityConfig.IdentitiesOnly, err = parseOptionYesNo(value)
+		return err
+	},
+}
+
+// sessionOptionSetters apply to session on target server, keys are in lower case
+var sessionOptionSetters = map[string]SessionOptionSetter{
+	"terminalmode": func(sessionConfig *SessionConfig, value string) error {
+		modes, err := parseTerminalModes(value)
+		if err != nil {
+			return err
+		}
+		for opcode, modeValue := range modes {
+			sessionConfig.TerminalModes[opcode] = modeValue
+		}
+		return nil
+	},
+	"sendenv": func(sessionConfig *SessionConfig, value string) error {
+		// Multiple patterns are separated by whitespace
+		for _, pattern := range strings.Fields(value) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid pattern %s", pattern)
+			}
+			sessionConfig.SendEnv = append(sessionConfig.SendEnv, pattern)
+		}
+		return nil
+	},
+	"forwardagent": func(sessionConfig *SessionConfig, value string) error {
+		// Either yes, no, or path of agent socket which may refer to environment variables
+		if forward, err := parseOptionYesNo(value); err == nil {
+			sessionConfig.ForwardAgent = forward
+			return nil
+		}
+		sessionConfig.ForwardAgent = true
+		sessionConfig.AgentSocket = os.ExpandEnv(value)
+		if sessionConfig.AgentSocket == "" {
+			return fmt.Errorf("agent socket %s is empty", value)
+		}
+		return nil
+	},
+	"forwardagentconfirm": func(sessionConfig *SessionConfig, value string) (err error) {
+		sessionConfig.ForwardAgentConfirm, err = parseOptionYesNo(value)
+		return err
+	},
+	"forwardx11": func(sessionConfig *SessionConfig, value string) (err error) {
+		sessionConfig.ForwardX11, err = parseOptionYesNo(value)
+		return err
+	},
+	"forwardx11trusted": func(sessionConfig *SessionConfig, value string) (err error) {
+		sessionConfig.ForwardX11Trusted, err = parseOptionYesNo(value)
+		return err
+	},
+	"xauthlocation": func(sessionConfig *SessionConfig, value string) error {
+		sessionConfig.XAuthLocation = value
+		return nil
+	},
+	"setenv": func(sessionConfig *SessionConfig, value string) error {
+		name, envValue, ok := strings.Cut(value, "=")
+		if !ok || name == "" {
+			return fmt.Errorf("invalid variable %s, expected NAME=VALUE", value)
+		}
+		sessionConfig.SetEnv = append(sessionConfig.SetEnv, [2]string{name, envValue})
+		return nil
+	},
+}
+
+// parseOption splits option in either "Key=Value" or "Key Value" format, key is returned in lower case
+func parseOption(option string) (key string, value string, err error) {
+	option = strings.TrimSpace(option)
+
+	keyEnd := strings.IndexAny(option, "= \t")
+	if keyEnd <= 0 {
+		return "", "", fmt.Errorf("malformed option %q", option)
+	}
+	key, value = option[:keyEnd], strings.TrimSpace(option[keyEnd:])
+
+	// At most one equal sign between key and value
+	value = strings.TrimSpace(strings.TrimPrefix(value, "="))
+	if value == "" {
+		return "", "", fmt.Errorf("missing value for option %s", key)
+	}
+
+	return strings.ToLower(key), value, nil
+}
+
+func parseOptionYesNo(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid value %s, expected yes or no", value)
+	}
+}
+
+func parseOptionEnum(value string, allowed []string) (string, error) {
+	mode := strings.ToLower(value)
+	if !arrayContains(allowed, mode) {
+		return "", fmt.Errorf("invalid value %s, expected one of %s", value, strings.Join(allowed, ", "))
+	}
+	return mode, nil
+}
+
+// parseOptionDuration accepts seconds as OpenSSH does, or Go duration like 1m30s
+func parseOptionDuration(value string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, fmt.Errorf("invalid duration %s", value)
+		}
+		return time.Duration(seconds) * time.Second, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("invalid duration %s", value)
+	}
+	return duration, nil
+}
+
+// parseOptionAlgorithms parses comma separated algorithms like OpenSSH: a plain list replaces defaults,
+// while "+" appends to, "-" removes from and "^" prepends to defaults. Patterns with * and ? are allowed except for plain list
+func parseOptionAlgorithms(value string, supported []string, defaults []string) ([]string, error) {
+	modifier := value[0]
+	if modifier == '+' || modifier == '-' || modifier == '^' {
+		value = value[1:]
+	} else {
+		modifier = 0
+	}
+
+	var algorithms []string
+	for _, pattern := range strings.Split(value, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			return nil, fmt.Errorf("empty algorithm in list")
+		}
+
+		if modifier == 0 {
+			// Exact names only
+			if !arrayContains(supported, pattern) {
+				return nil, fmt.Errorf("unsupported algorithm %q, expected some of %s", pattern, strings.Join(supported, ","))
+			}
+			if !arrayContains(algorithms, pattern) {
+				algorithms = append(algorithms, pattern)
+			}
+			continue
+		}
+
+		isMatched := false
+		for _, algo := range supported {
+			if isMatch, err := path.Match(pattern, algo); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			} else if isMatch {
+				isMatched = true
+				if !arrayContains(algorithms, algo) {
+					algorithms = append(algorithms, algo)
+				}
+			}
+		}
+		if !isMatched && modifier != '-' {
+			// Removing something never enabled is harmless
+			return nil, fmt.Errorf("unsupported algorithm %q, expected some of %s", pattern, strings.Join(supported, ","))
+		}
+	}
+
+	switch modifier {
+	case '+':
+		// Keep defaults first, same as OpenSSH
+		return append(append([]string{}, defaults...), filterAlgorithms(algorithms, defaults, false)...), nil
+	case '-':
+		return filterAlgorithms(defaults, algorithms, false), nil
+	case '^':
+		return append(algorithms, filterAlgorithms(defaults, algorithms, false)...), nil
+	default:
+		return algorithms, nil
+	}
+}
+
+// filterAlgorithms keeps algorithms which are (or are not) in others, order is kept
+func filterAlgorithms(algorithms []string, others []string, keepContained bool) []string {
+	var filtered []string
+	for _, algo := range algorithms {
+		if arrayContains(others, algo) == keepContained {
+			filtered = append(filtered, algo)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"golang.org/x/crypto/ssh"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_parseOption(t *testing.T) {
+	testcases := []struct {
+		name      string
+		option    string
+		wantKey   string
+		wantValue string
+		wantErr   bool
+	}{
+		{name: "equal sign", option: "Port=2233", wantKey: "port", wantValue: "2233"},
+		{name: "space", option: "Port 2233", wantKey: "port", wantValue: "2233"},
+		{name: "space around equal sign", option: "  port = 2233 ", wantKey: "port", wantValue: "2233"},
+		{name: "tab", option: "PORT\t2233", wantKey: "port", wantValue: "2233"},
+		{name: "value with equal sign", option: "SetEnv=A=B", wantKey: "setenv", wantValue: "A=B"},
+		{name: "value with spaces", option: "GlobalKnownHostsFile /etc/a /etc/b", wantKey: "globalknownhostsfile", wantValue: "/etc/a /etc/b"},
+		{name: "missing value", option: "Port=", wantErr: true},
+		{name: "missing key", option: "=2233", wantErr: true},
+		{name: "key only", option: "Port", wantErr: true},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			key, value, err := parseOption(testcase.option)
+			if (err != nil) != testcase.wantErr {
+				t.Fatalf("Unexpected error: want error %t, got %v", testcase.wantErr, err)
+			}
+
+			if key != testcase.wantKey || value != testcase.wantValue {
+				t.Errorf("Unexpected option: expected %q=%q, got %q=%q", testcase.wantKey, testcase.wantValue, key, value)
+			}
+		})
+	}
+}
+
+func Test_parseOptionAlgorithms(t *testing.T) {
+	supported := []string{"a-ctr", "b-ctr", "c-cbc", "d-cbc", "e-gcm"}
+	defaults := []string{"e-gcm", "a-ctr", "b-ctr"}
+
+	testcases := []struct {
+		name           string
+		value          string
+		wantAlgorithms []string
+		wantErr        bool
+	}{
+		{name: "replace", value: "c-cbc,a-ctr", wantAlgorithms: []string{"c-cbc", "a-ctr"}},
+		{name: "replace dedup", value: "c-cbc,c-cbc", wantAlgorithms: []string{"c-cbc"}},
+		{name: "append", value: "+c-cbc", wantAlgorithms: []string{"e-gcm", "a-ctr", "b-ctr", "c-cbc"}},
+		{name: "append existing", value: "+a-ctr,d-cbc", wantAlgorithms: []string{"e-gcm", "a-ctr", "b-ctr", "d-cbc"}},
+		{name: "append pattern", value: "+*-cbc", wantAlgorithms: []string{"e-gcm", "a-ctr", "b-ctr", "c-cbc", "d-cbc"}},
+		{name: "remove", value: "-a-ctr", wantAlgorithms: []string{"e-gcm", "b-ctr"}},
+		{name: "remove pattern", value: "-*-ctr", wantAlgorithms: []string{"e-gcm"}},
+		{name: "remove not enabled", value: "-c-cbc,x-*", wantAlgorithms: []string{"e-gcm", "a-ctr", "b-ctr"}},
+		{name: "prepend", value: "^b-ctr,c-cbc", wantAlgorithms: []string{"b-ctr", "c-cbc", "e-gcm", "a-ctr"}},
+		{name: "unsupported", value: "x-ctr", wantErr: true},
+		{name: "unsupported append", value: "+x-*", wantErr: true},
+		{name: "pattern without modifier", value: "*-ctr", wantErr: true},
+		{name: "empty entry", value: "a-ctr,", wantErr: true},
+		{name: "modifier only", value: "+", wantErr: true},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			algorithms, err := parseOptionAlgorithms(testcase.value, supported, defaults)
+			if (err != nil) != testcase.wantErr {
+				t.Fatalf("Unexpected error: want error %t, got %v", testcase.wantErr, err)
+			}
+
+			if !reflect.DeepEqual(algorithms, testcase.wantAlgorithms) {
+				t.Errorf("Unexpected algorithms: expected %v, got %v", testcase.wantAlgorithms, algorithms)
+			}
+		})
+	}
+}
+
+func Test_applyOptions(t *testing.T) {
+	testcases := []struct {
+		name                 string
+		options              []string
+		wantServer           Server
+		wantConnectionConfig ConnectionConfig
+		wantIdentityConfig   IdentityConfig
+		wantSessionConfig    SessionConfig
+		wantJumpOptions      [][2]string
+		wantErr              bool
+	}{
+		{
+			name:    "destination",
+			options: []string{"HostName=192.168.3.117", "port 2233", "User=candinya"},
+			wantServer: Server{
+				Username: p("candinya"),
+				Host:     "192.168.3.117",
+				Port:     2233,
+			},
+		},
+		{
+			name:    "connection",
+			options: []string{"ConnectTimeout=10", "ServerAliveInterval=1m", "ServerAliveCountMax=5", "Ciphers=aes256-ctr,aes128-cbc", "kexalgorithms=diffie-hellman-group1-sha1", "MACs=-hmac-sha1*,hmac-sha2-512*", "HostKeyAlgorithms=ssh-rsa,ssh-dss", "PubkeyAcceptedAlgorithms=rsa-sha2-512"},
+			wantConnectionConfig: ConnectionConfig{
+				ConnectTimeout:           10 * time.Second,
+				ServerAliveInterval:      time.Minute,
+				ServerAliveCountMax:      5,
+				Ciphers:                  []string{"aes256-ctr", "aes128-cbc"},
+				KexAlgorithms:            []string{"diffie-hellman-group1-sha1"},
+				MACs:                     []string{"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256"},
+				HostKeyAlgorithms:        []string{"ssh-rsa", "ssh-dss"},
+				PubkeyAcceptedAlgorithms: []string{"rsa-sha2-512"},
+			},
+		},
+		{
+			name:    "identity",
+			options: []string{"IdentityFile=/keys/a", "IdentityFile /keys/b", "IdentitiesOnly=Yes"},
+			wantIdentityConfig: IdentityConfig{
+				IdentityFiles:  []string{"/keys/a", "/keys/b"},
+				IdentitiesOnly: true,
+			},
+		},
+		{
+			name:    "terminal modes",
+			options: []string{"TerminalMode=ERASE=^?,VINTR=3", "terminalmode iutf8=1"},
+			wantSessionConfig: SessionConfig{
+				TerminalModes: ssh.TerminalModes{ssh.VERASE: 127, ssh.VINTR: 3, ssh.IUTF8: 1},
+			},
+		},
+		{
+			name:    "environment",
+			options: []string{"SendEnv=LANG LC_*", "sendenv EDITOR", "SetEnv=GREETING=hello world", "SetEnv=EMPTY="},
+			wantSessionConfig: SessionConfig{
+				SendEnv: []string{"LANG", "LC_*", "EDITOR"},
+				SetEnv:  [][2]string{{"GREETING", "hello world"}, {"EMPTY", ""}},
+			},
+		},
+		{
+			name:    "agent socket",
+			options: []string{"ForwardAgent=/tmp/agent.sock", "ForwardAgentConfirm=yes"},
+			wantSessionConfig: SessionConfig{
+				ForwardAgent:        true,
+				AgentSocket:         "/tmp/agent.sock",
+				ForwardAgentConfirm: true,
+			},
+		},
+		{
+			name:              "agent disabled",
+			options:           []string{"ForwardAgent=yes", "forwardagent no"},
+			wantSessionConfig: SessionConfig{ForwardAgent: false},
+		},
+		{
+			name:    "x11",
+			options: []string{"ForwardX11=yes", "ForwardX11Trusted yes", "XAuthLocation=/opt/X11/bin/xauth"},
+			wantSessionConfig: SessionConfig{
+				ForwardX11:        true,
+				ForwardX11Trusted: true,
+				XAuthLocation:     "/opt/X11/bin/xauth",
+			},
+		},
+		{
+			name:            "jump",
+			options:         []string{"JumpPort=2222", "jumpUserKnownHostsFile=/tmp/known_hosts"},
+			wantJumpOptions: [][2]string{{"port", "2222"}, {"userknownhostsfile", "/tmp/known_hosts"}},
+		},
+		{name: "unknown", options: []string{"Unknown=1"}, wantErr: true},
+		{name: "unknown jump", options: []string{"JumpUnknown=1"}, wantErr: true},
+		{name: "malformed", options: []string{"Port"}, wantErr: true},
+		{name: "invalid port", options: []string{"Port=65536"}, wantErr: true},
+		{name: "invalid timeout", options: []string{"ConnectTimeout=-1"}, wantErr: true},
+		{name: "invalid yes no", options: []string{"IdentitiesOnly=maybe"}, wantErr: true},
+		{name: "invalid mode", options: []string{"StrictHostKeyChecking=maybe"}, wantErr: true},
+		{name: "unsupported cipher", options: []string{"Ciphers=aes128-ctr,rot13"}, wantErr: true},
+		{name: "unknown terminal mode", options: []string{"TerminalMode=VFOO=1"}, wantErr: true},
+		{name: "invalid env pattern", options: []string{"SendEnv=LC_["}, wantErr: true},
+		{name: "invalid env", options: []string{"SetEnv=GREETING"}, wantErr: true},
+		{name: "invalid agent confirm", options: []string{"ForwardAgentConfirm=maybe"}, wantErr: true},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			server := &Server{
+				HostKeyConfig:    &HostKeyConfig{},
+				ConnectionConfig: &ConnectionConfig{},
+			}
+			identityConfig := &IdentityConfig{}
+			sessionConfig := &SessionConfig{TerminalModes: ssh.TerminalModes{}}
+
+			jumpOptions, err := applyOptions(testcase.options, server, identityConfig, sessionConfig)
+			if (err != nil) != testcase.wantErr {
+				t.Fatalf("Unexpected error: want error %t, got %v", testcase.wantErr, err)
+			}
+			if testcase.wantErr {
+				return
+			}
+
+			if !reflect.DeepEqual(server.Username, testcase.wantServer.Username) || server.Host != testcase.wantServer.Host || server.Port != testcase.wantServer.Port {
+				t.Errorf("Unexpected server: expected %+v, got %+v", testcase.wantServer, *server)
+			}
+
+			if !reflect.DeepEqual(*server.ConnectionConfig, testcase.wantConnectionConfig) {
+				t.Errorf("Unexpected connection config: expected %+v, got %+v", testcase.wantConnectionConfig, *server.ConnectionConfig)
+			}
+
+			if !reflect.DeepEqual(*identityConfig, testcase.wantIdentityConfig) {
+				t.Errorf("Unexpected identity config: expected %+v, got %+v", testcase.wantIdentityConfig, *identityConfig)
+			}
+
+			if testcase.wantSessionConfig.TerminalModes == nil {
+				testcase.wantSessionConfig.TerminalModes = ssh.TerminalModes{}
+			}
+			if !reflect.DeepEqual(*sessionConfig, testcase.wantSessionConfig) {
+				t.Errorf("Unexpected session config: expected %+v, got %+v", testcase.wantSessionConfig, *sessionConfig)
+			}
+
+			if !reflect.DeepEqual(jumpOptions, testcase.wantJumpOptions) {
+				t.Errorf("Unexpected jump options: expected %v, got %v", testcase.wantJumpOptions, jumpOptions)
+			}
+		})
+	}
+}
+
+func Test_applyJumpOptions(t *testing.T) {
+	targetServer := &Server{
+		HostKeyConfig: &HostKeyConfig{
+			UserKnownHostsFile:    p("/tmp/known_hosts"),
+			GlobalKnownHostsFiles: []string{"/etc/ssh/ssh_known_hosts"},
+			StrictHostKeyChecking: StrictHostKeyCheckingAsk,
+			HostKeyAlias:          p("nekops-prod"),
+		},
+		ConnectionConfig: &ConnectionConfig{
+			ConnectTimeout: 10 * time.Second,
+		},
+	}
+	jumpServer := &Server{Host: "jump.candinya.com", Port: 22}
+
+	err := applyJumpOptions([][2]string{
+		{"stricthostkeychecking", "yes"},
+		{"globalknownhostsfile", "/etc/ssh/jump_known_hosts"},
+		{"port", "2222"},
+	}, jumpServer, targetServer)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if jumpServer.Port != 2222 {
+		t.Errorf("Unexpected jump port: %d", jumpServer.Port)
+	}
+	if jumpServer.HostKeyConfig.HostKeyAlias != nil {
+		t.Errorf("Unexpected jump alias: %s", *jumpServer.HostKeyConfig.HostKeyAlias)
+	}
+	if jumpServer.HostKeyConfig.UserKnownHostsFile == nil || *jumpServer.HostKeyConfig.UserKnownHostsFile != "/tmp/known_hosts" {
+		t.Errorf("Unexpected jump known_hosts file: %v", jumpServer.HostKeyConfig.UserKnownHostsFile)
+	}
+	if !reflect.DeepEqual(jumpServer.HostKeyConfig.GlobalKnownHostsFiles, []string{"/etc/ssh/jump_known_hosts"}) {
+		t.Errorf("Unexpected jump global known_hosts files: %v", jumpServer.HostKeyConfig.GlobalKnownHostsFiles)
+	}
+	if jumpServer.HostKeyConfig.StrictHostKeyChecking != StrictHostKeyCheckingYes {
+		t.Errorf("Unexpected jump StrictHostKeyChecking: %s", jumpServer.HostKeyConfig.StrictHostKeyChecking)
+	}
+	if jumpServer.ConnectionConfig.ConnectTimeout != 10*time.Second {
+		t.Errorf("Unexpected jump ConnectTimeout: %s", jumpServer.ConnectionConfig.ConnectTimeout)
+	}
+
+	// Target should not be affected
+	if targetServer.HostKeyConfig.StrictHostKeyChecking != StrictHostKeyCheckingAsk || !reflect.DeepEqual(targetServer.HostKeyConfig.GlobalKnownHostsFiles, []string{"/etc/ssh/ssh_known_hosts"}) {
+		t.Errorf("Unexpected target host key config: %+v", *targetServer.HostKeyConfig)
+	}
+}
@@ -141,3 +141,50 @@ func inPipe(from io.Reader, to io.Writer, windowResize func(h int, w int) error)
 
 	return nil
 }
+
+// escapeCommandWriter takes commands out of data written to remote, each command must be written as a whole
+type escapeCommandWriter struct {
+	to     io.Writer
+	handle func(command string) error
+}
+
+func (w *escapeCommandWriter) Write(data []byte) (int, error) {
+	dataBuf := data
+	for {
+		commandStartIndex := bytes.Index(dataBuf, EscapeCommandPrefix)
+		if commandStartIndex == -1 {
+			break
+		}
+		commandLen := bytes.IndexByte(dataBuf[commandStartIndex+len(EscapeCommandPrefix):], EscapeCommandSuffix)
+		if commandLen == -1 {
+			// Incomplete command, just pipe normally
+			break
+		}
+		commandEndIndex := commandStartIndex + len(EscapeCommandPrefix) + commandLen
+
+		// Send bytes before command
+		if commandStartIndex > 0 {
+			if _, err := w.to.Write(dataBuf[:commandStartIndex]); err != nil {
+				return 0, err
+			}
+		}
+
+		command := string(dataBuf[commandStartIndex+len(EscapeCommandPrefix) : commandEndIndex])
+		if err := w.handle(command); err != nil {
+			// Not for us, send as is
+			LogError(fmt.Errorf("failed to handle escape command %q: %w", command, err))
+			if _, err = w.to.Write(dataBuf[commandStartIndex : commandEndIndex+1]); err != nil {
+				return 0, err
+			}
+		}
+
+		dataBuf = dataBuf[commandEndIndex+1:]
+	}
+
+	if len(dataBuf) > 0 {
+		if _, err := w.to.Write(dataBuf); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"io"
+	"strings"
 	"testing"
 )
 
@@ -331,3 +332,84 @@ func Test_inPipe(t *testing.T) {
 	}
 
 }
+
+func Test_escapeCommandWriter(t *testing.T) {
+	testcases := []struct {
+		name         string
+		writes       []string
+		failCommands bool
+		wantOut      string
+		wantCommands []string
+	}{
+		{
+			name:    "no command",
+			writes:  []string{"ls -al\n"},
+			wantOut: "ls -al\n",
+		},
+		{
+			name:         "single command",
+			writes:       []string{"\x1B]pipessh;signal;INT\a"},
+			wantCommands: []string{"signal;INT"},
+		},
+		{
+			name:         "commands among data",
+			writes:       []string{"sleep 10\n\x1B]pipessh;signal;INT\aecho\n\x1B]pipessh;break\a"},
+			wantOut:      "sleep 10\necho\n",
+			wantCommands: []string{"signal;INT", "break"},
+		},
+		{
+			name:    "incomplete command",
+			writes:  []string{"\x1B]pipessh;signal;", "INT\a"},
+			wantOut: "\x1B]pipessh;signal;INT\a",
+		},
+		{
+			name:    "other OSC sequence",
+			writes:  []string{"\x1B]0;title\a"},
+			wantOut: "\x1B]0;title\a",
+		},
+		{
+			name:         "failed command",
+			writes:       []string{"a\x1B]pipessh;unknown\ab"},
+			failCommands: true,
+			wantOut:      "a\x1B]pipessh;unknown\ab",
+			wantCommands: []string{"unknown"},
+		},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			resBuf := &bytes.Buffer{}
+			var commands []string
+			w := &escapeCommandWriter{
+				to: resBuf,
+				handle: func(command string) error {
+					commands = append(commands, command)
+					if testcase.failCommands {
+						return io.ErrUnexpectedEOF
+					}
+					return nil
+				},
+			}
+
+			for _, data := range testcase.writes {
+				n, err := w.Write([]byte(data))
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if n != len(data) {
+					t.Errorf("Unexpected written length: expected %d, got %d", len(data), n)
+				}
+			}
+
+			if resBuf.String() != testcase.wantOut {
+				t.Errorf("Unexpected output: expected %q, got %q", testcase.wantOut, resBuf.String())
+			}
+			if strings.Join(commands, "|") != strings.Join(testcase.wantCommands, "|") {
+				t.Errorf("Unexpected commands: expected %v, got %v", testcase.wantCommands, commands)
+			}
+		})
+	}
+}
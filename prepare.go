@@ -4,6 +4,7 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"golang.org/x/crypto/ssh"
 	"os"
 	"path/filepath"
 	"strings"
@@ -27,6 +28,17 @@ var (
 	flagJumpServer string
 	flagIdentity   string
 	flagOptions    FlagStringArray
+	flagVerbosity  int
+	flagLogFile    string
+	flagNoPty      bool
+	flagTerm       string
+	flagSize       string
+	flagSubsystem  string
+	flagAgent      bool
+	flagX11        bool
+	flagX11Trusted bool
+	flagRecursive  bool
+	flagPreserve   bool
 )
 
 func init() {
@@ -34,23 +46,72 @@ func init() {
 	flag.StringVar(&flagJumpServer, "J", "", "Connect through jump server")
 	flag.StringVar(&flagIdentity, "i", "", "Authenticate with specific private key")
 	flag.Var(&flagOptions, "o", "SSH Options")
+	flag.Var(FlagVerbosity{&flagVerbosity, 1}, "v", "Verbose mode, repeat for more details")
+	flag.Var(FlagVerbosity{&flagVerbosity, 2}, "vv", "Verbose mode, same as -v -v")
+	flag.Var(FlagVerbosity{&flagVerbosity, 3}, "vvv", "Verbose mode, same as -v -v -v")
+	flag.StringVar(&flagLogFile, "E", "", "Append logs to file instead of stderr")
+	flag.BoolVar(&flagNoPty, "T", false, "Disable pseudo terminal allocation")
+	flag.StringVar(&flagTerm, "term", "", "Terminal type, defaults to TERM")
+	flag.StringVar(&flagSubsystem, "s", "", "Request subsystem (e.g. sftp, netconf) instead of shell, implies -T")
+	flag.BoolVar(&flagAgent, "A", false, "Forward local agent, same as -o ForwardAgent=yes")
+	flag.BoolVar(&flagX11, "X", false, "Forward X11 as untrusted client, same as -o ForwardX11=yes")
+	flag.BoolVar(&flagX11Trusted, "Y", false, "Forward X11 as trusted client, same as -o ForwardX11=yes -o ForwardX11Trusted=yes")
+	flag.BoolVar(&flagRecursive, "r", false, "Copy directories recursively, scp only")
+	flag.BoolVar(&flagPreserve, "preserve", false, "Preserve modes and modification times, scp only")
+	flag.StringVar(&flagSize, "size", "", "Initial terminal size as ROWSxCOLS, optionally followed by pixel size ,WIDTHxHEIGHT")
 }
 
-func prepare() (targetServer *Server, jumpServer *Server, privateKeys []string, knownHostsFilePath *string, err error) {
-	// Parse command line args
-	flag.Parse()
-
-	commandArgs := flag.Args()
-	if len(commandArgs) != 1 {
-		// Invalid
-		return nil, nil, nil, nil, fmt.Errorf("too many arguments")
+// parseArgs parses flags and sets up logger, arguments after flags are returned
+func parseArgs(args []string) ([]string, error) {
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return nil, err
+	}
+	if err := setupLogger(flagVerbosity, flagLogFile); err != nil {
+		return nil, err
 	}
+	return flag.Args(), nil
+}
 
+// prepare builds configs of destination from parsed flags
+func prepare(destination string) (targetServer *Server, jumpServer *Server, sessionConfig *SessionConfig, privateKeys []string, err error) {
 	// Parse target server
-	targetServer, err = parseServer(commandArgs[0])
+	targetServer, err = parseServer(destination)
 	if err != nil {
 		return nil, nil, nil, nil, fmt.Errorf("failed to parse target server: %w", err)
 	}
+
+	// Parse options
+	targetServer.HostKeyConfig = &HostKeyConfig{
+		StrictHostKeyChecking: StrictHostKeyCheckingAsk,
+		PromptTimeout:         DefaultHostKeyReplyTimeout,
+		VerifyHostKeyDNS:      VerifyHostKeyDNSNo,
+	}
+	targetServer.ConnectionConfig = &ConnectionConfig{
+		ConnectTimeout:      DefaultTimeout,
+		HandshakeTimeout:    DefaultHandshakeTimeout,
+		AuthTimeout:         DefaultAuthTimeout,
+		ServerAliveCountMax: DefaultServerAliveCountMax,
+	}
+	identityConfig := &IdentityConfig{}
+	sessionConfig = &SessionConfig{
+		RequestPty:   !flagNoPty && flagSubsystem == "",
+		Subsystem:    flagSubsystem,
+		ForwardAgent: flagAgent,
+
+		ForwardX11:        flagX11 || flagX11Trusted,
+		ForwardX11Trusted: flagX11Trusted,
+		XAuthLocation:     DefaultXAuthLocation,
+		TerminalModes: ssh.TerminalModes{
+			ssh.ECHO:          1,
+			ssh.TTY_OP_ISPEED: 14400,
+			ssh.TTY_OP_OSPEED: 14400,
+		},
+	}
+	jumpOptions, err := applyOptions(flagOptions, targetServer, identityConfig, sessionConfig)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
 	if targetServer.Username == nil {
 		targetServer.Username = p(DefaultUser)
 	}
@@ -58,23 +119,16 @@ func prepare() (targetServer *Server, jumpServer *Server, privateKeys []string,
 		// Valid port overwrite
 		targetServer.Port = flagServerPort
 	}
+	LogDebug(LogLevelDebug1, "target server: %s@%s port %d", *targetServer.Username, targetServer.Host, targetServer.Port)
 
-	// Parse options
-	optionIdentitiesOnly := false
-	for _, option := range flagOptions {
-		optionSep := strings.SplitN(option, "=", 2)
-		if len(optionSep) < 2 {
-			// Skip invalid option
-			continue
-		}
-
-		switch optionSep[0] {
-		case "UserKnownHostsFile":
-			// Parse known_hosts file
-			knownHostsFilePath = &optionSep[1]
-		case "IdentitiesOnly":
-			// Only use specified identity
-			optionIdentitiesOnly = strings.ToLower(optionSep[1]) == "yes"
+	// Terminal type and size follow local terminal unless specified
+	sessionConfig.Term, sessionConfig.Rows, sessionConfig.Cols = localTerminal()
+	if flagTerm != "" {
+		sessionConfig.Term = flagTerm
+	}
+	if flagSize != "" {
+		if sessionConfig.Rows, sessionConfig.Cols, sessionConfig.Width, sessionConfig.Height, err = parseTerminalSize(flagSize); err != nil {
+			return nil, nil, nil, nil, err
 		}
 	}
 
@@ -84,17 +138,27 @@ func prepare() (targetServer *Server, jumpServer *Server, privateKeys []string,
 		if err != nil {
 			return nil, nil, nil, nil, fmt.Errorf("failed to parse jump server: %w", err)
 		}
+		if err = applyJumpOptions(jumpOptions, jumpServer, targetServer); err != nil {
+			return nil, nil, nil, nil, err
+		}
 		if jumpServer.Username == nil {
 			jumpServer.Username = targetServer.Username
 		}
+		LogDebug(LogLevelDebug1, "jump server: %s@%s port %d", *jumpServer.Username, jumpServer.Host, jumpServer.Port)
+
+		// Target is reached through jump server, its address is not a real peer
+		targetServer.HostKeyConfig.Tunneled = true
+	} else if len(jumpOptions) > 0 {
+		return nil, nil, nil, nil, fmt.Errorf("jump options specified without jump server")
 	}
 
 	// Parse identity
 	if flagIdentity != "" {
 		privateKeys = append(privateKeys, flagIdentity)
 	}
+	privateKeys = append(privateKeys, identityConfig.IdentityFiles...)
 	// Search for additional identity
-	if !optionIdentitiesOnly {
+	if !identityConfig.IdentitiesOnly {
 		// Find user home to get possible private keys
 		homedir, err := os.UserHomeDir()
 		if err != nil {
@@ -104,7 +168,7 @@ func prepare() (targetServer *Server, jumpServer *Server, privateKeys []string,
 		entries, err := os.ReadDir(keyDir)
 		if err != nil {
 			if errors.Is(err, os.ErrNotExist) {
-				return targetServer, jumpServer, nil, nil, nil
+				return targetServer, jumpServer, sessionConfig, privateKeys, nil
 			} else {
 				return nil, nil, nil, nil, fmt.Errorf("failed to read SSH keys: %w", err)
 			}
@@ -116,11 +180,78 @@ func prepare() (targetServer *Server, jumpServer *Server, privateKeys []string,
 					!strings.HasSuffix(entryName, ".pub") &&
 					!strings.HasSuffix(entryName, "_sk") { // currently unsupported
 					// This might be our lucky king
+					LogDebug(LogLevelDebug3, "found identity file %s", filepath.Join(keyDir, entryName))
 					privateKeys = append(privateKeys, filepath.Join(keyDir, entryName))
 				}
 			}
 		}
 	}
 
-	return targetServer, jumpServer, privateKeys, knownHostsFilePath, nil
+	return targetServer, jumpServer, sessionConfig, privateKeys, nil
+}
+
+// applyOptions applies all -o options to target server, jump server options are returned to be applied later
+func applyOptions(options []string, targetServer *Server, identityConfig *IdentityConfig, sessionConfig *SessionConfig) (jumpOptions [][2]string, err error) {
+	for _, option := range options {
+		key, value, err := parseOption(option)
+		if err != nil {
+			return nil, err
+		}
+
+		if jumpKey, isJumpOption := strings.CutPrefix(key, JumpOptionPrefix); isJumpOption {
+			if _, ok := hopOptionSetters[jumpKey]; !ok {
+				return nil, fmt.Errorf("unknown jump option %s", option)
+			}
+			// Jump server is not parsed yet
+			LogDebug(LogLevelDebug2, "option %s=%s deferred to jump server", jumpKey, value)
+			jumpOptions = append(jumpOptions, [2]string{jumpKey, value})
+			continue
+		}
+
+		if setHopOption, ok := hopOptionSetters[key]; ok {
+			if err = setHopOption(targetServer, value); err != nil {
+				return nil, fmt.Errorf("invalid option %s: %w", option, err)
+			}
+		} else if setIdentityOption, ok := identityOptionSetters[key]; ok {
+			if err = setIdentityOption(identityConfig, value); err != nil {
+				return nil, fmt.Errorf("invalid option %s: %w", option, err)
+			}
+		} else if setSessionOption, ok := sessionOptionSetters[key]; ok {
+			if err = setSessionOption(sessionConfig, value); err != nil {
+				return nil, fmt.Errorf("invalid option %s: %w", option, err)
+			}
+		} else {
+			return nil, fmt.Errorf("unknown option %s", option)
+		}
+		LogDebug(LogLevelDebug2, "option %s=%s applied", key, value)
+	}
+
+	return jumpOptions, nil
+}
+
+// applyJumpOptions makes jump server share target settings, then applies its own options
+func applyJumpOptions(jumpOptions [][2]string, jumpServer *Server, targetServer *Server) error {
+	// Alias belongs to target only
+	jumpHostKeyConfig := *targetServer.HostKeyConfig
+	jumpHostKeyConfig.HostKeyAlias = nil
+	jumpHostKeyConfig.GlobalKnownHostsFiles = append([]string{}, targetServer.HostKeyConfig.GlobalKnownHostsFiles...)
+	jumpServer.HostKeyConfig = &jumpHostKeyConfig
+
+	jumpConnectionConfig := *targetServer.ConnectionConfig
+	jumpServer.ConnectionConfig = &jumpConnectionConfig
+
+	isGlobalKnownHostsFilesSet := false
+	for _, jumpOption := range jumpOptions {
+		if jumpOption[0] == "globalknownhostsfile" && !isGlobalKnownHostsFilesSet {
+			// Replace inherited files instead of appending to them
+			jumpServer.HostKeyConfig.GlobalKnownHostsFiles = nil
+			isGlobalKnownHostsFilesSet = true
+		}
+		if err := hopOptionSetters[jumpOption[0]](jumpServer, jumpOption[1]); err != nil {
+			return fmt.Errorf("invalid jump option %s: %w", jumpOption[0], err)
+		}
+		LogDebug(LogLevelDebug2, "option %s=%s applied to jump server", jumpOption[0], jumpOption[1])
+	}
+
+	return nil
 }
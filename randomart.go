@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"strings"
+)
+
+const (
+	randomArtBase    = 8
+	randomArtWidth   = randomArtBase*2 + 1
+	randomArtHeight  = randomArtBase + 1
+	randomArtSymbols = " .o+=*BOX@%&#/^SE"
+)
+
+// randomArt draws the same visual fingerprint (SHA256 digest) as `ssh-keygen -lv` using the drunken bishop algorithm
+func randomArt(key ssh.PublicKey) string {
+	digest := sha256.Sum256(key.Marshal())
+
+	// Walk from center, each byte gives 4 moves
+	var field [randomArtWidth][randomArtHeight]int
+	maxValue := len(randomArtSymbols) - 1
+	x, y := randomArtWidth/2, randomArtHeight/2
+	for _, input := range digest {
+		for b := 0; b < 4; b++ {
+			if input&0x1 != 0 {
+				x++
+			} else {
+				x--
+			}
+			if input&0x2 != 0 {
+				y++
+			} else {
+				y--
+			}
+			x = min(max(x, 0), randomArtWidth-1)
+			y = min(max(y, 0), randomArtHeight-1)
+
+			if field[x][y] < maxValue-2 {
+				field[x][y]++
+			}
+			input >>= 2
+		}
+	}
+
+	// Mark start and end
+	field[randomArtWidth/2][randomArtHeight/2] = maxValue - 1
+	field[x][y] = maxValue
+
+	title := fmt.Sprintf("[%s %d]", keyTypeName(key), keyBits(key))
+	if len(title) > randomArtWidth {
+		title = fmt.Sprintf("[%s]", keyTypeName(key))
+	}
+
+	var art strings.Builder
+	art.WriteString(randomArtBorder(title))
+	art.WriteByte('\n')
+	for y := 0; y < randomArtHeight; y++ {
+		art.WriteByte('|')
+		for x := 0; x < randomArtWidth; x++ {
+			art.WriteByte(randomArtSymbols[min(field[x][y], maxValue)])
+		}
+		art.WriteString("|\n")
+	}
+	art.WriteString(randomArtBorder("[SHA256]"))
+
+	return art.String()
+}
+
+func randomArtBorder(label string) string {
+	padBefore := (randomArtWidth - len(label)) / 2
+	return "+" + strings.Repeat("-", padBefore) + label + strings.Repeat("-", randomArtWidth-padBefore-len(label)) + "+"
+}
+
+// keyTypeName is the short key type name used by OpenSSH, e.g. ED25519, RSA, ECDSA
+func keyTypeName(key ssh.PublicKey) string {
+	switch key.Type() {
+	case ssh.KeyAlgoRSA:
+		return "RSA"
+	case ssh.KeyAlgoDSA:
+		return "DSA"
+	case ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521:
+		return "ECDSA"
+	case ssh.KeyAlgoSKECDSA256:
+		return "ECDSA-SK"
+	case ssh.KeyAlgoED25519:
+		return "ED25519"
+	case ssh.KeyAlgoSKED25519:
+		return "ED25519-SK"
+	default:
+		return strings.ToUpper(key.Type())
+	}
+}
+
+// keyBits returns key size in bits, or 0 if unknown
+func keyBits(key ssh.PublicKey) int {
+	switch key.Type() {
+	case ssh.KeyAlgoED25519, ssh.KeyAlgoSKED25519:
+		return 256
+	case ssh.KeyAlgoSKECDSA256:
+		return 256
+	}
+
+	cryptoKey, ok := key.(ssh.CryptoPublicKey)
+	if !ok {
+		return 0
+	}
+
+	switch k := cryptoKey.CryptoPublicKey().(type) {
+	case *rsa.PublicKey:
+		return k.N.BitLen()
+	case *ecdsa.PublicKey:
+		return k.Curve.Params().BitSize
+	default:
+		return 0
+	}
+}
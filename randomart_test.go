@@ -0,0 +1,77 @@
+package main
+
+import (
+	"golang.org/x/crypto/ssh"
+	"testing"
+)
+
+func Test_randomArt(t *testing.T) {
+	testcases := []struct {
+		name    string
+		key     string
+		wantArt string
+	}{
+		{
+			name: "ED25519",
+			key:  "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIBvrj8vMjoXHHqZ041CPX6Iilsnvyx1TP86V8/gXJUlg",
+			wantArt: "+--[ED25519 256]--+\n" +
+				"|    ..           |\n" +
+				"|  E...           |\n" +
+				"| . o+            |\n" +
+				"|  +. o o .       |\n" +
+				"| .o  .* S        |\n" +
+				"| . o++ B .       |\n" +
+				"|  ..+Oo.. o.o    |\n" +
+				"|   .*+X .Bo+.    |\n" +
+				"|    +*.=+.*=     |\n" +
+				"+----[SHA256]-----+",
+		},
+		{
+			name: "RSA",
+			key:  "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABgQCRzBJcjPDv/MQa6/Rkm7zc23c8kvMdIFPVelGkW1wDJ7EvKwblTi+WRxBd94mHcVqGc2PXNqKvkdaqC2F1GAV5WLtiSg0drrw8UyjDHoXOjT7P0jGad1SPOVna8Miyaei4sqUC1m9rPLa1nWd4pb/+E1Gj5D23jZPZm9tbhse3JdVK9lkUBCsm2hbdBj+Jy+I/71v7zmLbQNfxoIfWfrn/aYwB9ytEEbGEYG0EtoDB5R2PBy3LZiJAsBMzpsyFAAt/L9IWlSMhf9Fj9Bti4ACBncbNL+NkpZ13tFp5kEddt+MNfKbWa4JotYVD12XtD46Nw8CRVmnQ1A87uwi13ldhoS8Hrvp7i+19cZ2da9rKOPNtYPWdkU/A8c8HuPj+55nyg7saiy8vX8VClADdPJo71yNf8HDLvfa+QIs+Qdk4JJmXSflutcFyqd1PfjnCuFb5BhcXf2J5rsz8xUMwYLDM1Yve6pPNqh08yQORUApL8KuyXbm5e6b1B3RoSXBxWp0=",
+			wantArt: "+---[RSA 3072]----+\n" +
+				"|         .oo. oo |\n" +
+				"|          .. o*  |\n" +
+				"|          .  = o.|\n" +
+				"|   .   . . o .=++|\n" +
+				"|  +     S + oooo+|\n" +
+				"| o...  ..B .  .o |\n" +
+				"|..E+ ...*oo     .|\n" +
+				"|...+o..o+o       |\n" +
+				"|.   +ooo..       |\n" +
+				"+----[SHA256]-----+",
+		},
+		{
+			name: "ECDSA",
+			key:  "ecdsa-sha2-nistp384 AAAAE2VjZHNhLXNoYTItbmlzdHAzODQAAAAIbmlzdHAzODQAAABhBBtLcqeqlBjlUpGClo08w2j/DzzTrnITo9kzg236wq28aIo0Q/I9o0mBiiSUuUSO4Rbm4umT+xMhaolY9FV9YFBkr8w3Hw/VBrmHxvgXoEc4neQWyLtWaxSmbppWJmwKtw==",
+			wantArt: "+---[ECDSA 384]---+\n" +
+				"|++*+             |\n" +
+				"|+o.              |\n" +
+				"| .o              |\n" +
+				"|   o o o .       |\n" +
+				"|  o + o S +   o  |\n" +
+				"| . o = . * o o . |\n" +
+				"|  . B o + = . .  |\n" +
+				"|   O.o = . *o.   |\n" +
+				"|   .*o*.  E.=+.  |\n" +
+				"+----[SHA256]-----+",
+		},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(testcase.key))
+			if err != nil {
+				t.Fatalf("failed to parse public key: %v", err)
+			}
+
+			art := randomArt(key)
+			if art != testcase.wantArt {
+				t.Errorf("Unexpected random art: expected\n%s\ngot\n%s", testcase.wantArt, art)
+			}
+		})
+	}
+}
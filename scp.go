@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const CommandSCP = "scp"
+
+// Legacy scp (rcp) protocol, remote side runs scp in sink (-t) or source (-f) mode
+const (
+	scpAckOK      = 0
+	scpAckWarning = 1 // followed by message line
+	scpAckFatal   = 2 // followed by message line
+)
+
+// SCPTransfer copies between a local path and a remote path, in one direction
+type SCPTransfer struct {
+	Upload    bool
+	Local     string
+	Remote    string
+	Recursive bool
+	Preserve  bool // modes and times
+}
+
+// parseSCPOperands finds out which operand is remote, which looks like [user@]host:path.
+// Destination for prepare is returned besides transfer, port must be specified with -p.
+func parseSCPOperands(source string, target string) (*SCPTransfer, string, error) {
+	sourceDestination, sourcePath, sourceIsRemote := splitSCPRemote(source)
+	targetDestination, targetPath, targetIsRemote := splitSCPRemote(target)
+
+	switch {
+	case sourceIsRemote && targetIsRemote:
+		return nil, "", fmt.Errorf("copying between remote hosts is not supported")
+	case sourceIsRemote:
+		return &SCPTransfer{Upload: false, Local: target, Remote: sourcePath}, sourceDestination, nil
+	case targetIsRemote:
+		return &SCPTransfer{Upload: true, Local: source, Remote: targetPath}, targetDestination, nil
+	default:
+		return nil, "", fmt.Errorf("either source or target must be remote")
+	}
+}
+
+// splitSCPRemote splits operand at the first colon out of brackets and before any slash, like scp does.
+// Remote path defaults to home directory if empty.
+func splitSCPRemote(operand string) (destination string, path string, isRemote bool) {
+	if filepath.VolumeName(operand) != "" {
+		// Windows drive like C:\
+		return "", "", false
+	}
+
+	// User info may contain colon for password
+	hostStart := 0
+	if at := strings.Index(operand, "@"); at != -1 && !strings.Contains(operand[:at], "/") {
+		hostStart = at + 1
+	}
+
+	inBrackets := false
+	for i := hostStart; i < len(operand); i++ {
+		switch operand[i] {
+		case '[':
+			inBrackets = true
+		case ']':
+			inBrackets = false
+		case '/':
+			if !inBrackets {
+				return "", "", false
+			}
+		case ':':
+			if !inBrackets {
+				if i == hostStart {
+					return "", "", false
+				}
+				path = operand[i+1:]
+				if path == "" {
+					path = "."
+				}
+				return operand[:i], path, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// shellQuote quotes s for POSIX shell which runs remote command.
+// Leading ~ or ~/ is left out of quotes for home directory, while globs are always quoted.
+func shellQuote(s string) string {
+	if s == "~" {
+		return s
+	}
+	if strings.HasPrefix(s, "~/") {
+		return "~/" + shellQuote(s[2:])
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// runSCPSession runs remote scp over an exec session, and sends or receives files with it
+func runSCPSession(client *ssh.Client, transfer *SCPTransfer) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return withHop(HopTarget, withCode(ErrorCodeSessionFailed, fmt.Errorf("failed to create session: %w", err)))
+	}
+	defer session.Close()
+
+	remoteIn, err := session.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("failed to pipe stdin: %w", err)
+	}
+	remoteOut, err := session.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to pipe stdout: %w", err)
+	}
+	session.Stderr = os.Stderr
+
+	command := "scp"
+	if transfer.Recursive {
+		command += " -r"
+	}
+	if transfer.Preserve {
+		command += " -p"
+	}
+	if transfer.Upload {
+		command += " -t"
+	} else {
+		command += " -f"
+	}
+	command += " -- " + shellQuote(transfer.Remote)
+
+	LogDebug(LogLevelDebug2, "executing %s", command)
+	if err = session.Start(command); err != nil {
+		return withHop(HopTarget, withCode(ErrorCodeShellFailed, fmt.Errorf("failed to start remote scp: %w", err)))
+	}
+
+	if err = sendEvent(EventNameSSHStart, nil); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(remoteOut)
+	if transfer.Upload {
+		err = (&scpSender{r: r, w: remoteIn, recursive: transfer.Recursive, preserve: transfer.Preserve}).send(transfer.Local)
+	} else {
+		err = (&scpReceiver{r: r, w: remoteIn, recursive: transfer.Recursive, preserve: transfer.Preserve, name: path.Base(transfer.Remote)}).receive(transfer.Local)
+	}
+	if err != nil {
+		return withHop(HopTarget, withCode(ErrorCodeTransferFailed, err))
+	}
+
+	// Remote scp exits once input ends
+	_ = remoteIn.Close()
+	err = session.Wait()
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return withHop(HopTarget, withCode(ErrorCodeTransferFailed, fmt.Errorf("remote scp exited with status %d", exitErr.ExitStatus())))
+	}
+	if err != nil {
+		return withHop(HopTarget, withCode(ErrorCodeDisconnected, fmt.Errorf("failed to wait: %w", err)))
+	}
+	return nil
+}
+
+// readSCPAck reads a response of the other side, warnings are errors as well since transfer is aborted
+func readSCPAck(r *bufio.Reader) error {
+	ack, err := r.ReadByte()
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+	switch ack {
+	case scpAckOK:
+		return nil
+	case scpAckWarning, scpAckFatal:
+		message, _ := r.ReadString('\n')
+		return fmt.Errorf("remote scp: %s", strings.TrimSuffix(message, "\n"))
+	default:
+		return fmt.Errorf("unexpected response %q", ack)
+	}
+}
+
+// scpSender is the source side, remote runs scp -t
+type scpSender struct {
+	r         *bufio.Reader
+	w         io.Writer
+	recursive bool
+	preserve  bool
+}
+
+// send sends file or directory at path
+func (s *scpSender) send(path string) error {
+	// Sink is ready
+	if err := readSCPAck(s.r); err != nil {
+		return err
+	}
+	return s.sendPath(path)
+}
+
+// command writes a protocol line and waits for its acknowledgement
+func (s *scpSender) command(format string, a ...any) error {
+	if _, err := fmt.Fprintf(s.w, format+"\n", a...); err != nil {
+		return fmt.Errorf("failed to send command: %w", err)
+	}
+	return readSCPAck(s.r)
+}
+
+func (s *scpSender) sendPath(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	if info.IsDir() && !s.recursive {
+		return fmt.Errorf("%s is a directory, use -r to copy recursively", path)
+	}
+
+	// Name of . or .. is not usable
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", path, err)
+	}
+	name := filepath.Base(absPath)
+
+	if s.preserve {
+		// Access time is not available on all platforms, modification time is used instead
+		modTime := info.ModTime().Unix()
+		if err = s.command("T%d 0 %d 0", modTime, modTime); err != nil {
+			return err
+		}
+	}
+
+	if !info.IsDir() {
+		return s.sendFile(path, name, info)
+	}
+
+	LogDebug(LogLevelDebug2, "sending directory %s", path)
+	if err = s.command("D%04o 0 %s", info.Mode().Perm(), name); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return fmt.Errorf("failed to read directory %s: %w", path, err)
+	}
+	for _, entry := range entries {
+		if err = s.sendPath(filepath.Join(path, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return s.command("E")
+}
+
+func (s *scpSender) sendFile(path string, name string, info os.FileInfo) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	LogDebug(LogLevelDebug2, "sending file %s", path)
+	if err = s.command("C%04o %d %s", info.Mode().Perm(), info.Size(), name); err != nil {
+		return err
+	}
+
+	progress := newTransferProgress(path, 0, info.Size())
+	written, err := io.Copy(s.w, &progressReader{r: io.LimitReader(file, info.Size()), progress: progress})
+	if err != nil {
+		return fmt.Errorf("failed to send %s: %w", path, err)
+	}
+	if written != info.Size() {
+		return fmt.Errorf("%s changed during transfer", path)
+	}
+	progress.update(written, true)
+
+	// Data ends with our own acknowledgement
+	if _, err = s.w.Write([]byte{scpAckOK}); err != nil {
+		return fmt.Errorf("failed to send %s: %w", path, err)
+	}
+	return readSCPAck(s.r)
+}
+
+// scpReceiver is the sink side, remote runs scp -f
+type scpReceiver struct {
+	r         *bufio.Reader
+	w         io.Writer
+	recursive bool
+	preserve  bool
+	name      string // basename of requested path, the only entry allowed at top level
+
+	// Times from the last T command, for the following file or directory
+	times *scpTimes
+}
+
+type scpTimes struct {
+	modTime time.Time
+	accTime time.Time
+}
+
+// scpDir is a directory being received, its mode and times are applied once it ends
+type scpDir struct {
+	path  string
+	mode  os.FileMode
+	times *scpTimes
+}
+
+func (s *scpReceiver) ack() error {
+	if _, err := s.w.Write([]byte{scpAckOK}); err != nil {
+		return fmt.Errorf("failed to send response: %w", err)
+	}
+	return nil
+}
+
+// receive receives into target, which is either an existing directory or the path of the received one
+func (s *scpReceiver) receive(target string) error {
+	targetIsDir := false
+	if info, err := os.Stat(target); err == nil && info.IsDir() {
+		targetIsDir = true
+	}
+
+	// Source starts once we're ready
+	if err := s.ack(); err != nil {
+		return err
+	}
+
+	// Directories entered, the last one is where entries go
+	var dirs []scpDir
+	received := false
+	for {
+		line, err := s.r.ReadString('\n')
+		if errors.Is(err, io.EOF) && line == "" {
+			if !received {
+				return fmt.Errorf("nothing received")
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read command: %w", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return fmt.Errorf("empty command")
+		}
+
+		switch line[0] {
+		case scpAckWarning, scpAckFatal:
+			return fmt.Errorf("remote scp: %s", line[1:])
+		case 'T':
+			if err = s.parseTimes(line[1:]); err != nil {
+				return err
+			}
+			if err = s.ack(); err != nil {
+				return err
+			}
+			continue
+		case 'E':
+			if len(dirs) == 0 {
+				return fmt.Errorf("unexpected end of directory")
+			}
+			dir := dirs[len(dirs)-1]
+			dirs = dirs[:len(dirs)-1]
+			if err = s.finish(dir.path, dir.mode, dir.times); err != nil {
+				return err
+			}
+			if err = s.ack(); err != nil {
+				return err
+			}
+			continue
+		case 'C', 'D':
+		default:
+			return fmt.Errorf("unknown command %q", line)
+		}
+
+		// Never trust remote to send only what we asked for
+		if line[0] == 'D' && !s.recursive {
+			return fmt.Errorf("unexpected directory without recursive")
+		}
+		mode, size, name, err := parseSCPEntry(line[1:])
+		if err != nil {
+			return err
+		}
+		if len(dirs) == 0 {
+			// Only the requested file or directory itself, entries inside a directory are checked by parseSCPEntry
+			if received {
+				return fmt.Errorf("unexpected %s after %s is received", name, s.name)
+			}
+			if name != s.name {
+				return fmt.Errorf("unexpected %s, expected %s", name, s.name)
+			}
+		}
+		var path string
+		switch {
+		case len(dirs) > 0:
+			path = filepath.Join(dirs[len(dirs)-1].path, name)
+		case targetIsDir:
+			path = filepath.Join(target, name)
+		default:
+			path = target
+		}
+		received = true
+
+		if line[0] == 'D' {
+			if err = s.receiveDir(path, mode); err != nil {
+				return err
+			}
+			dirs = append(dirs, scpDir{path: path, mode: mode, times: s.times})
+			s.times = nil
+		} else if err = s.receiveFile(path, mode, size); err != nil {
+			return err
+		}
+	}
+}
+
+// parseTimes parses "mtime 0 atime 0"
+func (s *scpReceiver) parseTimes(args string) error {
+	var modTime, modTimeUsec, accTime, accTimeUsec int64
+	if _, err := fmt.Sscanf(args, "%d %d %d %d", &modTime, &modTimeUsec, &accTime, &accTimeUsec); err != nil {
+		return fmt.Errorf("invalid times %q: %w", args, err)
+	}
+	s.times = &scpTimes{modTime: time.Unix(modTime, 0), accTime: time.Unix(accTime, 0)}
+	return nil
+}
+
+// finish applies mode and times to path when preserving
+func (s *scpReceiver) finish(path string, mode os.FileMode, times *scpTimes) error {
+	if !s.preserve {
+		return nil
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		return fmt.Errorf("failed to set mode of %s: %w", path, err)
+	}
+	if times != nil {
+		if err := os.Chtimes(path, times.accTime, times.modTime); err != nil {
+			return fmt.Errorf("failed to set times of %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// parseSCPEntry parses "mode size name" of C and D commands
+func parseSCPEntry(args string) (os.FileMode, int64, string, error) {
+	fields := strings.SplitN(args, " ", 3)
+	if len(fields) != 3 {
+		return 0, 0, "", fmt.Errorf("invalid entry %q", args)
+	}
+	mode, err := strconv.ParseUint(fields[0], 8, 32)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("invalid mode %q: %w", fields[0], err)
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, 0, "", fmt.Errorf("invalid size %q", fields[1])
+	}
+	name := fields[2]
+	// Don't let remote write out of target
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return 0, 0, "", fmt.Errorf("invalid name %q", name)
+	}
+	return os.FileMode(mode).Perm(), size, name, nil
+}
+
+func (s *scpReceiver) receiveDir(path string, mode os.FileMode) error {
+	LogDebug(LogLevelDebug2, "receiving directory %s", path)
+	// Must be writable till all entries are received
+	if err := os.Mkdir(path, mode|0700); err != nil && !errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("failed to create directory %s: %w", path, err)
+	}
+	return s.ack()
+}
+
+func (s *scpReceiver) receiveFile(path string, mode os.FileMode, size int64) error {
+	LogDebug(LogLevelDebug2, "receiving file %s", path)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	defer file.Close()
+
+	if err = s.ack(); err != nil {
+		return err
+	}
+
+	progress := newTransferProgress(path, 0, size)
+	written, err := io.Copy(file, &progressReader{r: io.LimitReader(s.r, size), progress: progress})
+	if err != nil {
+		return fmt.Errorf("failed to receive %s: %w", path, err)
+	}
+	if written != size {
+		return fmt.Errorf("failed to receive %s: connection closed", path)
+	}
+	progress.update(written, true)
+
+	// Data ends with acknowledgement of source
+	if err = readSCPAck(s.r); err != nil {
+		return err
+	}
+
+	if err = file.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", path, err)
+	}
+	times := s.times
+	s.times = nil
+	if err = s.finish(path, mode, times); err != nil {
+		return err
+	}
+	return s.ack()
+}
+
+// progressReader reports progress of everything read through it
+type progressReader struct {
+	r           io.Reader
+	progress    *transferProgress
+	transferred int64
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.transferred += int64(n)
+	p.progress.update(p.transferred, false)
+	return n, err
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_parseSCPOperands(t *testing.T) {
+	testcases := []struct {
+		name            string
+		source          string
+		target          string
+		wantErr         bool
+		wantTransfer    SCPTransfer
+		wantDestination string
+	}{
+		{
+			name:            "upload",
+			source:          "./a.txt",
+			target:          "root@candinya.com:/tmp/",
+			wantTransfer:    SCPTransfer{Upload: true, Local: "./a.txt", Remote: "/tmp/"},
+			wantDestination: "root@candinya.com",
+		},
+		{
+			name:            "download",
+			source:          "candinya.com:logs",
+			target:          "logs",
+			wantTransfer:    SCPTransfer{Upload: false, Local: "logs", Remote: "logs"},
+			wantDestination: "candinya.com",
+		},
+		{
+			name:            "home directory",
+			source:          "a.txt",
+			target:          "candinya.com:",
+			wantTransfer:    SCPTransfer{Upload: true, Local: "a.txt", Remote: "."},
+			wantDestination: "candinya.com",
+		},
+		{
+			name:            "password with colon",
+			source:          "root:pa:ss@candinya.com:/etc/hosts",
+			target:          ".",
+			wantTransfer:    SCPTransfer{Upload: false, Local: ".", Remote: "/etc/hosts"},
+			wantDestination: "root:pa:ss@candinya.com",
+		},
+		{
+			name:            "ipv6",
+			source:          "[fe80::1]:/etc/hosts",
+			target:          "hosts",
+			wantTransfer:    SCPTransfer{Upload: false, Local: "hosts", Remote: "/etc/hosts"},
+			wantDestination: "[fe80::1]",
+		},
+		{
+			name:            "colon after slash is local",
+			source:          "./a:b",
+			target:          "candinya.com:b",
+			wantTransfer:    SCPTransfer{Upload: true, Local: "./a:b", Remote: "b"},
+			wantDestination: "candinya.com",
+		},
+		{
+			name:    "both local",
+			source:  "a",
+			target:  "b",
+			wantErr: true,
+		},
+		{
+			name:    "both remote",
+			source:  "a:x",
+			target:  "b:y",
+			wantErr: true,
+		},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			transfer, destination, err := parseSCPOperands(testcase.source, testcase.target)
+			if testcase.wantErr {
+				if err == nil {
+					t.Errorf("got no error, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			if *transfer != testcase.wantTransfer {
+				t.Errorf("got transfer %+v, want %+v", *transfer, testcase.wantTransfer)
+			}
+			if destination != testcase.wantDestination {
+				t.Errorf("got destination %q, want %q", destination, testcase.wantDestination)
+			}
+		})
+	}
+}
+
+func Test_shellQuote(t *testing.T) {
+	testcases := []struct {
+		name string
+		s    string
+		want string
+	}{
+		{name: "plain", s: "/tmp/a.txt", want: `'/tmp/a.txt'`},
+		{name: "space and quote", s: "it's a.txt", want: `'it'\''s a.txt'`},
+		{name: "glob", s: "*.txt", want: `'*.txt'`},
+		{name: "home", s: "~", want: `~`},
+		{name: "under home", s: "~/my logs", want: `~/'my logs'`},
+		{name: "other user", s: "~root/a.txt", want: `'~root/a.txt'`},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := shellQuote(testcase.s); got != testcase.want {
+				t.Errorf("got %s, want %s", got, testcase.want)
+			}
+		})
+	}
+}
+
+func Test_parseSCPEntry(t *testing.T) {
+	testcases := []struct {
+		name     string
+		args     string
+		wantErr  bool
+		wantMode os.FileMode
+		wantSize int64
+		wantName string
+	}{
+		{name: "file", args: "0644 12 a b.txt", wantMode: 0644, wantSize: 12, wantName: "a b.txt"},
+		{name: "directory", args: "0755 0 dir", wantMode: 0755, wantSize: 0, wantName: "dir"},
+		{name: "parent", args: "0755 0 ..", wantErr: true},
+		{name: "slash", args: "0644 1 ../../etc/passwd", wantErr: true},
+		{name: "invalid mode", args: "rw 1 a", wantErr: true},
+		{name: "negative size", args: "0644 -1 a", wantErr: true},
+		{name: "missing name", args: "0644 1", wantErr: true},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			mode, size, name, err := parseSCPEntry(testcase.args)
+			if (err != nil) != testcase.wantErr {
+				t.Fatalf("got error %v, want error %v", err, testcase.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if mode != testcase.wantMode || size != testcase.wantSize || name != testcase.wantName {
+				t.Errorf("got %o %d %q, want %o %d %q", mode, size, name, testcase.wantMode, testcase.wantSize, testcase.wantName)
+			}
+		})
+	}
+}
+
+// Test_scp_loopback runs sender and receiver against each other, as remote scp would do
+func Test_scp_loopback(t *testing.T) {
+	testcases := []struct {
+		name         string
+		recursive    bool
+		targetExists bool // copy into existing directory
+		wantErr      bool
+	}{
+		{name: "recursive", recursive: true},
+		{name: "into directory", recursive: true, targetExists: true},
+		{name: "directory without recursive", recursive: false, wantErr: true},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			dir := t.TempDir()
+			source := filepath.Join(dir, "source")
+			modTime := time.Unix(1700000000, 0)
+			files := map[string]string{
+				"a.txt":         "hello",
+				"sub/b.txt":     "world",
+				"sub/empty.txt": "",
+			}
+			for name, content := range files {
+				path := filepath.Join(source, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatalf("failed to create directory: %v", err)
+				}
+				if err := os.WriteFile(path, []byte(content), 0640); err != nil {
+					t.Fatalf("failed to write file: %v", err)
+				}
+				if err := os.Chtimes(path, modTime, modTime); err != nil {
+					t.Fatalf("failed to set times: %v", err)
+				}
+			}
+
+			target := filepath.Join(dir, "target")
+			received := target
+			if testcase.targetExists {
+				if err := os.Mkdir(target, 0755); err != nil {
+					t.Fatalf("failed to create target: %v", err)
+				}
+				received = filepath.Join(target, "source")
+			}
+
+			senderR, receiverW := io.Pipe()
+			receiverR, senderW := io.Pipe()
+			receiveDone := make(chan error, 1)
+			go func() {
+				receiver := &scpReceiver{r: bufio.NewReader(receiverR), w: receiverW, recursive: testcase.recursive, preserve: true, name: "source"}
+				err := receiver.receive(target)
+				_ = receiverW.Close()
+				receiveDone <- err
+			}()
+
+			sender := &scpSender{r: bufio.NewReader(senderR), w: senderW, recursive: testcase.recursive, preserve: true}
+			sendErr := sender.send(source)
+			_ = senderW.Close()
+			receiveErr := <-receiveDone
+
+			if testcase.wantErr {
+				if sendErr == nil {
+					t.Errorf("got no error, want error")
+				}
+				return
+			}
+			if sendErr != nil || receiveErr != nil {
+				t.Fatalf("got errors %v, %v", sendErr, receiveErr)
+			}
+
+			for name, content := range files {
+				path := filepath.Join(received, name)
+				got, err := os.ReadFile(path)
+				if err != nil {
+					t.Errorf("failed to read %s: %v", name, err)
+					continue
+				}
+				if string(got) != content {
+					t.Errorf("got %q for %s, want %q", got, name, content)
+				}
+				info, _ := os.Stat(path)
+				if !info.ModTime().Equal(modTime) {
+					t.Errorf("got mod time %v for %s, want %v", info.ModTime(), name, modTime)
+				}
+			}
+		})
+	}
+}
+
+func Test_scpReceiver_receive(t *testing.T) {
+	testcases := []struct {
+		name      string
+		recursive bool
+		requested string // basename of remote path
+		input     string // sent by remote scp -f
+		wantErr   bool
+		wantTop   []string // entries created in target on error
+		wantFiles map[string]string
+	}{
+		{
+			name:      "requested file",
+			requested: "a.txt",
+			input:     "C0644 5 a.txt\nhello\x00",
+			wantFiles: map[string]string{"a.txt": "hello"},
+		},
+		{
+			name:      "unexpected file",
+			requested: "a.txt",
+			input:     "C0644 5 .bashrc\nhello\x00",
+			wantErr:   true,
+		},
+		{
+			name:      "directory without recursive",
+			requested: "a.txt",
+			input:     "D0755 0 a.txt\nC0644 5 b.txt\nhello\x00E\n",
+			wantErr:   true,
+		},
+		{
+			name:      "end without recursive",
+			requested: "a.txt",
+			input:     "E\n",
+			wantErr:   true,
+		},
+		{
+			name:      "recursive",
+			recursive: true,
+			requested: "dir",
+			input:     "D0755 0 dir\nC0644 5 b.txt\nhello\x00E\n",
+			wantFiles: map[string]string{"dir/b.txt": "hello"},
+		},
+		{
+			name:      "recursive unexpected directory",
+			recursive: true,
+			requested: "dir",
+			input:     "D0755 0 .ssh\nC0644 5 authorized_keys\nhello\x00E\n",
+			wantErr:   true,
+		},
+		{
+			name:      "recursive unexpected file",
+			recursive: true,
+			requested: "dir",
+			input:     "C0644 5 .bashrc\nhello\x00",
+			wantErr:   true,
+		},
+		{
+			name:      "recursive second entry",
+			recursive: true,
+			requested: "dir",
+			input:     "D0755 0 dir\nE\nD0755 0 dir\nC0644 5 b.txt\nhello\x00E\n",
+			wantErr:   true,
+			wantTop:   []string{"dir"},
+		},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			target := t.TempDir()
+			receiver := &scpReceiver{
+				r:         bufio.NewReader(strings.NewReader(testcase.input)),
+				w:         io.Discard,
+				recursive: testcase.recursive,
+				name:      testcase.requested,
+			}
+			err := receiver.receive(target)
+			if (err != nil) != testcase.wantErr {
+				t.Fatalf("got error %v, want error %v", err, testcase.wantErr)
+			}
+
+			entries, err := os.ReadDir(target)
+			if err != nil {
+				t.Fatalf("failed to read target: %v", err)
+			}
+			if testcase.wantErr {
+				var top []string
+				for _, entry := range entries {
+					top = append(top, entry.Name())
+				}
+				if !reflect.DeepEqual(top, testcase.wantTop) {
+					t.Errorf("got entries %v created, want %v", top, testcase.wantTop)
+				}
+				if _, err := os.Stat(filepath.Join(target, "dir", "b.txt")); err == nil {
+					t.Errorf("got second entry received, want rejected")
+				}
+				return
+			}
+			for name, content := range testcase.wantFiles {
+				got, err := os.ReadFile(filepath.Join(target, name))
+				if err != nil {
+					t.Errorf("failed to read %s: %v", name, err)
+					continue
+				}
+				if string(got) != content {
+					t.Errorf("got %q for %s, want %q", got, name, content)
+				}
+			}
+		})
+	}
+}
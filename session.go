@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sync/errgroup"
+	"io"
+	"sync"
+)
+
+// AttachedSession connects local stdin/stdout/stderr with a remote session
+type AttachedSession struct {
+	session   *ssh.Session
+	subsystem bool // stdin is passed as is for binary protocols, and exit status is not tracked
+
+	localIn  io.Reader
+	localOut io.Writer
+	localErr io.Writer
+
+	remoteIn  io.WriteCloser
+	remoteOut io.Reader
+	remoteErr io.Reader
+}
+
+// attachSession prepares pipes of session, must be called before remote command starts.
+// Unless for subsystem, escape sequences in stdin are intercepted for window change and commands.
+func attachSession(session *ssh.Session, stdin io.Reader, stdout io.Writer, stderr io.Writer, subsystem bool) (*AttachedSession, error) {
+	remoteIn, err := session.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to pipe stdin: %w", err)
+	}
+	remoteOut, err := session.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to pipe stdout: %w", err)
+	}
+	remoteErr, err := session.StderrPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to pipe stderr: %w", err)
+	}
+
+	return &AttachedSession{
+		session:   session,
+		subsystem: subsystem,
+		localIn:   stdin,
+		localOut:  stdout,
+		localErr:  stderr,
+		remoteIn:  remoteIn,
+		remoteOut: remoteOut,
+		remoteErr: remoteErr,
+	}, nil
+}
+
+// Wait pipes data until remote exits, any pipe error or ctx being done closes the session.
+// Output is always drained before returning, exit status of remote command is returned if it exited.
+func (s *AttachedSession) Wait(ctx context.Context) (int, error) {
+	g, groupCtx := errgroup.WithContext(ctx)
+	remoteExited := make(chan struct{})
+
+	// Output ends with EOF once session is closed, by remote or by us
+	var outputDone sync.WaitGroup
+	outputDone.Add(2)
+	g.Go(func() error {
+		defer outputDone.Done()
+		if err := pipe(s.remoteOut, s.localOut); err != nil {
+			return fmt.Errorf("failed to pipe stdout: %w", err)
+		}
+		return nil
+	})
+	g.Go(func() error {
+		defer outputDone.Done()
+		if err := pipe(s.remoteErr, s.localErr); err != nil {
+			return fmt.Errorf("failed to pipe stderr: %w", err)
+		}
+		return nil
+	})
+
+	// Local stdin read can't be interrupted, so it's not waited for
+	stdinDone := make(chan error, 1)
+	go func() {
+		if s.subsystem {
+			if err := pipe(s.localIn, s.remoteIn); err != nil {
+				stdinDone <- err
+				return
+			}
+			// Let remote know input ended, so a subsystem can finish its work
+			stdinDone <- s.remoteIn.Close()
+			return
+		}
+
+		remoteIn := &escapeCommandWriter{
+			to: s.remoteIn,
+			handle: func(command string) error {
+				return handleEscapeCommand(s.session, command)
+			},
+		}
+		stdinDone <- inPipe(s.localIn, remoteIn, s.session.WindowChange)
+	}()
+	g.Go(func() error {
+		select {
+		case err := <-stdinDone:
+			if err != nil {
+				return fmt.Errorf("failed to in-pipe stdin: %w", err)
+			}
+			return nil
+		case <-remoteExited:
+			return nil
+		case <-groupCtx.Done():
+			return nil
+		}
+	})
+
+	// Tear down session when anything goes wrong
+	g.Go(func() error {
+		select {
+		case <-remoteExited:
+		case <-groupCtx.Done():
+			_ = s.session.Close()
+		}
+		return nil
+	})
+
+	var exitErr *ssh.ExitError
+	exitStatus := 0
+	g.Go(func() error {
+		defer close(remoteExited)
+
+		if s.subsystem {
+			// Library only tracks shell or command, subsystem is considered exited once its output ends
+			outputDone.Wait()
+			return nil
+		}
+
+		err := s.session.Wait()
+		if errors.As(err, &exitErr) {
+			// Remote exited by itself, that's not an error of us
+			exitStatus = exitErr.ExitStatus()
+			return nil
+		}
+		if err != nil && ctx.Err() == nil {
+			return withHop(HopTarget, withCode(ErrorCodeDisconnected, fmt.Errorf("failed to wait: %w", err)))
+		}
+		return nil
+	})
+
+	if err := g.Wait(); err != nil {
+		return 0, err
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return exitStatus, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_AttachedSession_Wait(t *testing.T) {
+	testcases := []struct {
+		name           string
+		exitStatus     int  // sent by server
+		noExitStatus   bool // server drops channel without exit status
+		hang           bool // server never exits, cancelled by ctx
+		wantExitStatus int
+		wantErrCode    string
+		wantCancelled  bool
+	}{
+		{name: "success", exitStatus: 0, wantExitStatus: 0},
+		{name: "remote failure", exitStatus: 3, wantExitStatus: 3},
+		{name: "disconnected", noExitStatus: true, wantErrCode: ErrorCodeDisconnected},
+		{name: "cancelled", hang: true, wantCancelled: true},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			client := newTestConnPair(t, []ssh.Signer{newTestSigner(t)}, nil, func(_ ssh.Conn, channel ssh.Channel, reqs <-chan *ssh.Request) {
+				for req := range reqs {
+					_ = req.Reply(req.Type == "shell", nil)
+					if req.Type != "shell" {
+						continue
+					}
+
+					if testcase.hang {
+						// Wait till client closes
+						_, _ = io.Copy(io.Discard, channel)
+						return
+					}
+
+					_, _ = channel.Write([]byte("hello"))
+					_, _ = channel.Stderr().Write([]byte("oops"))
+					if !testcase.noExitStatus {
+						status := make([]byte, 4)
+						binary.BigEndian.PutUint32(status, uint32(testcase.exitStatus))
+						_, _ = channel.SendRequest("exit-status", false, status)
+					}
+					_ = channel.Close()
+					return
+				}
+			})
+
+			session, err := client.NewSession()
+			if err != nil {
+				t.Fatalf("failed to create session: %v", err)
+			}
+			defer session.Close()
+
+			stdinReader, stdinWriter := io.Pipe()
+			defer stdinWriter.Close()
+			var stdout, stderr bytes.Buffer
+			attachedSession, err := attachSession(session, stdinReader, &stdout, &stderr, false)
+			if err != nil {
+				t.Fatalf("failed to attach session: %v", err)
+			}
+			if err = session.Shell(); err != nil {
+				t.Fatalf("failed to start shell: %v", err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if testcase.hang {
+				go func() {
+					time.Sleep(100 * time.Millisecond)
+					cancel()
+				}()
+			}
+
+			exitStatus, err := attachedSession.Wait(ctx)
+
+			switch {
+			case testcase.wantCancelled:
+				if !errors.Is(err, context.Canceled) {
+					t.Errorf("Unexpected error: want cancelled, got %v", err)
+				}
+				return
+			case testcase.wantErrCode != "":
+				if code, _ := classifyError(err); code != testcase.wantErrCode {
+					t.Errorf("Unexpected error: want %s, got %v", testcase.wantErrCode, err)
+				}
+			default:
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if exitStatus != testcase.wantExitStatus {
+					t.Errorf("Unexpected exit status: expected %d, got %d", testcase.wantExitStatus, exitStatus)
+				}
+			}
+
+			// Output is drained before returning
+			if !strings.Contains(stdout.String(), "hello") {
+				t.Errorf("Unexpected stdout: %q", stdout.String())
+			}
+			if !strings.Contains(stderr.String(), "oops") {
+				t.Errorf("Unexpected stderr: %q", stderr.String())
+			}
+		})
+	}
+}
+
+func Test_AttachedSession_raw(t *testing.T) {
+	client := newTestConnPair(t, []ssh.Signer{newTestSigner(t)}, nil, func(_ ssh.Conn, channel ssh.Channel, reqs <-chan *ssh.Request) {
+		for req := range reqs {
+			// Echo subsystem, exits when input ends
+			isEcho := req.Type == "subsystem" && string(req.Payload[4:]) == "echo"
+			_ = req.Reply(isEcho, nil)
+			if !isEcho {
+				continue
+			}
+			_, _ = io.Copy(channel, channel)
+			_, _ = channel.SendRequest("exit-status", false, []byte{0, 0, 0, 0})
+			_ = channel.Close()
+			return
+		}
+	})
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("failed to create session: %v", err)
+	}
+	defer session.Close()
+
+	// Escape sequences must reach remote untouched
+	input := "\x1B[8;24;80t\x1B]pipessh;signal;INT\a\x00\xff"
+	var stdout, stderr bytes.Buffer
+	attachedSession, err := attachSession(session, strings.NewReader(input), &stdout, &stderr, true)
+	if err != nil {
+		t.Fatalf("failed to attach session: %v", err)
+	}
+	if err = session.RequestSubsystem("echo"); err != nil {
+		t.Fatalf("failed to request subsystem: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	exitStatus, err := attachedSession.Wait(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if exitStatus != 0 {
+		t.Errorf("Unexpected exit status: %d", exitStatus)
+	}
+	if stdout.String() != input {
+		t.Errorf("Unexpected stdout: expected %q, got %q", input, stdout.String())
+	}
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// SFTP version 3 (draft-ietf-secsh-filexfer-02), which is what OpenSSH speaks
+const SFTPVersion = 3
+
+const SubsystemSFTP = "sftp"
+
+// Packet types
+const (
+	sftpPacketInit    = 1
+	sftpPacketVersion = 2
+	sftpPacketOpen    = 3
+	sftpPacketClose   = 4
+	sftpPacketRead    = 5
+	sftpPacketWrite   = 6
+	sftpPacketLstat   = 7
+	sftpPacketOpenDir = 11
+	sftpPacketReadDir = 12
+	sftpPacketRemove  = 13
+	sftpPacketMkdir   = 14
+	sftpPacketRmdir   = 15
+	sftpPacketStat    = 17
+	sftpPacketRename  = 18
+	sftpPacketStatus  = 101
+	sftpPacketHandle  = 102
+	sftpPacketData    = 103
+	sftpPacketName    = 104
+	sftpPacketAttrs   = 105
+	sftpMaxPacketSize = 256 * 1024 // larger ones are considered broken
+)
+
+// Open flags
+const (
+	SFTPOpenRead   = 0x01
+	SFTPOpenWrite  = 0x02
+	SFTPOpenAppend = 0x04
+	SFTPOpenCreate = 0x08
+	SFTPOpenTrunc  = 0x10
+)
+
+// Status codes
+const (
+	SFTPStatusOK         = 0
+	SFTPStatusEOF        = 1
+	SFTPStatusNoSuchFile = 2
+)
+
+// Attribute flags
+const (
+	sftpAttrSize        = 0x00000001
+	sftpAttrUIDGID      = 0x00000002
+	sftpAttrPermissions = 0x00000004
+	sftpAttrACModTime   = 0x00000008
+	sftpAttrExtended    = 0x80000000
+)
+
+const (
+	sftpModeTypeMask = 0170000
+	sftpModeDir      = 0040000
+)
+
+type SFTPStatusError struct {
+	Code    uint32
+	Message string
+}
+
+func (e *SFTPStatusError) Error() string {
+	return fmt.Sprintf("sftp status %d: %s", e.Code, e.Message)
+}
+
+type SFTPAttrs struct {
+	Flags       uint32
+	Size        uint64
+	UID, GID    uint32
+	Permissions uint32 // including file type bits
+	ATime       uint32
+	MTime       uint32
+}
+
+func (a *SFTPAttrs) IsDir() bool {
+	return a.Flags&sftpAttrPermissions != 0 && a.Permissions&sftpModeTypeMask == sftpModeDir
+}
+
+type SFTPName struct {
+	Name  string
+	Attrs SFTPAttrs
+}
+
+// sftpBuffer reads fields one by one, the first error is kept and later reads return zero values
+type sftpBuffer struct {
+	data []byte
+	err  error
+}
+
+func (b *sftpBuffer) uint32() uint32 {
+	if b.err != nil || len(b.data) < 4 {
+		b.fail()
+		return 0
+	}
+	v := binary.BigEndian.Uint32(b.data)
+	b.data = b.data[4:]
+	return v
+}
+
+func (b *sftpBuffer) uint64() uint64 {
+	if b.err != nil || len(b.data) < 8 {
+		b.fail()
+		return 0
+	}
+	v := binary.BigEndian.Uint64(b.data)
+	b.data = b.data[8:]
+	return v
+}
+
+func (b *sftpBuffer) string() []byte {
+	length := b.uint32()
+	if b.err != nil || uint32(len(b.data)) < length {
+		b.fail()
+		return nil
+	}
+	v := b.data[:length]
+	b.data = b.data[length:]
+	return v
+}
+
+func (b *sftpBuffer) attrs() SFTPAttrs {
+	attrs := SFTPAttrs{Flags: b.uint32()}
+	if attrs.Flags&sftpAttrSize != 0 {
+		attrs.Size = b.uint64()
+	}
+	if attrs.Flags&sftpAttrUIDGID != 0 {
+		attrs.UID, attrs.GID = b.uint32(), b.uint32()
+	}
+	if attrs.Flags&sftpAttrPermissions != 0 {
+		attrs.Permissions = b.uint32()
+	}
+	if attrs.Flags&sftpAttrACModTime != 0 {
+		attrs.ATime, attrs.MTime = b.uint32(), b.uint32()
+	}
+	if attrs.Flags&sftpAttrExtended != 0 {
+		count := b.uint32()
+		for i := uint32(0); i < count && b.err == nil; i++ {
+			_, _ = b.string(), b.string() // type and data, not used
+		}
+	}
+	return attrs
+}
+
+func (b *sftpBuffer) fail() {
+	if b.err == nil {
+		b.err = fmt.Errorf("truncated packet")
+	}
+}
+
+func appendSFTPString(data []byte, s string) []byte {
+	data = binary.BigEndian.AppendUint32(data, uint32(len(s)))
+	return append(data, s...)
+}
+
+// SFTPClient is not safe for concurrent use, but several requests may be sent before their replies are received
+type SFTPClient struct {
+	r       io.Reader
+	w       io.Writer
+	nextID  uint32
+	pending map[uint32]bool          // sent but not replied, false if reply is abandoned
+	replies map[uint32]*sftpResponse // arrived before the ones received earlier, server may reply out of order
+}
+
+type sftpResponse struct {
+	packetType byte
+	buf        *sftpBuffer
+}
+
+// newSFTPClient negotiates version with server listening on the other side of r and w
+func newSFTPClient(r io.Reader, w io.Writer) (*SFTPClient, error) {
+	c := &SFTPClient{r: r, w: w, pending: map[uint32]bool{}, replies: map[uint32]*sftpResponse{}}
+
+	if err := c.writePacket(sftpPacketInit, binary.BigEndian.AppendUint32(nil, SFTPVersion)); err != nil {
+		return nil, fmt.Errorf("failed to send init: %w", err)
+	}
+	packetType, buf, err := c.readPacket()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read version: %w", err)
+	}
+	if packetType != sftpPacketVersion {
+		return nil, fmt.Errorf("unexpected packet type %d, expected version", packetType)
+	}
+	if version := buf.uint32(); buf.err != nil || version != SFTPVersion {
+		return nil, fmt.Errorf("unsupported sftp version %d", version)
+	}
+	// Extensions follow, not used
+
+	return c, nil
+}
+
+func (c *SFTPClient) writePacket(packetType byte, payload []byte) error {
+	packet := binary.BigEndian.AppendUint32(nil, uint32(1+len(payload)))
+	packet = append(packet, packetType)
+	packet = append(packet, payload...)
+	_, err := c.w.Write(packet)
+	return err
+}
+
+func (c *SFTPClient) readPacket() (byte, *sftpBuffer, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length < 1 || length > sftpMaxPacketSize {
+		return 0, nil, fmt.Errorf("invalid packet length %d", length)
+	}
+	payload := make([]byte, length-1)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[4], &sftpBuffer{data: payload}, nil
+}
+
+// request sends packet with a new id, and reads its response
+func (c *SFTPClient) request(packetType byte, payload []byte) (byte, *sftpBuffer, error) {
+	id, err := c.send(packetType, payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	return c.receive(id)
+}
+
+// send writes packet with a new id, whose response must be either received or abandoned
+func (c *SFTPClient) send(packetType byte, payload []byte) (uint32, error) {
+	id := c.nextID
+	c.nextID++
+
+	if err := c.writePacket(packetType, append(binary.BigEndian.AppendUint32(nil, id), payload...)); err != nil {
+		return 0, fmt.Errorf("failed to send request: %w", err)
+	}
+	c.pending[id] = true
+	return id, nil
+}
+
+// receive reads responses till the one of id, keeping others for later
+func (c *SFTPClient) receive(id uint32) (byte, *sftpBuffer, error) {
+	for {
+		if resp, ok := c.replies[id]; ok {
+			delete(c.replies, id)
+			return resp.packetType, resp.buf, nil
+		}
+
+		respType, buf, err := c.readPacket()
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to read response: %w", err)
+		}
+		respID := buf.uint32()
+		isWanted, ok := c.pending[respID]
+		if buf.err != nil || !ok {
+			return 0, nil, fmt.Errorf("unexpected response id %d, expected %d", respID, id)
+		}
+		delete(c.pending, respID)
+
+		if respID == id {
+			return respType, buf, nil
+		}
+		if isWanted {
+			c.replies[respID] = &sftpResponse{packetType: respType, buf: buf}
+		}
+	}
+}
+
+// Abandon drops responses of ids which are not going to be received, they are skipped when they arrive
+func (c *SFTPClient) Abandon(ids ...uint32) {
+	for _, id := range ids {
+		delete(c.replies, id)
+		if _, ok := c.pending[id]; ok {
+			c.pending[id] = false
+		}
+	}
+}
+
+// statusError turns a status response into error, nil for OK and io.EOF for EOF
+func statusError(respType byte, buf *sftpBuffer) error {
+	if respType != sftpPacketStatus {
+		return fmt.Errorf("unexpected packet type %d", respType)
+	}
+	code, message := buf.uint32(), buf.string()
+	if buf.err != nil {
+		return buf.err
+	}
+	switch code {
+	case SFTPStatusOK:
+		return nil
+	case SFTPStatusEOF:
+		return io.EOF
+	default:
+		return &SFTPStatusError{Code: code, Message: string(message)}
+	}
+}
+
+// unexpectedResponse explains a response which is not the expected type, usually a failure status
+func unexpectedResponse(respType byte, buf *sftpBuffer) error {
+	if err := statusError(respType, buf); err != nil {
+		return err
+	}
+	return fmt.Errorf("unexpected OK status")
+}
+
+func (c *SFTPClient) requestStatus(packetType byte, payload []byte) error {
+	respType, buf, err := c.request(packetType, payload)
+	if err != nil {
+		return err
+	}
+	return statusError(respType, buf)
+}
+
+func (c *SFTPClient) requestHandle(packetType byte, payload []byte) (string, error) {
+	respType, buf, err := c.request(packetType, payload)
+	if err != nil {
+		return "", err
+	}
+	if respType != sftpPacketHandle {
+		return "", unexpectedResponse(respType, buf)
+	}
+	handle := buf.string()
+	return string(handle), buf.err
+}
+
+func (c *SFTPClient) requestAttrs(packetType byte, payload []byte) (*SFTPAttrs, error) {
+	respType, buf, err := c.request(packetType, payload)
+	if err != nil {
+		return nil, err
+	}
+	if respType != sftpPacketAttrs {
+		return nil, unexpectedResponse(respType, buf)
+	}
+	attrs := buf.attrs()
+	return &attrs, buf.err
+}
+
+// Stat follows symbolic links
+func (c *SFTPClient) Stat(path string) (*SFTPAttrs, error) {
+	return c.requestAttrs(sftpPacketStat, appendSFTPString(nil, path))
+}
+
+// Lstat doesn't follow symbolic links
+func (c *SFTPClient) Lstat(path string) (*SFTPAttrs, error) {
+	return c.requestAttrs(sftpPacketLstat, appendSFTPString(nil, path))
+}
+
+// ReadDir lists all entries of directory, except . and ..
+func (c *SFTPClient) ReadDir(path string) ([]SFTPName, error) {
+	handle, err := c.requestHandle(sftpPacketOpenDir, appendSFTPString(nil, path))
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close(handle)
+
+	var names []SFTPName
+	for {
+		respType, buf, err := c.request(sftpPacketReadDir, appendSFTPString(nil, handle))
+		if err != nil {
+			return nil, err
+		}
+		if respType != sftpPacketName {
+			if err = unexpectedResponse(respType, buf); errors.Is(err, io.EOF) {
+				return names, nil
+			}
+			return nil, err
+		}
+
+		count := buf.uint32()
+		for i := uint32(0); i < count && buf.err == nil; i++ {
+			name := string(buf.string())
+			_ = buf.string() // long name like ls -l, not used
+			attrs := buf.attrs()
+			if name != "." && name != ".." {
+				names = append(names, SFTPName{Name: name, Attrs: attrs})
+			}
+		}
+		if buf.err != nil {
+			return nil, buf.err
+		}
+	}
+}
+
+func (c *SFTPClient) Mkdir(path string) error {
+	payload := appendSFTPString(nil, path)
+	payload = binary.BigEndian.AppendUint32(payload, 0) // no attributes
+	return c.requestStatus(sftpPacketMkdir, payload)
+}
+
+func (c *SFTPClient) Rename(oldPath string, newPath string) error {
+	return c.requestStatus(sftpPacketRename, appendSFTPString(appendSFTPString(nil, oldPath), newPath))
+}
+
+func (c *SFTPClient) Remove(path string) error {
+	return c.requestStatus(sftpPacketRemove, appendSFTPString(nil, path))
+}
+
+func (c *SFTPClient) Rmdir(path string) error {
+	return c.requestStatus(sftpPacketRmdir, appendSFTPString(nil, path))
+}
+
+// Open returns handle of file, which must be closed after use
+func (c *SFTPClient) Open(path string, flags uint32) (string, error) {
+	payload := appendSFTPString(nil, path)
+	payload = binary.BigEndian.AppendUint32(payload, flags)
+	payload = binary.BigEndian.AppendUint32(payload, 0) // no attributes
+	return c.requestHandle(sftpPacketOpen, payload)
+}
+
+func (c *SFTPClient) Close(handle string) error {
+	return c.requestStatus(sftpPacketClose, appendSFTPString(nil, handle))
+}
+
+// Read returns at most length bytes from offset, io.EOF is returned at end of file
+func (c *SFTPClient) Read(handle string, offset uint64, length uint32) ([]byte, error) {
+	id, err := c.SendRead(handle, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	return c.ReceiveRead(id)
+}
+
+// SendRead asks for data like Read without waiting, the reply is taken by ReceiveRead
+func (c *SFTPClient) SendRead(handle string, offset uint64, length uint32) (uint32, error) {
+	payload := appendSFTPString(nil, handle)
+	payload = binary.BigEndian.AppendUint64(payload, offset)
+	payload = binary.BigEndian.AppendUint32(payload, length)
+	return c.send(sftpPacketRead, payload)
+}
+
+func (c *SFTPClient) ReceiveRead(id uint32) ([]byte, error) {
+	respType, buf, err := c.receive(id)
+	if err != nil {
+		return nil, err
+	}
+	if respType != sftpPacketData {
+		return nil, unexpectedResponse(respType, buf)
+	}
+	data := buf.string()
+	if buf.err != nil {
+		return nil, buf.err
+	}
+	if len(data) == 0 {
+		// End of file is told by EOF status, reading again would never advance
+		return nil, fmt.Errorf("empty data without EOF status")
+	}
+	return data, nil
+}
+
+func (c *SFTPClient) Write(handle string, offset uint64, data []byte) error {
+	id, err := c.SendWrite(handle, offset, data)
+	if err != nil {
+		return err
+	}
+	return c.ReceiveWrite(id)
+}
+
+// SendWrite writes data like Write without waiting, the reply is taken by ReceiveWrite
+func (c *SFTPClient) SendWrite(handle string, offset uint64, data []byte) (uint32, error) {
+	payload := appendSFTPString(nil, handle)
+	payload = binary.BigEndian.AppendUint64(payload, offset)
+	payload = appendSFTPString(payload, string(data))
+	return c.send(sftpPacketWrite, payload)
+}
+
+func (c *SFTPClient) ReceiveWrite(id uint32) error {
+	respType, buf, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+	return statusError(respType, buf)
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// fakeSFTPServer serves files of local filesystem, enough for SFTPClient
+type fakeSFTPServer struct {
+	r         io.Reader
+	w         io.Writer
+	files     map[string]*os.File
+	dirs      map[string]bool // handles of directories already listed
+	handles   int
+	maxRead   int  // replies at most this many bytes to each read if positive
+	emptyRead bool // replies empty data to reads instead of EOF status
+}
+
+func (s *fakeSFTPServer) writePacket(packetType byte, payload []byte) {
+	packet := binary.BigEndian.AppendUint32(nil, uint32(1+len(payload)))
+	packet = append(packet, packetType)
+	_, _ = s.w.Write(append(packet, payload...))
+}
+
+func (s *fakeSFTPServer) status(id uint32, code uint32) {
+	payload := binary.BigEndian.AppendUint32(nil, id)
+	payload = binary.BigEndian.AppendUint32(payload, code)
+	payload = appendSFTPString(payload, "status "+strconv.Itoa(int(code)))
+	payload = appendSFTPString(payload, "")
+	s.writePacket(sftpPacketStatus, payload)
+}
+
+func (s *fakeSFTPServer) result(id uint32, err error) {
+	switch {
+	case err == nil:
+		s.status(id, SFTPStatusOK)
+	case errors.Is(err, fs.ErrNotExist):
+		s.status(id, SFTPStatusNoSuchFile)
+	default:
+		s.status(id, 4) // failure
+	}
+}
+
+func (s *fakeSFTPServer) handle(id uint32, handle string) {
+	s.writePacket(sftpPacketHandle, appendSFTPString(binary.BigEndian.AppendUint32(nil, id), handle))
+}
+
+func appendFakeSFTPAttrs(payload []byte, info fs.FileInfo) []byte {
+	mode := uint32(info.Mode().Perm())
+	if info.IsDir() {
+		mode |= sftpModeDir
+	} else {
+		mode |= 0100000
+	}
+	payload = binary.BigEndian.AppendUint32(payload, sftpAttrSize|sftpAttrPermissions|sftpAttrACModTime)
+	payload = binary.BigEndian.AppendUint64(payload, uint64(info.Size()))
+	payload = binary.BigEndian.AppendUint32(payload, mode)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(info.ModTime().Unix()))
+	return binary.BigEndian.AppendUint32(payload, uint32(info.ModTime().Unix()))
+}
+
+func (s *fakeSFTPServer) serve() {
+	client := &SFTPClient{r: s.r, w: s.w}
+	if _, _, err := client.readPacket(); err != nil {
+		return
+	}
+	s.writePacket(sftpPacketVersion, binary.BigEndian.AppendUint32(nil, SFTPVersion))
+
+	// Pipes have no buffer, queue requests so client can send several before reading replies
+	requests := make(chan *sftpResponse, DefaultSFTPRequests)
+	go func() {
+		defer close(requests)
+		for {
+			packetType, buf, err := client.readPacket()
+			if err != nil {
+				return
+			}
+			requests <- &sftpResponse{packetType: packetType, buf: buf}
+		}
+	}()
+
+	for request := range requests {
+		packetType, buf := request.packetType, request.buf
+		id := buf.uint32()
+
+		switch packetType {
+		case sftpPacketStat, sftpPacketLstat:
+			info, err := os.Lstat(string(buf.string()))
+			if err != nil {
+				s.result(id, err)
+				continue
+			}
+			s.writePacket(sftpPacketAttrs, appendFakeSFTPAttrs(binary.BigEndian.AppendUint32(nil, id), info))
+		case sftpPacketOpenDir:
+			path := string(buf.string())
+			if _, err := os.ReadDir(path); err != nil {
+				s.result(id, err)
+				continue
+			}
+			s.handles++
+			handle := strconv.Itoa(s.handles)
+			s.files[handle], _ = os.Open(path)
+			s.handle(id, handle)
+		case sftpPacketReadDir:
+			handle := string(buf.string())
+			if s.dirs[handle] {
+				s.status(id, SFTPStatusEOF)
+				continue
+			}
+			s.dirs[handle] = true
+			entries, _ := s.files[handle].ReadDir(-1)
+			payload := binary.BigEndian.AppendUint32(nil, id)
+			payload = binary.BigEndian.AppendUint32(payload, uint32(len(entries)+1))
+			dotInfo, _ := s.files[handle].Stat()
+			payload = appendFakeSFTPAttrs(appendSFTPString(appendSFTPString(payload, "."), "."), dotInfo)
+			for _, entry := range entries {
+				info, _ := entry.Info()
+				payload = appendFakeSFTPAttrs(appendSFTPString(appendSFTPString(payload, entry.Name()), entry.Name()), info)
+			}
+			s.writePacket(sftpPacketName, payload)
+		case sftpPacketOpen:
+			path, pflags := string(buf.string()), buf.uint32()
+			flags := os.O_RDONLY
+			if pflags&SFTPOpenWrite != 0 {
+				flags = os.O_WRONLY
+			}
+			if pflags&SFTPOpenCreate != 0 {
+				flags |= os.O_CREATE
+			}
+			if pflags&SFTPOpenTrunc != 0 {
+				flags |= os.O_TRUNC
+			}
+			file, err := os.OpenFile(path, flags, 0644)
+			if err != nil {
+				s.result(id, err)
+				continue
+			}
+			s.handles++
+			handle := strconv.Itoa(s.handles)
+			s.files[handle] = file
+			s.handle(id, handle)
+		case sftpPacketClose:
+			handle := string(buf.string())
+			s.result(id, s.files[handle].Close())
+			delete(s.files, handle)
+		case sftpPacketRead:
+			handle, offset, length := string(buf.string()), buf.uint64(), buf.uint32()
+			if s.maxRead > 0 && int(length) > s.maxRead {
+				length = uint32(s.maxRead)
+			}
+			data := make([]byte, length)
+			n, err := s.files[handle].ReadAt(data, int64(offset))
+			if s.emptyRead {
+				n = 0
+			} else if n == 0 && errors.Is(err, io.EOF) {
+				s.status(id, SFTPStatusEOF)
+				continue
+			}
+			s.writePacket(sftpPacketData, appendSFTPString(binary.BigEndian.AppendUint32(nil, id), string(data[:n])))
+		case sftpPacketWrite:
+			handle, offset, data := string(buf.string()), buf.uint64(), buf.string()
+			_, err := s.files[handle].WriteAt(data, int64(offset))
+			s.result(id, err)
+		case sftpPacketMkdir:
+			s.result(id, os.Mkdir(string(buf.string()), 0755))
+		case sftpPacketRename:
+			s.result(id, os.Rename(string(buf.string()), string(buf.string())))
+		case sftpPacketRemove:
+			s.result(id, os.Remove(string(buf.string())))
+		case sftpPacketRmdir:
+			s.result(id, os.Remove(string(buf.string())))
+		default:
+			s.status(id, 8) // unsupported
+		}
+	}
+}
+
+func newTestSFTPClient(t *testing.T) *SFTPClient {
+	return newTestSFTPClientOf(t, &fakeSFTPServer{})
+}
+
+// newTestSFTPClientOf connects to server, whose pipes and maps are filled here
+func newTestSFTPClientOf(t *testing.T, server *fakeSFTPServer) *SFTPClient {
+	clientR, serverW := io.Pipe()
+	serverR, clientW := io.Pipe()
+	t.Cleanup(func() {
+		_ = clientW.Close()
+		_ = serverW.Close()
+	})
+
+	server.r, server.w = serverR, serverW
+	server.files, server.dirs = map[string]*os.File{}, map[string]bool{}
+	go server.serve()
+
+	client, err := newSFTPClient(clientR, clientW)
+	if err != nil {
+		t.Fatalf("failed to create sftp client: %v", err)
+	}
+	return client
+}
+
+func Test_SFTPClient(t *testing.T) {
+	dir := t.TempDir()
+	client := newTestSFTPClient(t)
+
+	if err := client.Mkdir(filepath.Join(dir, "sub")); err != nil {
+		t.Fatalf("failed to mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	names, err := client.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read dir: %v", err)
+	}
+	if len(names) != 2 {
+		t.Fatalf("got %d entries, want 2", len(names))
+	}
+	for _, name := range names {
+		if isDir := name.Name == "sub"; name.Attrs.IsDir() != isDir {
+			t.Errorf("got IsDir %v for %s", name.Attrs.IsDir(), name.Name)
+		}
+	}
+
+	attrs, err := client.Stat(filepath.Join(dir, "a.txt"))
+	if err != nil {
+		t.Fatalf("failed to stat: %v", err)
+	}
+	if attrs.Size != 5 || attrs.IsDir() {
+		t.Errorf("got size %d dir %v, want 5 false", attrs.Size, attrs.IsDir())
+	}
+
+	_, err = client.Stat(filepath.Join(dir, "missing"))
+	var statusErr *SFTPStatusError
+	if !errors.As(err, &statusErr) || statusErr.Code != SFTPStatusNoSuchFile {
+		t.Errorf("got %v, want no such file", err)
+	}
+
+	handle, err := client.Open(filepath.Join(dir, "a.txt"), SFTPOpenRead)
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	data, err := client.Read(handle, 1, 100)
+	if err != nil || string(data) != "ello" {
+		t.Errorf("got %q %v, want ello", data, err)
+	}
+	if _, err = client.Read(handle, 5, 100); !errors.Is(err, io.EOF) {
+		t.Errorf("got %v, want EOF", err)
+	}
+	if err = client.Close(handle); err != nil {
+		t.Errorf("failed to close: %v", err)
+	}
+}
+
+func Test_SFTPClient_outOfOrder(t *testing.T) {
+	// Replies of 1, 2, 0, then one nobody asked for
+	var replies []byte
+	for _, id := range []uint32{1, 2, 0, 9} {
+		payload := appendSFTPString(binary.BigEndian.AppendUint32(nil, id), "data "+strconv.Itoa(int(id)))
+		replies = binary.BigEndian.AppendUint32(replies, uint32(1+len(payload)))
+		replies = append(append(replies, sftpPacketData), payload...)
+	}
+	client := &SFTPClient{r: bytes.NewReader(replies), w: io.Discard, pending: map[uint32]bool{}, replies: map[uint32]*sftpResponse{}}
+
+	for i := 0; i < 3; i++ {
+		if _, err := client.SendRead("handle", uint64(i), 100); err != nil {
+			t.Fatalf("failed to send read: %v", err)
+		}
+	}
+	client.Abandon(1)
+
+	for _, id := range []uint32{2, 0} {
+		data, err := client.ReceiveRead(id)
+		if want := "data " + strconv.Itoa(int(id)); err != nil || string(data) != want {
+			t.Errorf("got %q %v, want %q", data, err, want)
+		}
+	}
+	if len(client.pending) != 0 || len(client.replies) != 0 {
+		t.Errorf("got %d pending and %d replies left, want none", len(client.pending), len(client.replies))
+	}
+
+	if _, err := client.Read("handle", 0, 100); err == nil {
+		t.Errorf("got nil error for reply of unknown id")
+	}
+}
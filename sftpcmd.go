@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"os"
+	"time"
+)
+
+const CommandSFTP = "sftp"
+
+// SFTP operations, sent as JSON lines to stdin
+const (
+	SFTPOpList   = "list"
+	SFTPOpStat   = "stat"
+	SFTPOpGet    = "get"
+	SFTPOpPut    = "put"
+	SFTPOpMkdir  = "mkdir"
+	SFTPOpRename = "rename"
+	SFTPOpRemove = "remove"
+)
+
+type SFTPCommand struct {
+	ID     string `json:"id"` // echoed in events
+	Op     string `json:"op"`
+	Path   string `json:"p"`            // remote path
+	To     string `json:"to,omitempty"` // new remote path for rename
+	Local  string `json:"l,omitempty"`  // local path for get and put
+	Resume bool   `json:"r,omitempty"`  // continue from where destination file ends
+}
+
+// runSFTPSession starts sftp subsystem on client, then runs commands read from stdin line by line till EOF
+func runSFTPSession(client *ssh.Client, stdin io.Reader) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return withHop(HopTarget, withCode(ErrorCodeSessionFailed, fmt.Errorf("failed to create session: %w", err)))
+	}
+	defer session.Close()
+
+	remoteIn, err := session.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("failed to pipe stdin: %w", err)
+	}
+	remoteOut, err := session.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to pipe stdout: %w", err)
+	}
+	if err = session.RequestSubsystem(SubsystemSFTP); err != nil {
+		return withHop(HopTarget, withCode(ErrorCodeSubsystemFailed, fmt.Errorf("failed to request subsystem %s: %w", SubsystemSFTP, err)))
+	}
+
+	sftpClient, err := newSFTPClient(remoteOut, remoteIn)
+	if err != nil {
+		return withHop(HopTarget, withCode(ErrorCodeSubsystemFailed, fmt.Errorf("failed to start sftp: %w", err)))
+	}
+
+	// Ready for commands
+	if err = sendEvent(EventNameSSHStart, nil); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(stdin)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var command SFTPCommand
+		if err = json.Unmarshal(scanner.Bytes(), &command); err != nil {
+			LogError(fmt.Errorf("failed to parse sftp command %q: %w", scanner.Text(), err))
+			continue
+		}
+
+		LogDebug(LogLevelDebug1, "sftp %s %s", command.Op, command.Path)
+		evPayload := runSFTPCommand(sftpClient, &command)
+		if err = sendEvent(EventNameSFTPResult, evPayload); err != nil {
+			return err
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read from stdin: %w", err)
+	}
+
+	return nil
+}
+
+// runSFTPCommand never fails, errors are reported in result so following commands can still run
+func runSFTPCommand(c *SFTPClient, command *SFTPCommand) *EventPayloadSFTPResult {
+	evPayload := &EventPayloadSFTPResult{ID: command.ID}
+
+	var err error
+	switch command.Op {
+	case SFTPOpList:
+		var names []SFTPName
+		if names, err = c.ReadDir(command.Path); err == nil {
+			evPayload.Entries = []EventPayloadSFTPEntry{}
+			for _, name := range names {
+				evPayload.Entries = append(evPayload.Entries, sftpEntry(name.Name, &name.Attrs))
+			}
+		}
+	case SFTPOpStat:
+		var attrs *SFTPAttrs
+		if attrs, err = c.Stat(command.Path); err == nil {
+			entry := sftpEntry(command.Path, attrs)
+			evPayload.Stat = &entry
+		}
+	case SFTPOpGet:
+		err = sftpGet(c, command)
+	case SFTPOpPut:
+		err = sftpPut(c, command)
+	case SFTPOpMkdir:
+		err = c.Mkdir(command.Path)
+	case SFTPOpRename:
+		err = c.Rename(command.Path, command.To)
+	case SFTPOpRemove:
+		var attrs *SFTPAttrs
+		if attrs, err = c.Lstat(command.Path); err == nil {
+			if attrs.IsDir() {
+				err = c.Rmdir(command.Path)
+			} else {
+				err = c.Remove(command.Path)
+			}
+		}
+	default:
+		err = fmt.Errorf("unknown operation %s", command.Op)
+	}
+
+	if err != nil {
+		evPayload.Error = err.Error()
+	} else {
+		evPayload.OK = true
+	}
+	return evPayload
+}
+
+func sftpEntry(name string, attrs *SFTPAttrs) EventPayloadSFTPEntry {
+	return EventPayloadSFTPEntry{
+		Name:    name,
+		Size:    attrs.Size,
+		Mode:    attrs.Permissions,
+		ModTime: attrs.MTime,
+		IsDir:   attrs.IsDir(),
+	}
+}
+
+// sftpGet downloads remote file, appending to local file if resuming
+func sftpGet(c *SFTPClient, command *SFTPCommand) error {
+	attrs, err := c.Stat(command.Path)
+	if err != nil {
+		return fmt.Errorf("failed to stat remote file: %w", err)
+	}
+	total := int64(attrs.Size)
+
+	flags := os.O_WRONLY | os.O_CREATE
+	if !command.Resume {
+		flags |= os.O_TRUNC
+	}
+	localFile, err := os.OpenFile(command.Local, flags, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open local file: %w", err)
+	}
+	defer localFile.Close()
+
+	var offset int64
+	if command.Resume {
+		if offset, err = localFile.Seek(0, io.SeekEnd); err != nil {
+			return fmt.Errorf("failed to seek local file: %w", err)
+		}
+		if offset > total {
+			return fmt.Errorf("local file is larger than remote one, can't resume")
+		}
+	}
+
+	handle, err := c.Open(command.Path, SFTPOpenRead)
+	if err != nil {
+		return fmt.Errorf("failed to open remote file: %w", err)
+	}
+	defer c.Close(handle)
+
+	// Keep several requests in flight, replies are taken in order of offset
+	var ids []uint32
+	defer func() {
+		c.Abandon(ids...)
+	}()
+
+	progress := newTransferProgress(command.ID, offset, total)
+	next := offset // where the next request reads from
+	for {
+		// Stop asking at the known size, but always ask once more to see EOF, file may grow meanwhile
+		for len(ids) < DefaultSFTPRequests && (len(ids) == 0 || next < total) {
+			id, err := c.SendRead(handle, uint64(next), DefaultSFTPChunkSize)
+			if err != nil {
+				return fmt.Errorf("failed to read remote file: %w", err)
+			}
+			ids = append(ids, id)
+			next += DefaultSFTPChunkSize
+		}
+
+		data, err := c.ReceiveRead(ids[0])
+		ids = ids[1:]
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read remote file: %w", err)
+		}
+		if len(data) > DefaultSFTPChunkSize {
+			return fmt.Errorf("failed to read remote file: got %d bytes, more than requested", len(data))
+		}
+		if _, err = localFile.Write(data); err != nil {
+			return fmt.Errorf("failed to write local file: %w", err)
+		}
+		offset += int64(len(data))
+		progress.update(offset, false)
+
+		if len(data) < DefaultSFTPChunkSize {
+			// Short read, replies after it would leave a gap, ask again from where it ends
+			c.Abandon(ids...)
+			ids = nil
+			next = offset
+		}
+	}
+	progress.update(offset, true)
+
+	if err = localFile.Close(); err != nil {
+		return fmt.Errorf("failed to close local file: %w", err)
+	}
+	return nil
+}
+
+// sftpPut uploads local file, continuing after the end of remote file if resuming
+func sftpPut(c *SFTPClient, command *SFTPCommand) error {
+	localFile, err := os.Open(command.Local)
+	if err != nil {
+		return fmt.Errorf("failed to open local file: %w", err)
+	}
+	defer localFile.Close()
+
+	info, err := localFile.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat local file: %w", err)
+	}
+	total := info.Size()
+
+	var offset int64
+	flags := uint32(SFTPOpenWrite | SFTPOpenCreate)
+	if command.Resume {
+		attrs, err := c.Stat(command.Path)
+		var statusErr *SFTPStatusError
+		switch {
+		case err == nil:
+			offset = int64(attrs.Size)
+		case errors.As(err, &statusErr) && statusErr.Code == SFTPStatusNoSuchFile:
+			// Nothing to resume
+		default:
+			return fmt.Errorf("failed to stat remote file: %w", err)
+		}
+		if offset > total {
+			return fmt.Errorf("remote file is larger than local one, can't resume")
+		}
+	} else {
+		flags |= SFTPOpenTrunc
+	}
+
+	handle, err := c.Open(command.Path, flags)
+	if err != nil {
+		return fmt.Errorf("failed to open remote file: %w", err)
+	}
+	// Closed explicitly on success, handle must not be closed twice since server may reuse it
+	isClosed := false
+	defer func() {
+		if !isClosed {
+			_ = c.Close(handle)
+		}
+	}()
+
+	// Keep several requests in flight, each ends where the next begins
+	type pendingWrite struct {
+		id  uint32
+		end int64
+	}
+	var pending []pendingWrite
+	defer func() {
+		for _, write := range pending {
+			c.Abandon(write.id)
+		}
+	}()
+
+	progress := newTransferProgress(command.ID, offset, total)
+	buf := make([]byte, DefaultSFTPChunkSize)
+	next := offset // where the next request writes to
+	isEOF := false
+	for {
+		for !isEOF && len(pending) < DefaultSFTPRequests {
+			n, err := localFile.ReadAt(buf, next)
+			if n > 0 {
+				id, err := c.SendWrite(handle, uint64(next), buf[:n])
+				if err != nil {
+					return fmt.Errorf("failed to write remote file: %w", err)
+				}
+				next += int64(n)
+				pending = append(pending, pendingWrite{id: id, end: next})
+			}
+			if errors.Is(err, io.EOF) {
+				isEOF = true
+			} else if err != nil {
+				return fmt.Errorf("failed to read local file: %w", err)
+			}
+		}
+		if len(pending) == 0 {
+			break
+		}
+
+		if err := c.ReceiveWrite(pending[0].id); err != nil {
+			return fmt.Errorf("failed to write remote file: %w", err)
+		}
+		offset = pending[0].end
+		pending = pending[1:]
+		progress.update(offset, false)
+	}
+	progress.update(offset, true)
+
+	// Server may only report write errors on close
+	isClosed = true
+	if err = c.Close(handle); err != nil {
+		return fmt.Errorf("failed to close remote file: %w", err)
+	}
+	return nil
+}
+
+// transferProgress sends transferProgress events, at most once per interval
+type transferProgress struct {
+	id         string
+	total      int64
+	start      time.Time
+	startBytes int64 // resumed from, not counted in rate
+	lastReport time.Time
+}
+
+func newTransferProgress(id string, startBytes int64, total int64) *transferProgress {
+	return &transferProgress{
+		id:         id,
+		total:      total,
+		start:      time.Now(),
+		startBytes: startBytes,
+	}
+}
+
+func (p *transferProgress) update(transferred int64, isFinal bool) {
+	now := time.Now()
+	if !isFinal && now.Sub(p.lastReport) < DefaultProgressInterval {
+		return
+	}
+	p.lastReport = now
+
+	evPayload := EventPayloadTransferProgress{
+		ID:          p.id,
+		Transferred: transferred,
+		Total:       p.total,
+	}
+	if elapsed := now.Sub(p.start).Seconds(); elapsed > 0 {
+		evPayload.Rate = float64(transferred-p.startBytes) / elapsed
+	}
+	if evPayload.Rate > 0 && p.total > transferred {
+		evPayload.ETA = float64(p.total-transferred) / evPayload.Rate
+	}
+
+	if err := sendEvent(EventNameTransferProgress, evPayload); err != nil {
+		LogError(err)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_runSFTPCommand(t *testing.T) {
+	content := strings.Repeat("0123456789", 10000) // several chunks
+
+	testcases := []struct {
+		name       string
+		remote     string // existing remote file content, none if empty
+		local      string // existing local file content, none if empty
+		server     fakeSFTPServer
+		command    SFTPCommand
+		wantOK     bool
+		wantRemote string
+		wantLocal  string
+	}{
+		{
+			name:       "put",
+			local:      content,
+			command:    SFTPCommand{Op: SFTPOpPut},
+			wantOK:     true,
+			wantRemote: content,
+		},
+		{
+			name:       "put overwrite",
+			remote:     "old content which is longer",
+			local:      "new",
+			command:    SFTPCommand{Op: SFTPOpPut},
+			wantOK:     true,
+			wantRemote: "new",
+		},
+		{
+			name:       "put resume",
+			remote:     content[:12345],
+			local:      content,
+			command:    SFTPCommand{Op: SFTPOpPut, Resume: true},
+			wantOK:     true,
+			wantRemote: content,
+		},
+		{
+			name:       "put resume missing remote",
+			local:      content,
+			command:    SFTPCommand{Op: SFTPOpPut, Resume: true},
+			wantOK:     true,
+			wantRemote: content,
+		},
+		{
+			name:       "put resume larger remote",
+			remote:     content,
+			local:      content[:10],
+			command:    SFTPCommand{Op: SFTPOpPut, Resume: true},
+			wantOK:     false,
+			wantRemote: content,
+		},
+		{
+			name:       "get",
+			remote:     content,
+			command:    SFTPCommand{Op: SFTPOpGet},
+			wantOK:     true,
+			wantRemote: content,
+			wantLocal:  content,
+		},
+		{
+			name:       "get resume",
+			remote:     content,
+			local:      content[:54321],
+			command:    SFTPCommand{Op: SFTPOpGet, Resume: true},
+			wantOK:     true,
+			wantRemote: content,
+			wantLocal:  content,
+		},
+		{
+			name:       "get short reads",
+			remote:     content,
+			server:     fakeSFTPServer{maxRead: 1000},
+			command:    SFTPCommand{Op: SFTPOpGet},
+			wantOK:     true,
+			wantRemote: content,
+			wantLocal:  content,
+		},
+		{
+			name:       "get empty data",
+			remote:     content,
+			server:     fakeSFTPServer{emptyRead: true},
+			command:    SFTPCommand{Op: SFTPOpGet},
+			wantOK:     false,
+			wantRemote: content,
+		},
+		{
+			name:    "get missing",
+			command: SFTPCommand{Op: SFTPOpGet},
+			wantOK:  false,
+		},
+		{
+			name:    "remove",
+			remote:  content,
+			command: SFTPCommand{Op: SFTPOpRemove},
+			wantOK:  true,
+		},
+		{
+			name:    "unknown",
+			command: SFTPCommand{Op: "chmod"},
+			wantOK:  false,
+		},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			dir := t.TempDir()
+			remotePath := filepath.Join(dir, "remote")
+			localPath := filepath.Join(dir, "local")
+			if testcase.remote != "" {
+				if err := os.WriteFile(remotePath, []byte(testcase.remote), 0644); err != nil {
+					t.Fatalf("failed to write remote file: %v", err)
+				}
+			}
+			if testcase.local != "" {
+				if err := os.WriteFile(localPath, []byte(testcase.local), 0644); err != nil {
+					t.Fatalf("failed to write local file: %v", err)
+				}
+			}
+
+			command := testcase.command
+			command.ID = testcase.name
+			command.Path = remotePath
+			command.Local = localPath
+			server := testcase.server
+			got := runSFTPCommand(newTestSFTPClientOf(t, &server), &command)
+			if got.ID != testcase.name {
+				t.Errorf("got id %q, want %q", got.ID, testcase.name)
+			}
+			if got.OK != testcase.wantOK {
+				t.Fatalf("got ok %v (%s), want %v", got.OK, got.Error, testcase.wantOK)
+			}
+
+			remote, _ := os.ReadFile(remotePath)
+			if string(remote) != testcase.wantRemote {
+				t.Errorf("got remote file of %d bytes, want %d", len(remote), len(testcase.wantRemote))
+			}
+			if testcase.wantLocal != "" {
+				local, _ := os.ReadFile(localPath)
+				if string(local) != testcase.wantLocal {
+					t.Errorf("got local file of %d bytes, want %d", len(local), len(testcase.wantLocal))
+				}
+			}
+		})
+	}
+}
+
+func Test_runSFTPCommand_directory(t *testing.T) {
+	dir := t.TempDir()
+	client := newTestSFTPClient(t)
+
+	run := func(command SFTPCommand) *EventPayloadSFTPResult {
+		t.Helper()
+		got := runSFTPCommand(client, &command)
+		if !got.OK {
+			t.Fatalf("failed to %s: %s", command.Op, got.Error)
+		}
+		return got
+	}
+
+	run(SFTPCommand{Op: SFTPOpMkdir, Path: filepath.Join(dir, "a")})
+	run(SFTPCommand{Op: SFTPOpRename, Path: filepath.Join(dir, "a"), To: filepath.Join(dir, "b")})
+
+	got := run(SFTPCommand{Op: SFTPOpList, Path: dir})
+	if len(got.Entries) != 1 || got.Entries[0].Name != "b" || !got.Entries[0].IsDir {
+		t.Errorf("got entries %+v, want directory b", got.Entries)
+	}
+
+	got = run(SFTPCommand{Op: SFTPOpStat, Path: filepath.Join(dir, "b")})
+	if got.Stat == nil || !got.Stat.IsDir {
+		t.Errorf("got stat %+v, want directory", got.Stat)
+	}
+
+	run(SFTPCommand{Op: SFTPOpRemove, Path: filepath.Join(dir, "b")})
+	got = run(SFTPCommand{Op: SFTPOpList, Path: dir})
+	if len(got.Entries) != 0 {
+		t.Errorf("got entries %+v, want none", got.Entries)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const RequestBreak = "break" // RFC 4335, for serial consoles
+
+var (
+	// TerminationSignals close session orderly instead of killing the process
+	TerminationSignals = []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGHUP}
+
+	// ForwardedSignals are delivered to remote command when there's no pty to send control characters
+	ForwardedSignals = []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT}
+)
+
+var sshSignals = map[os.Signal]ssh.Signal{
+	os.Interrupt:    ssh.SIGINT,
+	syscall.SIGTERM: ssh.SIGTERM,
+	syscall.SIGHUP:  ssh.SIGHUP,
+	syscall.SIGQUIT: ssh.SIGQUIT,
+}
+
+// watchSignals either forwards signals to session, or cancels ctx on the first termination signal which is then sent to the returned channel
+func watchSignals(ctx context.Context, cancel context.CancelFunc, session *ssh.Session, forward bool) <-chan os.Signal {
+	caughtSignal := make(chan os.Signal, 1)
+	signals := make(chan os.Signal, 1)
+	if forward {
+		signal.Notify(signals, ForwardedSignals...)
+	} else {
+		signal.Notify(signals, TerminationSignals...)
+	}
+
+	go func() {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case sig := <-signals:
+				if !forward {
+					LogDebug(LogLevelDebug1, "received %s, closing session", sig)
+					caughtSignal <- sig
+					cancel()
+					return
+				}
+
+				LogDebug(LogLevelDebug1, "forwarding %s to remote", sig)
+				if err := session.Signal(sshSignals[sig]); err != nil {
+					LogError(fmt.Errorf("failed to forward signal %s: %w", sig, err))
+				}
+			}
+		}
+	}()
+
+	return caughtSignal
+}
+
+// signalExitCode follows shell convention, 128 plus signal number
+func signalExitCode(sig os.Signal) int {
+	if s, ok := sig.(syscall.Signal); ok {
+		return 128 + int(s)
+	}
+	return 1
+}
+
+// handleEscapeCommand runs command received from stdin, which is one of:
+//
+//	signal;NAME     send signal NAME (without SIG prefix) to remote command
+//	break[;LENGTH]  send BREAK lasting LENGTH milliseconds
+//	agent;ID;REPLY  reply allow or deny to agentConfirm event ID
+//	hostkey;REPLY   reply to hostKey event asked during session
+func handleEscapeCommand(session *ssh.Session, command string) error {
+	name, arg, _ := strings.Cut(command, ";")
+	switch name {
+	case "signal":
+		if arg == "" {
+			return fmt.Errorf("signal name is required")
+		}
+		sig := ssh.Signal(strings.TrimPrefix(strings.ToUpper(arg), "SIG"))
+		LogDebug(LogLevelDebug1, "sending signal %s to remote", sig)
+		if err := session.Signal(sig); err != nil {
+			return fmt.Errorf("failed to send signal %s: %w", sig, err)
+		}
+		return nil
+	case "break":
+		length := DefaultBreakLength
+		if arg != "" {
+			var err error
+			if length, err = strconv.Atoi(arg); err != nil || length < 0 {
+				return fmt.Errorf("invalid break length %s", arg)
+			}
+		}
+		LogDebug(LogLevelDebug1, "sending break of %d ms to remote", length)
+		ok, err := session.SendRequest(RequestBreak, true, ssh.Marshal(struct{ Length uint32 }{uint32(length)}))
+		if err != nil {
+			return fmt.Errorf("failed to send break: %w", err)
+		}
+		if !ok {
+			// Server without serial console, not worth failing
+			LogDebug(LogLevelDebug1, "break is not supported by remote")
+		}
+		return nil
+	case "agent":
+		return agentConfirmations.reply(arg)
+	case "hostkey":
+		return hostKeyReplies.reply(arg)
+	default:
+		return fmt.Errorf("unknown command %s", name)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"golang.org/x/crypto/ssh"
+	"testing"
+)
+
+func Test_handleEscapeCommand(t *testing.T) {
+	testcases := []struct {
+		name        string
+		command     string
+		wantRequest string // type and payload of channel request received by server
+		wantErr     bool
+	}{
+		{
+			name:        "signal",
+			command:     "signal;INT",
+			wantRequest: "signal " + string(ssh.Marshal(struct{ Signal string }{"INT"})),
+		},
+		{
+			name:        "signal with prefix",
+			command:     "signal;sigusr1",
+			wantRequest: "signal " + string(ssh.Marshal(struct{ Signal string }{"USR1"})),
+		},
+		{
+			name:        "break",
+			command:     "break",
+			wantRequest: "break " + string(ssh.Marshal(struct{ Length uint32 }{DefaultBreakLength})),
+		},
+		{
+			name:        "break with length",
+			command:     "break;1000",
+			wantRequest: "break " + string(ssh.Marshal(struct{ Length uint32 }{1000})),
+		},
+		{
+			name:    "invalid break length",
+			command: "break;long",
+			wantErr: true,
+		},
+		{
+			name:    "missing signal",
+			command: "signal",
+			wantErr: true,
+		},
+		{
+			name:    "unknown",
+			command: "reboot",
+			wantErr: true,
+		},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			received := make(chan string, 1)
+			client := newTestConnPair(t, []ssh.Signer{newTestSigner(t)}, nil, func(_ ssh.Conn, _ ssh.Channel, reqs <-chan *ssh.Request) {
+				for req := range reqs {
+					if req.WantReply {
+						_ = req.Reply(true, nil)
+					}
+					received <- req.Type + " " + string(req.Payload)
+				}
+			})
+
+			session, err := client.NewSession()
+			if err != nil {
+				t.Fatalf("failed to create session: %v", err)
+			}
+			defer session.Close()
+
+			err = handleEscapeCommand(session, testcase.command)
+			if (err != nil) != testcase.wantErr {
+				t.Fatalf("Unexpected error: want error %t, got %v", testcase.wantErr, err)
+			}
+			if testcase.wantErr {
+				return
+			}
+
+			if got := <-received; got != testcase.wantRequest {
+				t.Errorf("Unexpected request: expected %q, got %q", testcase.wantRequest, got)
+			}
+		})
+	}
+}
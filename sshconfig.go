@@ -1,45 +1,137 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"golang.org/x/crypto/ssh"
+	"net"
+	"strconv"
+	"strings"
 )
 
-func sshConfig(server *Server, keyAuth ssh.AuthMethod, knownHostsFilePath *string) (*ssh.ClientConfig, error) {
+func sshConfig(server *Server, signers []ssh.Signer) (*ssh.ClientConfig, error) {
+	connectionConfig := server.ConnectionConfig
+
+	// Callbacks are invoked when each method is tried, which marks its start
 	var authMethods []ssh.AuthMethod
 	if server.Password != nil {
-		authMethods = append(authMethods, ssh.Password(*server.Password))
+		authMethods = append(authMethods, ssh.PasswordCallback(func() (string, error) {
+			server.Timing.markAuthMethod("password")
+			LogDebug(LogLevelDebug1, "trying password authentication for %s@%s", *server.Username, server.Host)
+			return *server.Password, nil
+		}))
+	}
+	if connectionConfig.PubkeyAcceptedAlgorithms != nil {
+		signers = restrictSignerAlgorithms(signers, connectionConfig.PubkeyAcceptedAlgorithms)
 	}
-	if keyAuth != nil {
-		authMethods = append(authMethods, keyAuth)
+	if len(signers) > 0 {
+		authMethods = append(authMethods, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			server.Timing.markAuthMethod("publickey")
+			LogDebug(LogLevelDebug1, "trying publickey authentication for %s@%s", *server.Username, server.Host)
+			for _, signer := range signers {
+				LogDebug(LogLevelDebug2, "offering public key: %s %s", signer.PublicKey().Type(), ssh.FingerprintSHA256(signer.PublicKey()))
+			}
+			return signers, nil
+		}))
 	}
 	if len(authMethods) == 0 {
 		return nil, fmt.Errorf("no auth methods found")
 	}
+	LogDebug(LogLevelDebug2, "%s: %d auth methods, %d keys", server.Host, len(authMethods), len(signers))
 
 	cfg := ssh.ClientConfig{
-		User:    *server.Username,
-		Auth:    authMethods,
-		Timeout: DefaultTimeout,
-		HostKeyAlgorithms: []string{
-			// Most secure one
-			ssh.KeyAlgoED25519,
-
-			// Relatively secure ones
-			ssh.KeyAlgoECDSA521,
-			ssh.KeyAlgoECDSA384,
-			ssh.KeyAlgoECDSA256,
+		User:              *server.Username,
+		Auth:              authMethods,
+		Timeout:           server.ConnectionConfig.ConnectTimeout,
+		HostKeyAlgorithms: DefaultHostKeyAlgorithms,
+	}
 
-			// Keep for backward compatibility
-			ssh.KeyAlgoRSA,
-		},
+	// Algorithm preferences, library defaults are used if not set
+	cfg.Ciphers = connectionConfig.Ciphers
+	cfg.KeyExchanges = connectionConfig.KexAlgorithms
+	cfg.MACs = connectionConfig.MACs
+	isHostKeyAlgorithmsSet := connectionConfig.HostKeyAlgorithms != nil
+	if isHostKeyAlgorithmsSet {
+		cfg.HostKeyAlgorithms = connectionConfig.HostKeyAlgorithms
 	}
 
-	if knownHostsFilePath != nil {
-		cfg.HostKeyCallback = prepareHostKeyHandler(*knownHostsFilePath)
+	hostKeyConfig := server.HostKeyConfig
+	if hostKeyConfig.UserKnownHostsFile != nil || len(hostKeyConfig.GlobalKnownHostsFiles) > 0 || hostKeyConfig.StrictHostKeyChecking == StrictHostKeyCheckingYes || hostKeyConfig.VerifyHostKeyDNS != VerifyHostKeyDNSNo {
+		// Prefer host key algorithms already known for this host, so a server with multiple keys won't be treated as a new one.
+		// Explicitly configured order is kept as is, same as OpenSSH
+		if !isHostKeyAlgorithmsSet {
+			if knownKeyTypes, err := scanKnownKeyTypes(hostKeyConfig, server); err != nil {
+				LogError(fmt.Errorf("failed to scan known key types: %w", err))
+			} else {
+				cfg.HostKeyAlgorithms = orderHostKeyAlgorithms(cfg.HostKeyAlgorithms, knownKeyTypes)
+			}
+		}
+
+		cfg.HostKeyCallback = prepareHostKeyHandler(hostKeyConfig)
 	} else {
 		cfg.HostKeyCallback = ssh.InsecureIgnoreHostKey()
 	}
 
+	LogDebug(LogLevelDebug3, "%s: host key algorithms %s", server.Host, strings.Join(cfg.HostKeyAlgorithms, ","))
 	return &cfg, nil
 }
+
+func scanKnownKeyTypes(hostKeyConfig *HostKeyConfig, server *Server) ([]string, error) {
+	rawHostname, _, _, err := knownHostsNames(hostKeyConfig, net.JoinHostPort(server.Host, strconv.Itoa(server.Port)), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var knownHostsFilePaths []string
+	knownHostsFilePaths = append(knownHostsFilePaths, hostKeyConfig.GlobalKnownHostsFiles...)
+	if hostKeyConfig.UserKnownHostsFile != nil {
+		knownHostsFilePaths = append(knownHostsFilePaths, *hostKeyConfig.UserKnownHostsFile)
+	}
+
+	var knownKeyTypes []string
+	for _, knownHostsFilePath := range knownHostsFilePaths {
+		knownHostsContent, err := readKnownHosts(knownHostsFilePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read known_hosts file %s: %w", knownHostsFilePath, err)
+		}
+
+		for _, keyType := range findKnownKeyTypes(bytes.NewReader(knownHostsContent), rawHostname) {
+			if !arrayContains(knownKeyTypes, keyType) {
+				knownKeyTypes = append(knownKeyTypes, keyType)
+			}
+		}
+	}
+
+	return knownKeyTypes, nil
+}
+
+// restrictSignerAlgorithms limits signers to the accepted algorithms, signers without any accepted algorithm are dropped
+func restrictSignerAlgorithms(signers []ssh.Signer, acceptedAlgorithms []string) []ssh.Signer {
+	var restrictedSigners []ssh.Signer
+	for _, signer := range signers {
+		var algorithms []string
+		for _, algo := range acceptedAlgorithms {
+			if hostKeyAlgoKeyType(algo) == signer.PublicKey().Type() {
+				algorithms = append(algorithms, algo)
+			}
+		}
+		if len(algorithms) == 0 {
+			continue
+		}
+
+		algorithmSigner, ok := signer.(ssh.AlgorithmSigner)
+		if !ok {
+			// Only signs with its key type, which is accepted
+			restrictedSigners = append(restrictedSigners, signer)
+			continue
+		}
+		restrictedSigner, err := ssh.NewSignerWithAlgorithms(algorithmSigner, algorithms)
+		if err != nil {
+			LogError(fmt.Errorf("failed to restrict algorithms of key %s: %w", ssh.FingerprintSHA256(signer.PublicKey()), err))
+			continue
+		}
+		restrictedSigners = append(restrictedSigners, restrictedSigner)
+	}
+
+	return restrictedSigners
+}
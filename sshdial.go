@@ -1,44 +1,290 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"golang.org/x/crypto/ssh"
 	"net"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
-func sshDial(targetServer *Server, targetConfig *ssh.ClientConfig, jumpServer *Server, jumpConfig *ssh.ClientConfig) (targetClient *ssh.Client, jumpClient *ssh.Client, err error) {
+const GlobalRequestKeepAlive = "keepalive@openssh.com" // client checks whether server is still alive
+
+// RequestsFilter takes over global requests from server, only unhandled ones should be passed on to client
+type RequestsFilter func(conn ssh.Conn, reqs <-chan *ssh.Request) <-chan *ssh.Request
+
+func sshDial(targetServer *Server, targetConfig *ssh.ClientConfig, jumpServer *Server, jumpConfig *ssh.ClientConfig, targetRequestsFilter RequestsFilter) (targetClient *ssh.Client, jumpClient *ssh.Client, err error) {
 	targetAddress := net.JoinHostPort(targetServer.Host, strconv.Itoa(targetServer.Port))
 
 	if jumpServer == nil {
 		// Connect directly to target server
-		targetClient, err = ssh.Dial("tcp", targetAddress, targetConfig)
+		conn, err := dialTCP(targetAddress, targetServer.ConnectionConfig.ConnectTimeout, targetServer.Timing)
+		if err != nil {
+			return nil, nil, withHop(HopTarget, fmt.Errorf("failed to dial target server %s: %w", targetAddress, err))
+		}
+
+		targetClient, err = newClient(conn, targetAddress, targetConfig, targetRequestsFilter, HopTarget, targetServer)
 		if err != nil {
-			return nil, nil, fmt.Errorf("failed to connect to target server %s: %w", targetAddress, err)
+			return nil, nil, withHop(HopTarget, fmt.Errorf("failed to connect to target server %s: %w", targetAddress, err))
 		}
+		startKeepAlive(targetClient, targetServer.ConnectionConfig)
 
 		return targetClient, nil, nil
 	} else {
 		// Step 1: Connect to jump server
 		jumpAddress := net.JoinHostPort(jumpServer.Host, strconv.Itoa(jumpServer.Port))
-		jumpClient, err = ssh.Dial("tcp", jumpAddress, jumpConfig)
+		conn, err := dialTCP(jumpAddress, jumpServer.ConnectionConfig.ConnectTimeout, jumpServer.Timing)
 		if err != nil {
-			return nil, nil, fmt.Errorf("failed to connect to jump server %s: %w", jumpAddress, err)
+			return nil, nil, withHop(HopJump, fmt.Errorf("failed to dial jump server %s: %w", jumpAddress, err))
 		}
 
-		// Step 2: Connect to target server
-		tnc, err := jumpClient.Dial("tcp", targetAddress)
+		jumpClient, err = newClient(conn, jumpAddress, jumpConfig, nil, HopJump, jumpServer)
 		if err != nil {
-			return nil, nil, fmt.Errorf("failed to dial target server %s: %w", targetAddress, err)
+			return nil, nil, withHop(HopJump, fmt.Errorf("failed to connect to jump server %s: %w", jumpAddress, err))
 		}
+		startKeepAlive(jumpClient, jumpServer.ConnectionConfig)
 
-		ncc, chans, reqs, err := ssh.NewClientConn(tnc, targetAddress, targetConfig)
+		// Step 2: Connect to target server
+		tnc, err := dialTunnel(jumpClient, targetAddress, targetServer.ConnectionConfig.ConnectTimeout, targetServer.Timing)
 		if err != nil {
-			return nil, nil, fmt.Errorf("failed to connect to target server %s: %w", targetAddress, err)
+			_ = jumpClient.Close()
+			// Tunnel is opened by jump server
+			return nil, nil, withHop(HopJump, fmt.Errorf("failed to dial target server %s: %w", targetAddress, err))
 		}
 
-		targetClient = ssh.NewClient(ncc, chans, reqs)
+		targetClient, err = newClient(tnc, targetAddress, targetConfig, targetRequestsFilter, HopTarget, targetServer)
+		if err != nil {
+			_ = jumpClient.Close()
+			return nil, nil, withHop(HopTarget, fmt.Errorf("failed to connect to target server %s: %w", targetAddress, err))
+		}
+		startKeepAlive(targetClient, targetServer.ConnectionConfig)
 
 		return targetClient, jumpClient, nil
 	}
 }
+
+// dialTCP resolves address and connects to the first reachable IP, both within timeout
+func dialTCP(address string, timeout time.Duration, timing *HopTiming) (net.Conn, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// Step 1: Resolve
+	LogDebug(LogLevelDebug1, "resolving %s", address)
+	resolveStart := time.Now()
+	addresses, err := resolveAddress(ctx, address)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, &TimeoutError{Phase: PhaseConnect, Timeout: timeout}
+		}
+		return nil, fmt.Errorf("failed to resolve: %w", err)
+	}
+	if addresses[0] != address {
+		timing.DNS = milliseconds(time.Since(resolveStart))
+		LogDebug(LogLevelDebug2, "%s resolved to %s", address, strings.Join(addresses, ", "))
+	}
+
+	// Step 2: Connect, try one by one
+	connectStart := time.Now()
+	var dialer net.Dialer
+	for _, addr := range addresses {
+		LogDebug(LogLevelDebug1, "connecting to %s", addr)
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			timing.Connect = milliseconds(time.Since(connectStart))
+			LogDebug(LogLevelDebug1, "connection established to %s", addr)
+			return conn, nil
+		}
+		LogDebug(LogLevelDebug1, "connect to %s failed: %v", addr, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, &TimeoutError{Phase: PhaseConnect, Timeout: timeout}
+	}
+	return nil, err
+}
+
+// dialTunnel opens a direct-tcpip channel through jump server, address is resolved by jump server
+func dialTunnel(jumpClient *ssh.Client, address string, timeout time.Duration, timing *HopTiming) (net.Conn, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	LogDebug(LogLevelDebug1, "opening tunnel to %s through %s", address, jumpClient.RemoteAddr())
+	connectStart := time.Now()
+	conn, err := jumpClient.DialContext(ctx, "tcp", address)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, &TimeoutError{Phase: PhaseConnect, Timeout: timeout}
+		}
+		return nil, err
+	}
+	timing.Connect = milliseconds(time.Since(connectStart))
+
+	return conn, nil
+}
+
+func newClient(conn net.Conn, address string, config *ssh.ClientConfig, requestsFilter RequestsFilter, hop string, server *Server) (*ssh.Client, error) {
+	connectionConfig, timing := server.ConnectionConfig, server.Timing
+
+	// Limit and measure each phase, host key prompt is excluded since it has its own limit
+	var (
+		watchdog       = newPhaseWatchdog(conn)
+		handshakeStart = time.Now()
+		authStart      time.Time
+		hostKeyErr     error
+		isFirstKex     = true // callback runs again on every re-key, always in the same goroutine
+		acceptedKeys   []ssh.PublicKey
+	)
+	phaseConfig := *config
+	phaseConfig.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if !isFirstKex {
+			// Connected already, phases and timing are done. Keys accepted on this connection, even only once, are not asked again
+			if containsKey(acceptedKeys, key) {
+				return nil
+			}
+			LogDebug(LogLevelDebug1, "%s host key changed on re-key: %s %s", hop, key.Type(), ssh.FingerprintSHA256(key))
+			if err := config.HostKeyCallback(hostname, remote, key); err != nil {
+				return err
+			}
+			acceptedKeys = append(acceptedKeys, key)
+			return nil
+		}
+		isFirstKex = false
+
+		watchdog.start(PhaseHostKeyPrompt, 0)
+		hostKeyStart := time.Now()
+		timing.Handshake = milliseconds(hostKeyStart.Sub(handshakeStart))
+		LogDebug(LogLevelDebug1, "%s host key: %s %s", hop, key.Type(), ssh.FingerprintSHA256(key))
+
+		if err := config.HostKeyCallback(hostname, remote, key); err != nil {
+			hostKeyErr = err
+			return err
+		}
+
+		acceptedKeys = append(acceptedKeys, key)
+		authStart = time.Now()
+		timing.HostKey = milliseconds(authStart.Sub(hostKeyStart))
+		watchdog.start(PhaseAuth, connectionConfig.AuthTimeout)
+		return nil
+	}
+
+	LogDebug(LogLevelDebug1, "starting handshake with %s server %s", hop, address)
+	watchdog.start(PhaseHandshake, connectionConfig.HandshakeTimeout)
+	recorder := newKexInitRecorder(conn)
+	ncc, chans, reqs, err := ssh.NewClientConn(recorder, address, &phaseConfig)
+	authEnd := time.Now()
+	if timeoutErr := watchdog.stop(); timeoutErr != nil {
+		// Closed by watchdog, the original error is only about closed connection
+		if ncc != nil {
+			_ = ncc.Close()
+		}
+		return nil, timeoutErr
+	}
+	if err != nil {
+		// Library errors don't tell which phase failed, judge by how far it went
+		switch {
+		case hostKeyErr != nil:
+			var timeoutErr *TimeoutError
+			if errors.As(hostKeyErr, &timeoutErr) {
+				return nil, hostKeyErr
+			}
+			return nil, withCode(ErrorCodeHostKeyRejected, hostKeyErr)
+		case !authStart.IsZero():
+			return nil, withCode(ErrorCodeAuthFailed, err)
+		default:
+			return nil, withCode(ErrorCodeHandshakeFailed, err)
+		}
+	}
+
+	timing.Auth = milliseconds(authEnd.Sub(authStart))
+	timing.finishAuth(authEnd)
+	LogDebug(LogLevelDebug1, "authenticated to %s server %s as %s", hop, address, config.User)
+
+	// Report negotiated algorithms, only for information so never fail the connection
+	if evPayload, err := recorder.negotiated(); err != nil {
+		LogError(fmt.Errorf("failed to get negotiated algorithms: %w", err))
+	} else {
+		evPayload.Hop = hop
+		evPayload.Host = address
+		evPayload.ServerVersion = string(ncc.ServerVersion())
+		LogDebug(LogLevelDebug1, "remote software version %s", evPayload.ServerVersion)
+		LogDebug(LogLevelDebug1, "kex: algorithm %s, host key algorithm %s", evPayload.Kex, evPayload.HostKey)
+		LogDebug(LogLevelDebug1, "kex: client->server cipher %s MAC %s", evPayload.Ciphers[0], macOrImplicit(evPayload.MACs[0]))
+		LogDebug(LogLevelDebug1, "kex: server->client cipher %s MAC %s", evPayload.Ciphers[1], macOrImplicit(evPayload.MACs[1]))
+		if err = sendEvent(EventNameConnectionInfo, evPayload); err != nil {
+			LogError(err)
+		}
+	}
+
+	if requestsFilter != nil {
+		reqs = requestsFilter(ncc, reqs)
+	}
+
+	return ssh.NewClient(ncc, chans, reqs), nil
+}
+
+// startKeepAlive sends keepalive requests every ServerAliveInterval, and closes client when too many of them are not answered
+func startKeepAlive(client *ssh.Client, connectionConfig *ConnectionConfig) {
+	if connectionConfig.ServerAliveInterval <= 0 {
+		// Disabled
+		return
+	}
+
+	go func() {
+		var unanswered atomic.Int32
+
+		closed := make(chan struct{})
+		go func() {
+			_ = client.Wait()
+			close(closed)
+		}()
+
+		ticker := time.NewTicker(connectionConfig.ServerAliveInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-closed:
+				return
+			case <-ticker.C:
+			}
+
+			if int(unanswered.Add(1)) > connectionConfig.ServerAliveCountMax {
+				LogError(fmt.Errorf("server %s not responding, disconnecting", client.RemoteAddr()))
+				_ = client.Close()
+				return
+			}
+
+			LogDebug(LogLevelDebug3, "sending keepalive to %s", client.RemoteAddr())
+			// Any reply (even failure) means server is alive, wait in background so ticks are not delayed
+			go func() {
+				if _, _, err := client.SendRequest(GlobalRequestKeepAlive, true, nil); err == nil {
+					unanswered.Store(0)
+				}
+			}()
+		}
+	}()
+}
+
+// macOrImplicit names MAC of AEAD ciphers the same way as OpenSSH
+func macOrImplicit(mac string) string {
+	if mac == "" {
+		return "<implicit>"
+	}
+	return mac
+}
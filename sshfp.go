@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const dnsTypeSSHFP dnsmessage.Type = 44 // RFC 4255
+
+// SSHFP algorithm numbers, see RFC 4255, RFC 6594 and RFC 7479
+var sshfpAlgorithms = map[string]uint8{
+	ssh.KeyAlgoRSA:      1,
+	ssh.KeyAlgoDSA:      2,
+	ssh.KeyAlgoECDSA256: 3,
+	ssh.KeyAlgoECDSA384: 3,
+	ssh.KeyAlgoECDSA521: 3,
+	ssh.KeyAlgoED25519:  4,
+}
+
+// SSHFP fingerprint types
+const (
+	sshfpFingerprintSHA1   uint8 = 1
+	sshfpFingerprintSHA256 uint8 = 2
+)
+
+// verifyHostKeyDNS compares key with SSHFP records of host.
+// Match result is nil when there's no record for this key algorithm, secure reports whether the answer is validated with DNSSEC.
+func verifyHostKeyDNS(resolver string, host string, key ssh.PublicKey) (*bool, bool, error) {
+	if net.ParseIP(host) != nil {
+		// SSHFP records are only published for names
+		return nil, false, nil
+	}
+
+	if resolver == "" {
+		var err error
+		if resolver, err = defaultDNSResolver(); err != nil {
+			return nil, false, fmt.Errorf("failed to find DNS resolver: %w", err)
+		}
+	}
+
+	records, secure, err := lookupSSHFP(resolver, host, DefaultDNSTimeout)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to look up SSHFP records for %s: %w", host, err)
+	}
+
+	return matchSSHFP(records, key), secure, nil
+}
+
+func matchSSHFP(records []SSHFPRecord, key ssh.PublicKey) *bool {
+	algorithm, ok := sshfpAlgorithms[key.Type()]
+	if !ok {
+		// Unsupported key type
+		return nil
+	}
+
+	sha1Fingerprint := sha1.Sum(key.Marshal())
+	sha256Fingerprint := sha256.Sum256(key.Marshal())
+
+	var isMatch *bool = nil
+	for _, record := range records {
+		if record.Algorithm != algorithm {
+			continue
+		}
+
+		var fingerprint []byte
+		switch record.FingerprintType {
+		case sshfpFingerprintSHA1:
+			fingerprint = sha1Fingerprint[:]
+		case sshfpFingerprintSHA256:
+			fingerprint = sha256Fingerprint[:]
+		default:
+			// Unsupported fingerprint type
+			continue
+		}
+
+		if bytes.Equal(record.Fingerprint, fingerprint) {
+			return p(true)
+		}
+
+		// Records exist for this algorithm, but not this one
+		isMatch = p(false)
+	}
+
+	return isMatch
+}
+
+func lookupSSHFP(resolver string, host string, timeout time.Duration) ([]SSHFPRecord, bool, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid name: %w", err)
+	}
+
+	// Build query
+	idBytes := make([]byte, 2)
+	if _, err = rand.Read(idBytes); err != nil {
+		return nil, false, fmt.Errorf("failed to generate query id: %w", err)
+	}
+	id := binary.BigEndian.Uint16(idBytes)
+
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:               id,
+		RecursionDesired: true,
+		AuthenticData:    true, // ask resolver to tell us whether the answer is validated
+	})
+	if err = builder.StartQuestions(); err != nil {
+		return nil, false, fmt.Errorf("failed to build query: %w", err)
+	}
+	if err = builder.Question(dnsmessage.Question{Name: name, Type: dnsTypeSSHFP, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, false, fmt.Errorf("failed to build query: %w", err)
+	}
+	if err = builder.StartAdditionals(); err != nil {
+		return nil, false, fmt.Errorf("failed to build query: %w", err)
+	}
+	var optHeader dnsmessage.ResourceHeader
+	if err = optHeader.SetEDNS0(DefaultDNSPayloadSize, dnsmessage.RCodeSuccess, true); err != nil {
+		return nil, false, fmt.Errorf("failed to build query: %w", err)
+	}
+	if err = builder.OPTResource(optHeader, dnsmessage.OPTResource{}); err != nil {
+		return nil, false, fmt.Errorf("failed to build query: %w", err)
+	}
+	query, err := builder.Finish()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to build query: %w", err)
+	}
+
+	// Exchange, retry with TCP if answer doesn't fit in UDP
+	response, err := exchangeDNS("udp", resolver, query, timeout)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var parser dnsmessage.Parser
+	header, err := parser.Start(response)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to parse response: %w", err)
+	}
+	if header.Truncated {
+		if response, err = exchangeDNS("tcp", resolver, query, timeout); err != nil {
+			return nil, false, err
+		}
+		if header, err = parser.Start(response); err != nil {
+			return nil, false, fmt.Errorf("failed to parse response: %w", err)
+		}
+	}
+
+	if header.ID != id {
+		return nil, false, fmt.Errorf("response id mismatch")
+	}
+	switch header.RCode {
+	case dnsmessage.RCodeSuccess:
+		// Continue
+	case dnsmessage.RCodeNameError:
+		// No such name, so no records
+		return nil, header.AuthenticData, nil
+	default:
+		return nil, false, fmt.Errorf("resolver returned %s", header.RCode)
+	}
+
+	// Parse answers
+	if err = parser.SkipAllQuestions(); err != nil {
+		return nil, false, fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	var records []SSHFPRecord
+	for {
+		answerHeader, err := parser.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		} else if err != nil {
+			return nil, false, fmt.Errorf("failed to parse response: %w", err)
+		}
+
+		if answerHeader.Type != dnsTypeSSHFP {
+			// CNAME or something else
+			if err = parser.SkipAnswer(); err != nil {
+				return nil, false, fmt.Errorf("failed to parse response: %w", err)
+			}
+			continue
+		}
+
+		answer, err := parser.UnknownResource()
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to parse response: %w", err)
+		}
+		if len(answer.Data) < 3 {
+			// Malformed record, skip
+			continue
+		}
+
+		records = append(records, SSHFPRecord{
+			Algorithm:       answer.Data[0],
+			FingerprintType: answer.Data[1],
+			Fingerprint:     answer.Data[2:],
+		})
+	}
+
+	return records, header.AuthenticData, nil
+}
+
+func exchangeDNS(network string, resolver string, query []byte, timeout time.Duration) ([]byte, error) {
+	conn, err := net.DialTimeout(network, resolver, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to resolver %s: %w", resolver, err)
+	}
+
+	defer conn.Close()
+
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, fmt.Errorf("failed to set deadline: %w", err)
+	}
+
+	if network == "tcp" {
+		// Messages over TCP are prefixed with length
+		if _, err = conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(query)))); err != nil {
+			return nil, fmt.Errorf("failed to send query: %w", err)
+		}
+	}
+	if _, err = conn.Write(query); err != nil {
+		return nil, fmt.Errorf("failed to send query: %w", err)
+	}
+
+	if network == "tcp" {
+		lengthBytes := make([]byte, 2)
+		if _, err = io.ReadFull(conn, lengthBytes); err != nil {
+			return nil, fmt.Errorf("failed to read response: %w", err)
+		}
+		response := make([]byte, binary.BigEndian.Uint16(lengthBytes))
+		if _, err = io.ReadFull(conn, response); err != nil {
+			return nil, fmt.Errorf("failed to read response: %w", err)
+		}
+		return response, nil
+	}
+
+	response := make([]byte, DefaultDNSPayloadSize)
+	n, err := conn.Read(response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	return response[:n], nil
+}
+
+func defaultDNSResolver() (string, error) {
+	resolvConf, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "", fmt.Errorf("no system resolver found, please specify with VerifyHostKeyDNSResolver: %w", err)
+	}
+
+	defer resolvConf.Close()
+
+	resolvConfScanner := bufio.NewScanner(resolvConf)
+	for resolvConfScanner.Scan() {
+		fields := strings.Fields(resolvConfScanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53"), nil
+		}
+	}
+
+	return "", fmt.Errorf("no nameserver in /etc/resolv.conf, please specify with VerifyHostKeyDNSResolver")
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+)
+
+type stubDNSZone struct {
+	records     map[string][]SSHFPRecord // name => records, missing name means NXDOMAIN
+	secure      bool                     // set AD bit
+	truncateUDP bool                     // force client to retry with TCP
+}
+
+// startStubDNS serves zone on both UDP and TCP of the same local port
+func startStubDNS(t *testing.T, zone stubDNSZone) string {
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen udp: %v", err)
+	}
+	t.Cleanup(func() { _ = udpConn.Close() })
+
+	tcpListener, err := net.Listen("tcp", udpConn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("failed to listen tcp: %v", err)
+	}
+	t.Cleanup(func() { _ = tcpListener.Close() })
+
+	go func() {
+		buf := make([]byte, DefaultDNSPayloadSize)
+		for {
+			n, addr, err := udpConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if response := stubDNSAnswer(buf[:n], zone, zone.truncateUDP); response != nil {
+				_, _ = udpConn.WriteTo(response, addr)
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			conn, err := tcpListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				lengthBytes := make([]byte, 2)
+				if _, err := io.ReadFull(conn, lengthBytes); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(lengthBytes))
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+				if response := stubDNSAnswer(query, zone, false); response != nil {
+					_, _ = conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(response))), response...))
+				}
+			}()
+		}
+	}()
+
+	return udpConn.LocalAddr().String()
+}
+
+func stubDNSAnswer(query []byte, zone stubDNSZone, truncate bool) []byte {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil
+	}
+
+	records, ok := zone.records[question.Name.String()]
+	responseHeader := dnsmessage.Header{
+		ID:                 header.ID,
+		Response:           true,
+		RecursionAvailable: true,
+		AuthenticData:      zone.secure,
+		Truncated:          truncate,
+	}
+	if !ok {
+		responseHeader.RCode = dnsmessage.RCodeNameError
+	}
+
+	builder := dnsmessage.NewBuilder(nil, responseHeader)
+	_ = builder.StartQuestions()
+	_ = builder.Question(question)
+	_ = builder.StartAnswers()
+	if !truncate {
+		for _, record := range records {
+			_ = builder.UnknownResource(dnsmessage.ResourceHeader{
+				Name:  question.Name,
+				Type:  dnsTypeSSHFP,
+				Class: dnsmessage.ClassINET,
+				TTL:   300,
+			}, dnsmessage.UnknownResource{
+				Type: dnsTypeSSHFP,
+				Data: append([]byte{record.Algorithm, record.FingerprintType}, record.Fingerprint...),
+			})
+		}
+	}
+	response, err := builder.Finish()
+	if err != nil {
+		return nil
+	}
+	return response
+}
+
+func Test_verifyHostKeyDNS(t *testing.T) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIOMqqnkVzrm0SdG6UOoqKLsabgH5C9okWi0dh2l9GKJl"))
+	if err != nil {
+		t.Fatalf("failed to parse public key: %v", err)
+	}
+	otherKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte("ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIFKGJvkCkPoissrebkHB17tYjPunEULNKP8fNN6fTQ8M"))
+	if err != nil {
+		t.Fatalf("failed to parse public key: %v", err)
+	}
+
+	sha256Fingerprint := sha256.Sum256(key.Marshal())
+	sha1Fingerprint := sha1.Sum(key.Marshal())
+	otherSHA256Fingerprint := sha256.Sum256(otherKey.Marshal())
+
+	testcases := []struct {
+		name       string
+		zone       stubDNSZone
+		host       string
+		wantMatch  *bool
+		wantSecure bool
+	}{
+		{
+			name: "match sha256 secure",
+			zone: stubDNSZone{
+				records: map[string][]SSHFPRecord{"candinya.com.": {{4, 2, sha256Fingerprint[:]}}},
+				secure:  true,
+			},
+			host:       "candinya.com",
+			wantMatch:  p(true),
+			wantSecure: true,
+		},
+		{
+			name: "match sha1 insecure",
+			zone: stubDNSZone{
+				records: map[string][]SSHFPRecord{"candinya.com.": {{1, 2, []byte{1, 2, 3}}, {4, 1, sha1Fingerprint[:]}}},
+			},
+			host:       "candinya.com",
+			wantMatch:  p(true),
+			wantSecure: false,
+		},
+		{
+			name: "mismatch",
+			zone: stubDNSZone{
+				records: map[string][]SSHFPRecord{"candinya.com.": {{4, 2, otherSHA256Fingerprint[:]}}},
+				secure:  true,
+			},
+			host:       "candinya.com",
+			wantMatch:  p(false),
+			wantSecure: true,
+		},
+		{
+			name: "other algorithm only",
+			zone: stubDNSZone{
+				records: map[string][]SSHFPRecord{"candinya.com.": {{1, 2, otherSHA256Fingerprint[:]}}},
+			},
+			host:      "candinya.com",
+			wantMatch: nil,
+		},
+		{
+			name: "no such name",
+			zone: stubDNSZone{
+				records: map[string][]SSHFPRecord{},
+			},
+			host:      "candinya.com",
+			wantMatch: nil,
+		},
+		{
+			name: "truncated retry with tcp",
+			zone: stubDNSZone{
+				records:     map[string][]SSHFPRecord{"candinya.com.": {{4, 2, sha256Fingerprint[:]}}},
+				secure:      true,
+				truncateUDP: true,
+			},
+			host:       "candinya.com",
+			wantMatch:  p(true),
+			wantSecure: true,
+		},
+		{
+			name: "skip ip address",
+			zone: stubDNSZone{
+				records: map[string][]SSHFPRecord{},
+			},
+			host:      "127.0.0.1",
+			wantMatch: nil,
+		},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			resolver := startStubDNS(t, testcase.zone)
+
+			match, secure, err := verifyHostKeyDNS(resolver, testcase.host, key)
+			if err != nil {
+				t.Fatalf("failed to verify host key: %v", err)
+			}
+
+			if (match == nil) != (testcase.wantMatch == nil) || (match != nil && *match != *testcase.wantMatch) {
+				t.Errorf("Unexpected match: expected %s, got %s", formatOptionalBool(testcase.wantMatch), formatOptionalBool(match))
+			}
+
+			if secure != testcase.wantSecure {
+				t.Errorf("Unexpected secure: expected %t, got %t", testcase.wantSecure, secure)
+			}
+		})
+	}
+}
+
+func formatOptionalBool(b *bool) string {
+	if b == nil {
+		return "nil"
+	}
+	return strconv.FormatBool(*b)
+}
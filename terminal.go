@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const RequestPty = "pty-req"
+
+// terminalModeOpcodes are names of RFC 4254 terminal modes, control characters can also be named without leading V
+var terminalModeOpcodes = map[string]uint8{
+	"VINTR": ssh.VINTR, "VQUIT": ssh.VQUIT, "VERASE": ssh.VERASE, "VKILL": ssh.VKILL,
+	"VEOF": ssh.VEOF, "VEOL": ssh.VEOL, "VEOL2": ssh.VEOL2, "VSTART": ssh.VSTART,
+	"VSTOP": ssh.VSTOP, "VSUSP": ssh.VSUSP, "VDSUSP": ssh.VDSUSP, "VREPRINT": ssh.VREPRINT,
+	"VWERASE": ssh.VWERASE, "VLNEXT": ssh.VLNEXT, "VFLUSH": ssh.VFLUSH, "VSWTCH": ssh.VSWTCH,
+	"VSTATUS": ssh.VSTATUS, "VDISCARD": ssh.VDISCARD,
+
+	"IGNPAR": ssh.IGNPAR, "PARMRK": ssh.PARMRK, "INPCK": ssh.INPCK, "ISTRIP": ssh.ISTRIP,
+	"INLCR": ssh.INLCR, "IGNCR": ssh.IGNCR, "ICRNL": ssh.ICRNL, "IUCLC": ssh.IUCLC,
+	"IXON": ssh.IXON, "IXANY": ssh.IXANY, "IXOFF": ssh.IXOFF, "IMAXBEL": ssh.IMAXBEL,
+	"IUTF8": ssh.IUTF8,
+
+	"ISIG": ssh.ISIG, "ICANON": ssh.ICANON, "XCASE": ssh.XCASE, "ECHO": ssh.ECHO,
+	"ECHOE": ssh.ECHOE, "ECHOK": ssh.ECHOK, "ECHONL": ssh.ECHONL, "NOFLSH": ssh.NOFLSH,
+	"TOSTOP": ssh.TOSTOP, "IEXTEN": ssh.IEXTEN, "ECHOCTL": ssh.ECHOCTL, "ECHOKE": ssh.ECHOKE,
+	"PENDIN": ssh.PENDIN,
+
+	"OPOST": ssh.OPOST, "OLCUC": ssh.OLCUC, "ONLCR": ssh.ONLCR, "OCRNL": ssh.OCRNL,
+	"ONOCR": ssh.ONOCR, "ONLRET": ssh.ONLRET,
+
+	"CS7": ssh.CS7, "CS8": ssh.CS8, "PARENB": ssh.PARENB, "PARODD": ssh.PARODD,
+
+	"TTY_OP_ISPEED": ssh.TTY_OP_ISPEED, "TTY_OP_OSPEED": ssh.TTY_OP_OSPEED,
+}
+
+// parseTerminalSize parses "ROWSxCOLS", optionally followed by pixel size ",WIDTHxHEIGHT"
+func parseTerminalSize(value string) (rows, cols, width, height int, err error) {
+	chars, pixels, hasPixels := strings.Cut(value, ",")
+	if rows, cols, err = parseDimensions(chars); err != nil || rows == 0 || cols == 0 {
+		return 0, 0, 0, 0, fmt.Errorf("invalid terminal size %s", value)
+	}
+	if hasPixels {
+		if width, height, err = parseDimensions(pixels); err != nil {
+			return 0, 0, 0, 0, fmt.Errorf("invalid terminal pixel size %s", value)
+		}
+	}
+	return rows, cols, width, height, nil
+}
+
+func parseDimensions(value string) (int, int, error) {
+	first, second, ok := strings.Cut(strings.ToLower(value), "x")
+	if !ok {
+		return 0, 0, fmt.Errorf("missing separator x")
+	}
+	a, err := strconv.ParseUint(first, 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	b, err := strconv.ParseUint(second, 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	return int(a), int(b), nil
+}
+
+// parseTerminalModes parses comma separated "NAME=VALUE" pairs, value is a number or a control character like ^C
+func parseTerminalModes(value string) (ssh.TerminalModes, error) {
+	modes := ssh.TerminalModes{}
+	for _, pair := range strings.Split(value, ",") {
+		name, modeValue, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid terminal mode %s, expected NAME=VALUE", pair)
+		}
+
+		name = strings.ToUpper(name)
+		opcode, ok := terminalModeOpcodes[name]
+		if !ok {
+			if opcode, ok = terminalModeOpcodes["V"+name]; !ok {
+				return nil, fmt.Errorf("unknown terminal mode %s", name)
+			}
+		}
+
+		if len(modeValue) == 2 && modeValue[0] == '^' {
+			// Caret notation like stty, ^? is DEL
+			modes[opcode] = uint32(strings.ToUpper(modeValue[1:])[0]) ^ 0x40
+			continue
+		}
+		n, err := strconv.ParseUint(modeValue, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %s of terminal mode %s", modeValue, name)
+		}
+		modes[opcode] = uint32(n)
+	}
+	return modes, nil
+}
+
+// localTerminal returns terminal type and size to use when not specified, falling back to defaults
+func localTerminal() (termType string, rows, cols int) {
+	termType = os.Getenv("TERM")
+	if termType == "" {
+		termType = DefaultTerm
+	}
+
+	rows, cols = DefaultTerminalRows, DefaultTerminalCols
+	stdinFd := int(os.Stdin.Fd())
+	if term.IsTerminal(stdinFd) {
+		if width, height, err := term.GetSize(stdinFd); err == nil && width > 0 && height > 0 {
+			rows, cols = height, width
+		}
+	}
+
+	return termType, rows, cols
+}
+
+// requestPty works like ssh.Session.RequestPty, but sends pixel size as is
+func requestPty(session *ssh.Session, sessionConfig *SessionConfig) error {
+	var modeList []byte
+	for opcode, value := range sessionConfig.TerminalModes {
+		modeList = append(modeList, ssh.Marshal(struct {
+			Opcode uint8
+			Value  uint32
+		}{opcode, value})...)
+	}
+	modeList = append(modeList, 0) // TTY_OP_END
+
+	ok, err := session.SendRequest(RequestPty, true, ssh.Marshal(struct {
+		Term     string
+		Columns  uint32
+		Rows     uint32
+		Width    uint32
+		Height   uint32
+		Modelist string
+	}{
+		Term:     sessionConfig.Term,
+		Columns:  uint32(sessionConfig.Cols),
+		Rows:     uint32(sessionConfig.Rows),
+		Width:    uint32(sessionConfig.Width),
+		Height:   uint32(sessionConfig.Height),
+		Modelist: string(modeList),
+	}))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("pty request denied by server")
+	}
+	return nil
+}
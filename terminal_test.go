@@ -0,0 +1,71 @@
+package main
+
+import (
+	"golang.org/x/crypto/ssh"
+	"reflect"
+	"testing"
+)
+
+func Test_parseTerminalSize(t *testing.T) {
+	testcases := []struct {
+		name                             string
+		value                            string
+		wantRows, wantCols, wantW, wantH int
+		wantErr                          bool
+	}{
+		{name: "chars", value: "50x132", wantRows: 50, wantCols: 132},
+		{name: "upper case separator", value: "50X132", wantRows: 50, wantCols: 132},
+		{name: "pixels", value: "24x80,640x384", wantRows: 24, wantCols: 80, wantW: 640, wantH: 384},
+		{name: "missing cols", value: "24", wantErr: true},
+		{name: "zero", value: "0x80", wantErr: true},
+		{name: "negative", value: "-1x80", wantErr: true},
+		{name: "invalid pixels", value: "24x80,640", wantErr: true},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			rows, cols, width, height, err := parseTerminalSize(testcase.value)
+			if (err != nil) != testcase.wantErr {
+				t.Fatalf("Unexpected error: want error %t, got %v", testcase.wantErr, err)
+			}
+			if rows != testcase.wantRows || cols != testcase.wantCols || width != testcase.wantW || height != testcase.wantH {
+				t.Errorf("Unexpected size: expected %dx%d,%dx%d, got %dx%d,%dx%d", testcase.wantRows, testcase.wantCols, testcase.wantW, testcase.wantH, rows, cols, width, height)
+			}
+		})
+	}
+}
+
+func Test_parseTerminalModes(t *testing.T) {
+	testcases := []struct {
+		name    string
+		value   string
+		want    ssh.TerminalModes
+		wantErr bool
+	}{
+		{name: "number", value: "VINTR=3", want: ssh.TerminalModes{ssh.VINTR: 3}},
+		{name: "without V prefix", value: "erase=127", want: ssh.TerminalModes{ssh.VERASE: 127}},
+		{name: "caret", value: "VINTR=^C,VERASE=^?,VSUSP=^z", want: ssh.TerminalModes{ssh.VINTR: 3, ssh.VERASE: 127, ssh.VSUSP: 26}},
+		{name: "flags", value: "IUTF8=1, ECHO=0", want: ssh.TerminalModes{ssh.IUTF8: 1, ssh.ECHO: 0}},
+		{name: "unknown", value: "VFOO=1", wantErr: true},
+		{name: "missing value", value: "ECHO", wantErr: true},
+		{name: "invalid value", value: "ECHO=yes", wantErr: true},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			modes, err := parseTerminalModes(testcase.value)
+			if (err != nil) != testcase.wantErr {
+				t.Fatalf("Unexpected error: want error %t, got %v", testcase.wantErr, err)
+			}
+			if !testcase.wantErr && !reflect.DeepEqual(modes, testcase.want) {
+				t.Errorf("Unexpected modes: expected %v, got %v", testcase.want, modes)
+			}
+		})
+	}
+}
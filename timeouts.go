@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	PhaseConnect       = "connect"       // TCP connect, or opening tunnel through jump server
+	PhaseHandshake     = "handshake"     // version exchange and key exchange
+	PhaseAuth          = "auth"          // user authentication
+	PhaseHostKeyPrompt = "hostKeyPrompt" // waiting for user to reply hostKey event
+)
+
+// TimeoutError tells which phase took too long
+type TimeoutError struct {
+	Phase   string
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %s", e.Phase, e.Timeout)
+}
+
+// phaseWatchdog closes conn when current phase takes too long.
+// Deadlines are not supported by connections tunneled through jump server, so closing is the only reliable way.
+type phaseWatchdog struct {
+	conn net.Conn
+
+	lock       sync.Mutex
+	timer      *time.Timer
+	generation int // timers of previous phases may fire while being stopped, ignore them
+	expired    *TimeoutError
+}
+
+func newPhaseWatchdog(conn net.Conn) *phaseWatchdog {
+	return &phaseWatchdog{conn: conn}
+}
+
+// start watching a new phase, previous one is considered finished. Non-positive timeout means no limit
+func (w *phaseWatchdog) start(phase string, timeout time.Duration) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.reset()
+	if timeout <= 0 || w.expired != nil {
+		return
+	}
+
+	generation := w.generation
+	w.timer = time.AfterFunc(timeout, func() {
+		w.lock.Lock()
+		if w.generation != generation {
+			// Phase already finished
+			w.lock.Unlock()
+			return
+		}
+		w.expired = &TimeoutError{Phase: phase, Timeout: timeout}
+		w.lock.Unlock()
+
+		_ = w.conn.Close()
+	})
+}
+
+// stop watching, returns the phase timed out if any
+func (w *phaseWatchdog) stop() *TimeoutError {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.reset()
+	return w.expired
+}
+
+// reset stops current timer, should be called with lock held
+func (w *phaseWatchdog) reset() {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	w.generation++
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_newClient_timeouts(t *testing.T) {
+	const (
+		timeout = 200 * time.Millisecond
+		stall   = 600 * time.Millisecond
+	)
+
+	testcases := []struct {
+		name           string
+		silentServer   bool          // accept TCP but never speak SSH
+		authDelay      time.Duration // server delays password check
+		hostKeyDelay   time.Duration // user takes time to verify host key
+		wantErrPhase   string
+		wantConnection bool
+	}{
+		{name: "handshake", silentServer: true, wantErrPhase: PhaseHandshake},
+		{name: "auth", authDelay: stall, wantErrPhase: PhaseAuth},
+		{name: "host key prompt not limited", hostKeyDelay: stall, wantConnection: true},
+		{name: "in time", wantConnection: true},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("failed to listen: %v", err)
+			}
+			defer listener.Close()
+
+			serverConfig := &ssh.ServerConfig{
+				PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+					time.Sleep(testcase.authDelay)
+					return nil, nil
+				},
+			}
+			serverConfig.AddHostKey(newTestSigner(t))
+			go func() {
+				serverPipe, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer serverPipe.Close()
+				if testcase.silentServer {
+					time.Sleep(stall)
+					return
+				}
+				serverConn, chans, reqs, err := ssh.NewServerConn(serverPipe, serverConfig)
+				if err != nil {
+					return
+				}
+				defer serverConn.Close()
+				go ssh.DiscardRequests(reqs)
+				for newChannel := range chans {
+					_ = newChannel.Reject(ssh.Prohibited, "not supported")
+				}
+			}()
+
+			conn, err := dialTCP(listener.Addr().String(), timeout, &HopTiming{})
+			if err != nil {
+				t.Fatalf("failed to dial: %v", err)
+			}
+
+			client, err := newClient(conn, "candinya.com:22", &ssh.ClientConfig{
+				User: "root",
+				Auth: []ssh.AuthMethod{ssh.Password("password")},
+				HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+					time.Sleep(testcase.hostKeyDelay)
+					return nil
+				},
+			}, nil, HopTarget, &Server{
+				ConnectionConfig: &ConnectionConfig{
+					HandshakeTimeout: timeout,
+					AuthTimeout:      timeout,
+				},
+				Timing: &HopTiming{},
+			})
+
+			if testcase.wantConnection {
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				_ = client.Close()
+				return
+			}
+
+			var timeoutErr *TimeoutError
+			if !errors.As(err, &timeoutErr) {
+				t.Fatalf("Unexpected error: want timeout, got %v", err)
+			}
+			if timeoutErr.Phase != testcase.wantErrPhase {
+				t.Errorf("Unexpected phase: expected %s, got %s", testcase.wantErrPhase, timeoutErr.Phase)
+			}
+		})
+	}
+}
+
+// countingSigner counts key exchanges by signatures of host key
+type countingSigner struct {
+	ssh.Signer
+	signed *atomic.Int32
+}
+
+func (s *countingSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	s.signed.Add(1)
+	return s.Signer.Sign(rand, data)
+}
+
+// Test_newClient_rekey keeps a connection busy long enough for several re-keys, which must not re-arm phase limits or ask for host key again
+func Test_newClient_rekey(t *testing.T) {
+	const timeout = 300 * time.Millisecond
+
+	var signed atomic.Int32
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(&countingSigner{Signer: newTestSigner(t), signed: &signed})
+	address := newTestServer(t, serverConfig, func(_ ssh.Conn, req *ssh.Request) {
+		_ = req.Reply(true, nil)
+	}, nil)
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+
+	var verified atomic.Int32
+	client, err := newClient(conn, "candinya.com:22", &ssh.ClientConfig{
+		Config: ssh.Config{RekeyThreshold: 1024},
+		User:   "root",
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			verified.Add(1)
+			return nil
+		},
+	}, nil, HopTarget, &Server{
+		ConnectionConfig: &ConnectionConfig{
+			HandshakeTimeout: timeout,
+			AuthTimeout:      timeout,
+		},
+		Timing: &HopTiming{},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer client.Close()
+
+	// Re-key, then stay idle longer than any phase limit
+	payload := make([]byte, 512)
+	for i := 0; i < 10; i++ {
+		if _, _, err := client.SendRequest("keepalive@openssh.com", true, payload); err != nil {
+			t.Fatalf("failed to send request: %v", err)
+		}
+	}
+	time.Sleep(2 * timeout)
+	if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+		t.Fatalf("connection closed after re-key: %v", err)
+	}
+	if signed.Load() < 2 {
+		t.Errorf("got %d key exchanges, want re-keyed", signed.Load())
+	}
+	if verified.Load() != 1 {
+		t.Errorf("got host key verified %d times, want only once", verified.Load())
+	}
+}
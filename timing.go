@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// HopTiming records how long each phase takes to connect a hop, all durations are in milliseconds
+type HopTiming struct {
+	Hop         string             `json:"hop"`
+	Host        string             `json:"h"`
+	DNS         float64            `json:"dns,omitempty"` // omitted for IP address, or resolved by jump server
+	Connect     float64            `json:"connect"`
+	Handshake   float64            `json:"handshake"`
+	HostKey     float64            `json:"hostKey"` // including waiting for user reply
+	Auth        float64            `json:"auth"`
+	AuthMethods []AuthMethodTiming `json:"authMethods,omitempty"` // in the order tried
+
+	lock             sync.Mutex
+	authMethodStarts []time.Time
+}
+
+type AuthMethodTiming struct {
+	Method   string  `json:"m"`
+	Duration float64 `json:"d"`
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// markAuthMethod is called when server starts to try an auth method
+func (t *HopTiming) markAuthMethod(method string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.AuthMethods = append(t.AuthMethods, AuthMethodTiming{Method: method})
+	t.authMethodStarts = append(t.authMethodStarts, time.Now())
+}
+
+// finishAuth calculates duration of each auth method, every method lasts till the next one starts
+func (t *HopTiming) finishAuth(authEnd time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for i := range t.AuthMethods {
+		methodEnd := authEnd
+		if i+1 < len(t.authMethodStarts) {
+			methodEnd = t.authMethodStarts[i+1]
+		}
+		t.AuthMethods[i].Duration = milliseconds(methodEnd.Sub(t.authMethodStarts[i]))
+	}
+}
+
+// resolveAddress looks up host of address, IP addresses are returned as is
+func resolveAddress(ctx context.Context, address string) ([]string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to split address %s: %w", address, err)
+	}
+	if net.ParseIP(host) != nil {
+		return []string{address}, nil
+	}
+
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var addresses []string
+	for _, ip := range ips {
+		addresses = append(addresses, net.JoinHostPort(ip.String(), port))
+	}
+	return addresses, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_HopTiming_finishAuth(t *testing.T) {
+	start := time.Now()
+
+	testcases := []struct {
+		name         string
+		methodStarts []time.Duration
+		authEnd      time.Duration
+		want         []float64
+	}{
+		{
+			name: "no method",
+		},
+		{
+			name:         "single method",
+			methodStarts: []time.Duration{10 * time.Millisecond},
+			authEnd:      25 * time.Millisecond,
+			want:         []float64{15},
+		},
+		{
+			name:         "fallback",
+			methodStarts: []time.Duration{0, 40 * time.Millisecond},
+			authEnd:      100 * time.Millisecond,
+			want:         []float64{40, 60},
+		},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			timing := &HopTiming{}
+			for _, methodStart := range testcase.methodStarts {
+				timing.AuthMethods = append(timing.AuthMethods, AuthMethodTiming{Method: "password"})
+				timing.authMethodStarts = append(timing.authMethodStarts, start.Add(methodStart))
+			}
+
+			timing.finishAuth(start.Add(testcase.authEnd))
+
+			var got []float64
+			for _, method := range timing.AuthMethods {
+				got = append(got, method.Duration)
+			}
+			if !reflect.DeepEqual(got, testcase.want) {
+				t.Errorf("Unexpected durations: expected %v, got %v", testcase.want, got)
+			}
+		})
+	}
+}
+
+func Test_resolveAddress(t *testing.T) {
+	testcases := []struct {
+		name    string
+		address string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:    "ipv4",
+			address: "127.0.0.1:22",
+			want:    []string{"127.0.0.1:22"},
+		},
+		{
+			name:    "ipv6",
+			address: "[::1]:22",
+			want:    []string{"[::1]:22"},
+		},
+		{
+			name:    "missing port",
+			address: "127.0.0.1",
+			wantErr: true,
+		},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := resolveAddress(context.Background(), testcase.address)
+			if (err != nil) != testcase.wantErr {
+				t.Fatalf("Unexpected error: want error %t, got %v", testcase.wantErr, err)
+			}
+			if !reflect.DeepEqual(got, testcase.want) {
+				t.Errorf("Unexpected addresses: expected %v, got %v", testcase.want, got)
+			}
+		})
+	}
+}
@@ -1,5 +1,10 @@
 package main
 
+import (
+	"golang.org/x/crypto/ssh"
+	"time"
+)
+
 type Server struct {
 	// Authentication
 	Username *string
@@ -8,4 +13,85 @@ type Server struct {
 	// SSH server
 	Host string
 	Port int
+
+	// Settings for this hop
+	HostKeyConfig    *HostKeyConfig
+	ConnectionConfig *ConnectionConfig
+
+	// Filled while connecting
+	Timing *HopTiming
+}
+
+type ConnectionConfig struct {
+	// Limits of each connection phase, 0 means no limit
+	ConnectTimeout   time.Duration
+	HandshakeTimeout time.Duration
+	AuthTimeout      time.Duration
+
+	// Algorithm preferences, nil means library defaults
+	Ciphers                  []string
+	KexAlgorithms            []string
+	MACs                     []string
+	HostKeyAlgorithms        []string
+	PubkeyAcceptedAlgorithms []string
+
+	ServerAliveInterval time.Duration // 0 means disabled
+	ServerAliveCountMax int
+}
+
+type SessionConfig struct {
+	RequestPty bool   // otherwise local signals are forwarded to remote
+	Subsystem  string // requested instead of shell if set, stdin is piped as is
+
+	// Pseudo terminal
+	Term          string
+	Rows, Cols    int
+	Width, Height int // in pixels, 0 means unknown
+	TerminalModes ssh.TerminalModes
+
+	// Environment variables
+	SendEnv []string    // patterns of local variable names
+	SetEnv  [][2]string // name and value
+
+	// Agent forwarding
+	ForwardAgent        bool
+	AgentSocket         string // empty means SSH_AUTH_SOCK
+	ForwardAgentConfirm bool   // ask before each signing request
+
+	// X11 forwarding
+	ForwardX11        bool
+	ForwardX11Trusted bool   // otherwise remote clients get an untrusted cookie
+	XAuthLocation     string // xauth program
+}
+
+type IdentityConfig struct {
+	IdentityFiles  []string // in addition to -i
+	IdentitiesOnly bool     // don't search ~/.ssh for other keys
+}
+
+type HostKeyConfig struct {
+	UserKnownHostsFile    *string       // read-write, nil means host keys are not saved
+	GlobalKnownHostsFiles []string      // read-only, always take precedence over user file
+	StrictHostKeyChecking string        // how to deal with unknown or changed keys
+	HostKeyAlias          *string       // name used in known_hosts files instead of host and port
+	PromptTimeout         time.Duration // waiting for reply of hostKey event, 0 means no limit
+	Tunneled              bool          // connected through another hop, so remote address is not the real peer
+
+	VerifyHostKeyDNS         string // whether to check SSHFP records
+	VerifyHostKeyDNSResolver string // DNS server address (host:port), empty for system default
+}
+
+type SSHFPRecord struct {
+	Algorithm       uint8
+	FingerprintType uint8
+	Fingerprint     []byte
+}
+
+type KnownHostsLine struct {
+	Hosts []string
+	Key   ssh.PublicKey
+
+	// Position in known_hosts file, including line separator
+	Start int64
+	End   int64
 }
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	RequestX11 = "x11-req"
+	ChannelX11 = "x11"
+
+	X11AuthProtocol  = "MIT-MAGIC-COOKIE-1"
+	X11UnixSocketDir = "/tmp/.X11-unix"
+	X11TCPPortBase   = 6000
+	X11CookieLength  = 16 // when there's no real cookie to follow
+)
+
+// X11Display is where local X server listens, parsed from DISPLAY
+type X11Display struct {
+	Network   string // unix or tcp
+	Address   string
+	Number    int
+	Screen    int
+	XauthName string // display name to look up in xauth
+}
+
+// parseDisplay accepts DISPLAY as [host]:number[.screen], unix:number[.screen] or launchd socket path /path/to/socket:number
+func parseDisplay(display string) (*X11Display, error) {
+	if display == "" {
+		return nil, fmt.Errorf("DISPLAY is not set")
+	}
+
+	colon := strings.LastIndex(display, ":")
+	if colon == -1 {
+		return nil, fmt.Errorf("invalid display %s", display)
+	}
+	host, numberStr := display[:colon], display[colon+1:]
+	screenStr := "0"
+	if dot := strings.Index(numberStr, "."); dot != -1 {
+		numberStr, screenStr = numberStr[:dot], numberStr[dot+1:]
+	}
+	number, err := strconv.Atoi(numberStr)
+	if err != nil || number < 0 {
+		return nil, fmt.Errorf("invalid display number in %s", display)
+	}
+	screen, err := strconv.Atoi(screenStr)
+	if err != nil || screen < 0 {
+		return nil, fmt.Errorf("invalid screen number in %s", display)
+	}
+
+	d := &X11Display{Number: number, Screen: screen, XauthName: display}
+	switch {
+	case strings.HasPrefix(host, "/"):
+		// Socket created by launchd for XQuartz
+		d.Network, d.Address = "unix", host
+	case host == "" || host == "unix":
+		d.Network, d.Address = "unix", filepath.Join(X11UnixSocketDir, "X"+numberStr)
+		d.XauthName = "unix:" + numberStr
+	default:
+		// IPv6 address is bracketed in DISPLAY, JoinHostPort adds brackets again
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		d.Network, d.Address = "tcp", net.JoinHostPort(host, strconv.Itoa(X11TCPPortBase+number))
+		if host == "localhost" {
+			// xauth saves local displays by unix name
+			d.XauthName = "unix:" + numberStr
+		}
+	}
+	return d, nil
+}
+
+// parseXauthList finds MIT cookie in output of xauth list, which looks like "host/unix:0  MIT-MAGIC-COOKIE-1  hex"
+func parseXauthList(output []byte) ([]byte, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[1] != X11AuthProtocol {
+			continue
+		}
+		cookie, err := hex.DecodeString(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cookie: %w", err)
+		}
+		return cookie, nil
+	}
+	return nil, nil
+}
+
+// xauthCookie gets cookie of local display from xauth, nil if there's none.
+// Untrusted cookie is generated with SECURITY extension, so remote clients can't take over other windows.
+func xauthCookie(xauthLocation string, display *X11Display, trusted bool) ([]byte, error) {
+	if trusted {
+		output, err := exec.Command(xauthLocation, "list", display.XauthName).Output()
+		if err != nil {
+			// No xauth at all, local server may not need authentication
+			LogDebug(LogLevelDebug1, "failed to run xauth: %v", err)
+			return nil, nil
+		}
+		return parseXauthList(output)
+	}
+
+	dir, err := os.MkdirTemp("", "pipessh-xauth-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	authFile := filepath.Join(dir, "xauthfile")
+
+	// Timeout 0 keeps cookie valid till server resets
+	if output, err := exec.Command(xauthLocation, "-f", authFile, "generate", display.XauthName, X11AuthProtocol, "untrusted", "timeout", "0").CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("failed to generate untrusted cookie: %w: %s", err, bytes.TrimSpace(output))
+	}
+	output, err := exec.Command(xauthLocation, "-f", authFile, "list", display.XauthName).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list untrusted cookie: %w", err)
+	}
+	cookie, err := parseXauthList(output)
+	if err != nil {
+		return nil, err
+	}
+	if cookie == nil {
+		return nil, fmt.Errorf("untrusted cookie is not generated")
+	}
+	return cookie, nil
+}
+
+// X11Forwarding connects x11 channels to local display, remote only knows a fake cookie
+type X11Forwarding struct {
+	display    *X11Display
+	fakeCookie []byte
+	realCookie []byte // nil if local server doesn't need one
+}
+
+// forwardX11 requests X11 forwarding on session, and serves x11 channels opened by server
+func forwardX11(client *ssh.Client, session *ssh.Session, display string, trusted bool, xauthLocation string) error {
+	x11Display, err := parseDisplay(display)
+	if err != nil {
+		return err
+	}
+	realCookie, err := xauthCookie(xauthLocation, x11Display, trusted)
+	if err != nil {
+		return err
+	}
+
+	// Same length as real one, so remote clients can't tell
+	cookieLength := X11CookieLength
+	if realCookie != nil {
+		cookieLength = len(realCookie)
+	}
+	fakeCookie := make([]byte, cookieLength)
+	if _, err = rand.Read(fakeCookie); err != nil {
+		return fmt.Errorf("failed to generate cookie: %w", err)
+	}
+	forwarding := &X11Forwarding{display: x11Display, fakeCookie: fakeCookie, realCookie: realCookie}
+
+	channels := client.HandleChannelOpen(ChannelX11)
+	if channels == nil {
+		return fmt.Errorf("x11 forwarding is already set up")
+	}
+	go func() {
+		for newChannel := range channels {
+			go forwarding.serve(newChannel)
+		}
+	}()
+
+	LogDebug(LogLevelDebug2, "requesting x11 forwarding to %s %s", x11Display.Network, x11Display.Address)
+	ok, err := session.SendRequest(RequestX11, true, ssh.Marshal(struct {
+		SingleConnection bool
+		AuthProtocol     string
+		AuthCookie       string
+		ScreenNumber     uint32
+	}{
+		SingleConnection: false,
+		AuthProtocol:     X11AuthProtocol,
+		AuthCookie:       hex.EncodeToString(fakeCookie),
+		ScreenNumber:     uint32(x11Display.Screen),
+	}))
+	if err != nil {
+		return fmt.Errorf("failed to request x11 forwarding: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("x11 forwarding is denied by server")
+	}
+	return nil
+}
+
+func (f *X11Forwarding) serve(newChannel ssh.NewChannel) {
+	channel, reqs, err := newChannel.Accept()
+	if err != nil {
+		LogError(fmt.Errorf("failed to accept x11 channel: %w", err))
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	LogDebug(LogLevelDebug1, "remote opened x11 connection")
+
+	if err = f.forward(channel); err != nil {
+		LogError(fmt.Errorf("failed to forward x11 connection: %w", err))
+	}
+}
+
+// forward checks fake cookie in connection setup of remote client, and connects it to local display with real cookie
+func (f *X11Forwarding) forward(channel io.ReadWriteCloser) error {
+	defer channel.Close()
+
+	setup, err := f.substituteCookie(channel)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.Dial(f.display.Network, f.display.Address)
+	if err != nil {
+		return fmt.Errorf("failed to connect to display: %w", err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write(setup); err != nil {
+		return fmt.Errorf("failed to send connection setup: %w", err)
+	}
+
+	go func() {
+		_, _ = io.Copy(conn, channel)
+		_ = conn.Close()
+	}()
+	_, _ = io.Copy(channel, conn)
+	return nil
+}
+
+// substituteCookie reads connection setup from r, and returns it with real cookie
+func (f *X11Forwarding) substituteCookie(r io.Reader) ([]byte, error) {
+	// byte-order, unused, major, minor, name length, data length, unused
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("failed to read connection setup: %w", err)
+	}
+	var byteOrder binary.ByteOrder
+	switch header[0] {
+	case 'B':
+		byteOrder = binary.BigEndian
+	case 'l':
+		byteOrder = binary.LittleEndian
+	default:
+		return nil, fmt.Errorf("invalid byte order %q", header[0])
+	}
+
+	nameLength, dataLength := int(byteOrder.Uint16(header[6:])), int(byteOrder.Uint16(header[8:]))
+	auth := make([]byte, x11Pad(nameLength)+x11Pad(dataLength))
+	if _, err := io.ReadFull(r, auth); err != nil {
+		return nil, fmt.Errorf("failed to read connection setup: %w", err)
+	}
+	name, data := auth[:nameLength], auth[x11Pad(nameLength):x11Pad(nameLength)+dataLength]
+	if string(name) != X11AuthProtocol || subtle.ConstantTimeCompare(data, f.fakeCookie) != 1 {
+		return nil, fmt.Errorf("authentication of remote client doesn't match")
+	}
+
+	// Without real cookie, let local server decide by other means like xhost
+	realName := ""
+	if f.realCookie != nil {
+		realName = X11AuthProtocol
+	}
+	setup := append([]byte{}, header...)
+	byteOrder.PutUint16(setup[6:], uint16(len(realName)))
+	byteOrder.PutUint16(setup[8:], uint16(len(f.realCookie)))
+	setup = append(setup, realName...)
+	setup = append(setup, make([]byte, x11Pad(len(realName))-len(realName))...)
+	setup = append(setup, f.realCookie...)
+	setup = append(setup, make([]byte, x11Pad(len(f.realCookie))-len(f.realCookie))...)
+	return setup, nil
+}
+
+// x11Pad rounds n up to multiple of 4
+func x11Pad(n int) int {
+	return (n + 3) &^ 3
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_parseDisplay(t *testing.T) {
+	testcases := []struct {
+		name    string
+		display string
+		wantErr bool
+		want    X11Display
+	}{
+		{
+			name:    "local",
+			display: ":0",
+			want:    X11Display{Network: "unix", Address: filepath.Join(X11UnixSocketDir, "X0"), XauthName: "unix:0"},
+		},
+		{
+			name:    "unix with screen",
+			display: "unix:1.2",
+			want:    X11Display{Network: "unix", Address: filepath.Join(X11UnixSocketDir, "X1"), Number: 1, Screen: 2, XauthName: "unix:1"},
+		},
+		{
+			name:    "localhost",
+			display: "localhost:10.0",
+			want:    X11Display{Network: "tcp", Address: "localhost:6010", Number: 10, XauthName: "unix:10"},
+		},
+		{
+			name:    "remote host",
+			display: "192.168.1.2:0",
+			want:    X11Display{Network: "tcp", Address: "192.168.1.2:6000", XauthName: "192.168.1.2:0"},
+		},
+		{
+			name:    "ipv6 host",
+			display: "[::1]:0",
+			want:    X11Display{Network: "tcp", Address: "[::1]:6000", XauthName: "[::1]:0"},
+		},
+		{
+			name:    "launchd",
+			display: "/private/tmp/com.apple.launchd.abc/org.xquartz:0",
+			want:    X11Display{Network: "unix", Address: "/private/tmp/com.apple.launchd.abc/org.xquartz", XauthName: "/private/tmp/com.apple.launchd.abc/org.xquartz:0"},
+		},
+		{name: "empty", display: "", wantErr: true},
+		{name: "no number", display: "localhost", wantErr: true},
+		{name: "invalid number", display: ":x", wantErr: true},
+		{name: "invalid screen", display: ":0.x", wantErr: true},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := parseDisplay(testcase.display)
+			if (err != nil) != testcase.wantErr {
+				t.Fatalf("got error %v, want error %v", err, testcase.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if *got != testcase.want {
+				t.Errorf("got %+v, want %+v", *got, testcase.want)
+			}
+		})
+	}
+}
+
+func Test_parseXauthList(t *testing.T) {
+	testcases := []struct {
+		name    string
+		output  string
+		wantErr bool
+		want    []byte
+	}{
+		{
+			name:   "cookie",
+			output: "nekops/unix:0  XDM-AUTHORIZATION-1  00112233\nnekops/unix:0  MIT-MAGIC-COOKIE-1  0123456789abcdef\n",
+			want:   []byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef},
+		},
+		{name: "none", output: "", want: nil},
+		{name: "invalid", output: "nekops/unix:0  MIT-MAGIC-COOKIE-1  xyz\n", wantErr: true},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := parseXauthList([]byte(testcase.output))
+			if (err != nil) != testcase.wantErr {
+				t.Fatalf("got error %v, want error %v", err, testcase.wantErr)
+			}
+			if !bytes.Equal(got, testcase.want) {
+				t.Errorf("got %x, want %x", got, testcase.want)
+			}
+		})
+	}
+}
+
+// x11Setup builds connection setup sent by X clients
+func x11Setup(byteOrder binary.ByteOrder, name string, data []byte) []byte {
+	setup := make([]byte, 12)
+	if byteOrder == binary.BigEndian {
+		setup[0] = 'B'
+	} else {
+		setup[0] = 'l'
+	}
+	byteOrder.PutUint16(setup[2:], 11)
+	byteOrder.PutUint16(setup[6:], uint16(len(name)))
+	byteOrder.PutUint16(setup[8:], uint16(len(data)))
+	setup = append(setup, name...)
+	setup = append(setup, make([]byte, x11Pad(len(name))-len(name))...)
+	setup = append(setup, data...)
+	return append(setup, make([]byte, x11Pad(len(data))-len(data))...)
+}
+
+func Test_X11Forwarding_forward(t *testing.T) {
+	fakeCookie := []byte("fake-cookie-0123")
+	realCookie := []byte("real-cookie-4567")
+
+	testcases := []struct {
+		name       string
+		realCookie []byte
+		setup      []byte
+		wantSetup  []byte // received by local server, nil if it shouldn't be connected
+	}{
+		{
+			name:       "big endian",
+			realCookie: realCookie,
+			setup:      x11Setup(binary.BigEndian, X11AuthProtocol, fakeCookie),
+			wantSetup:  x11Setup(binary.BigEndian, X11AuthProtocol, realCookie),
+		},
+		{
+			name:       "little endian",
+			realCookie: realCookie,
+			setup:      x11Setup(binary.LittleEndian, X11AuthProtocol, fakeCookie),
+			wantSetup:  x11Setup(binary.LittleEndian, X11AuthProtocol, realCookie),
+		},
+		{
+			name:      "no real cookie",
+			setup:     x11Setup(binary.LittleEndian, X11AuthProtocol, fakeCookie),
+			wantSetup: x11Setup(binary.LittleEndian, "", nil),
+		},
+		{
+			name:       "wrong cookie",
+			realCookie: realCookie,
+			setup:      x11Setup(binary.BigEndian, X11AuthProtocol, []byte("guessed-cookie-0")),
+		},
+		{
+			name:       "other protocol",
+			realCookie: realCookie,
+			setup:      x11Setup(binary.BigEndian, "XDM-AUTHORIZATION-1", fakeCookie),
+		},
+	}
+
+	for _, testcase := range testcases {
+		testcase := testcase
+		t.Run(testcase.name, func(t *testing.T) {
+			t.Parallel()
+
+			// Fake X server replies with what it received
+			socket := filepath.Join(t.TempDir(), "X0")
+			listener, err := net.Listen("unix", socket)
+			if err != nil {
+				t.Skipf("unix socket is not available: %v", err)
+			}
+			defer listener.Close()
+			received := make(chan []byte, 1)
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				setup := make([]byte, len(testcase.wantSetup))
+				if _, err = io.ReadFull(conn, setup); err != nil {
+					return
+				}
+				received <- setup
+				_, _ = conn.Write([]byte("welcome"))
+			}()
+
+			forwarding := &X11Forwarding{
+				display:    &X11Display{Network: "unix", Address: socket},
+				fakeCookie: fakeCookie,
+				realCookie: testcase.realCookie,
+			}
+			remote, channel := net.Pipe()
+			defer remote.Close()
+			forwardDone := make(chan error, 1)
+			go func() {
+				forwardDone <- forwarding.forward(channel)
+			}()
+
+			go func() {
+				_, _ = remote.Write(testcase.setup)
+			}()
+
+			if testcase.wantSetup == nil {
+				if err := <-forwardDone; err == nil {
+					t.Errorf("got no error, want rejected")
+				}
+				return
+			}
+
+			select {
+			case got := <-received:
+				if !bytes.Equal(got, testcase.wantSetup) {
+					t.Errorf("got setup %q, want %q", got, testcase.wantSetup)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out waiting for local server")
+			}
+			reply := make([]byte, len("welcome"))
+			if _, err := io.ReadFull(remote, reply); err != nil || string(reply) != "welcome" {
+				t.Errorf("got reply %q %v, want welcome", reply, err)
+			}
+		})
+	}
+}